@@ -47,6 +47,9 @@ dependencies {
     implementation("org.eclipse.paho:org.eclipse.paho.client.mqttv3:1.2.5")
     implementation("org.eclipse.paho:org.eclipse.paho.android.service:1.1.1")
     
+    // Ed25519, to verify signed settings on API levels before 33
+    implementation("org.bouncycastle:bcprov-jdk18on:1.78.1")
+    
     // Coroutines for async operations
     implementation("org.jetbrains.kotlinx:kotlinx-coroutines-android:1.7.3")
     
@@ -3,6 +3,12 @@ package com.hoppyshare.android
 import android.content.Context
 import android.util.Base64
 import android.util.Log
+import org.bouncycastle.asn1.x500.X500Name
+import org.bouncycastle.asn1.x500.style.BCStyle
+import org.bouncycastle.crypto.params.Ed25519PublicKeyParameters
+import org.bouncycastle.crypto.util.PublicKeyFactory
+import java.security.cert.CertificateFactory
+import java.security.cert.X509Certificate
 import java.security.interfaces.RSAPrivateKey
 import javax.crypto.spec.OAEPParameterSpec
 
@@ -14,6 +20,7 @@ object Config {
     var keyPem: String = ""
     var caPem: String = ""
     var groupKey: String = ""
+    var settingsKey: String = "" // PEM, empty on devices set up before settings were signed
     
     fun loadFromPreferences(context: Context): Boolean {
         return try {
@@ -28,6 +35,7 @@ object Config {
             keyPem = prefs.getString("client_key", "") ?: ""
             caPem = prefs.getString("ca_cert", "") ?: ""
             groupKey = prefs.getString("group_key", "") ?: ""
+            settingsKey = prefs.getString("settings_key", "") ?: ""
             
             if (deviceId.isEmpty() || certPem.isEmpty() || keyPem.isEmpty() || 
                 caPem.isEmpty() || groupKey.isEmpty()) {
@@ -77,6 +85,34 @@ object Config {
         }
     }
     
+    // Ed25519 keys the settings topic is signed with, every PUBLIC KEY block
+    // of settingsKey
+    fun getSettingsKeys(): List<Ed25519PublicKeyParameters> {
+        val pem = Regex("-----BEGIN PUBLIC KEY-----(.*?)-----END PUBLIC KEY-----", RegexOption.DOT_MATCHES_ALL)
+        return pem.findAll(settingsKey).mapNotNull { block ->
+            try {
+                val der = Base64.decode(block.groupValues[1].replace("\n", "").replace("\r", "").trim(), Base64.DEFAULT)
+                PublicKeyFactory.createKey(der) as? Ed25519PublicKeyParameters
+            } catch (e: Exception) {
+                Log.e("Config", "Invalid settings key: ${e.message}")
+                null
+            }
+        }.toList()
+    }
+
+    // The account this device belongs to, the common name of its certificate
+    fun getAccountId(): String? {
+        return try {
+            val cert = CertificateFactory.getInstance("X.509")
+                .generateCertificate(certPem.byteInputStream()) as X509Certificate
+            X500Name.getInstance(cert.subjectX500Principal.encoded)
+                .getRDNs(BCStyle.CN).firstOrNull()?.first?.value?.toString()
+        } catch (e: Exception) {
+            Log.e("Config", "Failed to read account from certificate: ${e.message}")
+            null
+        }
+    }
+
     private fun hexStringToByteArray(s: String): ByteArray {
         val len = s.length
         val data = ByteArray(len / 2)
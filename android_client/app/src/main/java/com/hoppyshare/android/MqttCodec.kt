@@ -38,7 +38,11 @@ data class DecodedPayload(
     }
 }
 
+// Only V0 frames (see desktop_client/mqttclient/codec.go) are supported.
+// The device publishes no capabilities, so desktops always send it V0;
+// frames in the versioned envelope are refused instead of misread.
 object MqttCodec {
+    private val frameMagic = byteArrayOf(0xFF.toByte(), 'H'.code.toByte(), 'S'.code.toByte())
     
     fun encodeMessage(mimeType: String, filename: String, deviceId: String, payload: ByteArray): ByteArray {
         android.util.Log.d("MqttCodec", "encodeMessage() called:")
@@ -85,6 +89,11 @@ object MqttCodec {
     }
     
     fun decodeMessage(data: ByteArray): DecodedPayload {
+        if (data.size >= frameMagic.size && data.sliceArray(0 until frameMagic.size).contentEquals(frameMagic)) {
+            val version = if (data.size > frameMagic.size) data[frameMagic.size].toInt() and 0xFF else -1
+            throw IllegalArgumentException("Unsupported frame version $version")
+        }
+
         val input = ByteArrayInputStream(data)
         
         // Read header
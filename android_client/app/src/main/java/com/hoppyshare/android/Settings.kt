@@ -2,7 +2,9 @@ package com.hoppyshare.android
 
 import android.content.Context
 import android.content.SharedPreferences
+import android.util.Base64
 import android.util.Log
+import org.bouncycastle.crypto.signers.Ed25519Signer
 import org.json.JSONArray
 import org.json.JSONObject
 
@@ -17,6 +19,10 @@ object Settings {
     private const val KEY_NICKNAME = "nickname"
     private const val KEY_MUTED = "muted"
     private const val KEY_SEND_TO_SELF = "send_to_self"
+    private const val KEY_SIGNED_AT = "signed_at"
+
+    // see desktop_client/settings/signed.go
+    private const val SETTINGS_DOMAIN = "hoppyshare-settings-v1"
     
     private var currentSettings = AppSettings()
     private lateinit var sharedPrefs: SharedPreferences
@@ -54,9 +60,59 @@ object Settings {
         Log.d("Settings", "Saved settings: $currentSettings")
     }
     
+    // The backend publishes settings in a signed envelope (see settings.md).
+    // Returns the settings array, or null if the payload is unsigned, does not
+    // verify with the key delivered at setup, names another account, or was
+    // signed before the settings last applied.
+    private fun unwrapSigned(payload: String): String? {
+        val trimmed = payload.trim()
+        if (!trimmed.startsWith("{")) {
+            Log.w("Settings", "Rejecting unsigned settings")
+            return null
+        }
+
+        val keys = Config.getSettingsKeys()
+        if (keys.isEmpty()) {
+            Log.w("Settings", "No settings key, set this device up again to receive settings")
+            return null
+        }
+
+        val envelope = JSONObject(trimmed)
+        val account = envelope.getString("account")
+        val signedAt = envelope.getLong("signed_at")
+        val body = envelope.getString("payload")
+        val signature = Base64.decode(envelope.getString("signature"), Base64.DEFAULT)
+
+        if (account != Config.getAccountId()) {
+            Log.w("Settings", "Rejecting settings signed for account $account")
+            return null
+        }
+
+        val message = "$SETTINGS_DOMAIN\n$account\n$signedAt\n$body".toByteArray(Charsets.UTF_8)
+        val verified = keys.any { key ->
+            val verifier = Ed25519Signer()
+            verifier.init(false, key)
+            verifier.update(message, 0, message.size)
+            verifier.verifySignature(signature)
+        }
+        if (!verified) {
+            Log.w("Settings", "Rejecting settings that do not verify")
+            return null
+        }
+
+        if (signedAt < sharedPrefs.getLong(KEY_SIGNED_AT, 0)) {
+            Log.w("Settings", "Rejecting settings signed before the applied ones")
+            return null
+        }
+        sharedPrefs.edit().putLong(KEY_SIGNED_AT, signedAt).apply()
+
+        return String(Base64.decode(body, Base64.DEFAULT))
+    }
+
     fun parseSettingsFromMqtt(payload: String, deviceId: String): Boolean {
         return try {
-            val jsonArray = JSONArray(payload)
+            val settingsArray = unwrapSigned(payload) ?: return false
+            val jsonArray = JSONArray(settingsArray)
             
             for (i in 0 until jsonArray.length()) {
                 val deviceObj = jsonArray.getJSONObject(i)
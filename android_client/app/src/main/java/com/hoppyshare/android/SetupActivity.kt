@@ -59,14 +59,16 @@ class SetupActivity : ComponentActivity() {
             val ca = uri.getQueryParameter("ca")
             val groupKey = uri.getQueryParameter("group_key")
             val deviceId = uri.getQueryParameter("device_id")
+            // verifies the settings topic, see Settings.unwrapSigned
+            val settingsKey = uri.getQueryParameter("settings_key")
             
-            if (cert == null || key == null || ca == null || groupKey == null || deviceId == null) {
+            if (cert == null || key == null || ca == null || groupKey == null || deviceId == null || settingsKey == null) {
                 showError("Missing certificate data")
                 return
             }
             
             // Store certificates securely
-            val success = storeCertificates(cert, key, ca, groupKey, deviceId)
+            val success = storeCertificates(cert, key, ca, groupKey, settingsKey, deviceId)
             
             if (success) {
                 showSuccess()
@@ -79,7 +81,7 @@ class SetupActivity : ComponentActivity() {
         }
     }
     
-    private fun storeCertificates(cert: String, key: String, ca: String, groupKey: String, deviceId: String): Boolean {
+    private fun storeCertificates(cert: String, key: String, ca: String, groupKey: String, settingsKey: String, deviceId: String): Boolean {
         return try {
             // Store in SharedPreferences for now (should use Android Keystore for production)
             val prefs = getSharedPreferences("hoppyshare_certs", MODE_PRIVATE)
@@ -88,6 +90,7 @@ class SetupActivity : ComponentActivity() {
                 putString("client_key", key)
                 putString("ca_cert", ca)
                 putString("group_key", groupKey)
+                putString("settings_key", settingsKey)
                 putString("device_id", deviceId)
                 putBoolean("is_configured", true)
                 apply()
@@ -1,7 +1,6 @@
 package animate
 
 import (
-	"desktop_client/settings"
 	"desktop_client/systrayhelpers"
 	_ "embed"
 	"runtime"
@@ -59,6 +58,7 @@ const (
 	StateLoading
 	StateNotification
 	StateError
+	StateIdentify
 )
 
 // Animation system
@@ -82,6 +82,18 @@ type Animator struct {
 
 var globalAnimator *Animator
 
+var (
+	lightAnimations   bool
+	lightAnimationsMu sync.RWMutex
+)
+
+// SetLightAnimations makes the idle icon static instead of slowly breathing.
+func SetLightAnimations(on bool) {
+	lightAnimationsMu.Lock()
+	lightAnimations = on
+	lightAnimationsMu.Unlock()
+}
+
 // Initialize sets up the animation system based on the current platform
 func Initialize() {
 	globalAnimator = &Animator{
@@ -200,8 +212,20 @@ func (a *Animator) updateFrame() {
 	case StateError:
 		// Error icon when stuff breaks
 		iconToShow = a.errorIcon
+	case StateIdentify:
+		// Fast blink between the notification and default icons
+		if a.frameIndex%2 == 0 {
+			iconToShow = a.notificationIcon
+		} else {
+			iconToShow = a.defaultIcon
+		}
+		a.frameIndex++
 	case StateIdle:
-		if settings.GetSettings().LightAnimations {
+		lightAnimationsMu.RLock()
+		light := lightAnimations
+		lightAnimationsMu.RUnlock()
+
+		if light {
 			iconToShow = a.defaultIcon
 		} else {
 			// Slow breathing (slower than loading)
@@ -8,6 +8,7 @@ import (
 	"desktop_client/notification"
 	"desktop_client/settings"
 	"encoding/binary"
+	"errors"
 	"log"
 	"net"
 	"sync"
@@ -17,10 +18,9 @@ import (
 var MAX_CHUNK_SIZE = 500
 
 var (
-	mu          sync.Mutex
-	started     bool
-	lastMessage []byte
-	callback    func()
+	mu       sync.Mutex
+	started  bool
+	callback func()
 )
 
 // BLE CHUNK FORMAT (4 byte header) + 500
@@ -30,10 +30,19 @@ var (
 // data []byte
 //
 
+// MaxMessageSize is the largest frame that can be sent over BLE.
+const MaxMessageSize = 3 * 1024 * 1024
+
+const (
+	maxMessageChunks   = (MaxMessageSize + 500 - 1) / 500
+	maxPendingMessages = 16
+)
+
 type chunkBuffer struct {
 	chunks   map[uint32][]byte
 	received map[uint32]bool
 	total    uint32
+	started  time.Time
 }
 
 var (
@@ -82,7 +91,9 @@ func Stop() error {
 	return nil
 }
 
-func Publish(content []byte, mimeType string, filename string) error {
+// Publish sends content to the devices in to, or to every device if to is
+// empty.
+func Publish(content []byte, mimeType string, filename string, to []string) error {
 	mu.Lock()
 	on := started
 	mu.Unlock()
@@ -91,7 +102,7 @@ func Publish(content []byte, mimeType string, filename string) error {
 		return nil
 	}
 
-	payload, err := mqttclient.EncodeMessage(mimeType, filename, config.DeviceID, content)
+	payload, err := mqttclient.EncodeMessageTo(to, mimeType, filename, content)
 	if err != nil {
 		return err
 	}
@@ -105,28 +116,14 @@ func SetOnMessageCallback(cb func()) {
 	callback = cb
 }
 
-func GetLastMessage() (filename string, contentType string, data []byte, ok bool) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	decoded, err := mqttclient.DecodeMessage(lastMessage)
-	if err != nil {
-		return "", "", nil, false
-	}
-
-	return decoded.Filename, decoded.Type, decoded.Payload, true
-}
-
 // exported to cgo layer
 func onMessage(deviceID string, payload []byte) {
 	handleChunk(payload)
 }
 
+// ClearMsg drops messages that are still being reassembled. Received messages
+// are kept in the history, see mqttclient.SaveReceived.
 func ClearMsg() {
-	mu.Lock()
-	lastMessage = nil
-	mu.Unlock()
-
 	assembleMu.Lock()
 	defer assembleMu.Unlock()
 	for k := range buffers {
@@ -142,11 +139,23 @@ func PublishChunked(payload []byte) error {
 	if err != nil {
 		return err
 	}
+
+	for _, chunk := range splitChunks(msgID, payload) {
+		log.Printf("SENDING CHUNK")
+		publishBLE(chunk)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// splitChunks cuts payload into the chunks of one BLE message.
+func splitChunks(msgID []byte, payload []byte) [][]byte {
 	totalChunks := (len(payload) + MAX_CHUNK_SIZE - 1) / MAX_CHUNK_SIZE
+	chunks := make([][]byte, 0, totalChunks)
 
 	// each chunk of the payload gets an increasing id
 	for i := 0; i < totalChunks; i++ {
-		log.Printf("SENDING CHUNK")
 		start := i * MAX_CHUNK_SIZE
 		end := start + MAX_CHUNK_SIZE
 		if end > len(payload) {
@@ -172,19 +181,65 @@ func PublishChunked(payload []byte) error {
 		// 	data 	[]byte
 		buff.Write(chunk)
 
-		publishBLE(buff.Bytes())
-		time.Sleep(20 * time.Millisecond)
+		chunks = append(chunks, buff.Bytes())
 	}
 
-	return nil
+	return chunks
 }
 
 func handleChunk(chunk []byte) {
 	log.Printf("RECEIVED CHUNK")
-	if len(chunk) < 4 {
+
+	full, ok := reassemble(chunk)
+	if !ok {
 		return
 	}
 
+	decoded, err := mqttclient.DecodeMessage(full)
+	if errors.Is(err, mqttclient.ErrReplay) || errors.Is(err, mqttclient.ErrStale) {
+		log.Printf("Dropped BLE message: %v", err)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to decode BLE message: %v", err)
+		return
+	}
+	if !decoded.IsFor(config.DeviceID) {
+		return
+	}
+	if !mqttclient.AcceptSender(decoded.Verified) {
+		log.Printf("Dropped unverified BLE message")
+		return
+	}
+	if !mqttclient.AcceptNote(decoded) {
+		log.Printf("Dropped BLE message by a receive rule")
+		return
+	}
+
+	// Decoded once on arrival: the frame's message ID is in the replay cache
+	// after that, so it cannot be decoded again
+	if err := mqttclient.SaveReceived(decoded); err != nil {
+		log.Printf("Failed to store BLE message: %v", err)
+		return
+	}
+
+	mu.Lock()
+	cb := callback
+	mu.Unlock()
+
+	if cb != nil {
+		cb()
+	}
+}
+
+// reassemble adds one chunk to its message and returns the message once
+// every chunk has arrived. Chunks that cannot belong to a valid message drop
+// the whole message, since the peer is either broken or hostile.
+func reassemble(chunk []byte) ([]byte, bool) {
+	if len(chunk) < 4 {
+		return nil, false
+	}
+
 	msgId := chunk[0:2]
 	seqRaw := binary.BigEndian.Uint16(chunk[2:4])
 	seqIndex := uint32(seqRaw >> 1)
@@ -193,52 +248,70 @@ func handleChunk(chunk []byte) {
 	msgKey := string(msgId)
 
 	assembleMu.Lock()
+	defer assembleMu.Unlock()
+
+	if seqIndex >= maxMessageChunks || len(chunkData) > MAX_CHUNK_SIZE {
+		delete(buffers, msgKey)
+		return nil, false
+	}
+
 	buf, exists := buffers[msgKey]
 	if !exists {
+		if len(buffers) >= maxPendingMessages {
+			evictOldestBuffer()
+		}
+
 		buf = &chunkBuffer{
 			chunks:   make(map[uint32][]byte),
 			received: make(map[uint32]bool),
+			started:  time.Now(),
 		}
 
 		buffers[msgKey] = buf
 	}
 
 	if isLast {
+		if buf.total > 0 && buf.total != seqIndex+1 {
+			delete(buffers, msgKey)
+			return nil, false
+		}
 		buf.total = seqIndex + 1
 		log.Printf("IS LAST")
 	}
 
-	buf.chunks[seqIndex] = chunkData
+	if buf.total > 0 && seqIndex >= buf.total {
+		delete(buffers, msgKey)
+		return nil, false
+	}
+
+	// the caller may reuse chunk once this returns
+	buf.chunks[seqIndex] = append([]byte(nil), chunkData...)
 	buf.received[seqIndex] = true
 
-	if buf.total > 0 {
-		complete := true
-		for i := uint32(0); i < buf.total; i++ {
-			if _, ok := buf.chunks[i]; !ok {
-				complete = false
-				break
-			}
-		}
-		if complete {
-			full := &bytes.Buffer{}
-			for i := uint32(0); i < buf.total; i++ {
-				full.Write(buf.chunks[i])
-			}
-			delete(buffers, msgKey)
-			assembleMu.Unlock()
+	if buf.total == 0 || uint32(len(buf.chunks)) < buf.total {
+		return nil, false
+	}
+
+	full := &bytes.Buffer{}
+	for i := uint32(0); i < buf.total; i++ {
+		full.Write(buf.chunks[i])
+	}
+	delete(buffers, msgKey)
 
-			mu.Lock()
-			lastMessage = full.Bytes()
-			cb := callback
-			mu.Unlock()
+	return full.Bytes(), true
+}
 
-			if cb != nil {
-				cb()
-			}
-			return
+// evictOldestBuffer drops the message that started reassembling first.
+// Callers must hold assembleMu.
+func evictOldestBuffer() {
+	var oldestKey string
+	var oldest time.Time
+	for k, b := range buffers {
+		if oldest.IsZero() || b.started.Before(oldest) {
+			oldestKey, oldest = k, b.started
 		}
 	}
-	assembleMu.Unlock()
+	delete(buffers, oldestKey)
 }
 
 // Generates Message ID
@@ -0,0 +1,140 @@
+package ble
+
+import (
+	"bytes"
+	"desktop_client/internal/testkeys"
+	"desktop_client/mqttclient"
+	"errors"
+	"testing"
+)
+
+func resetBuffers() {
+	assembleMu.Lock()
+	defer assembleMu.Unlock()
+	buffers = make(map[string]*chunkBuffer)
+}
+
+// splitFuzzInput cuts data into chunks, each prefixed by a one byte length.
+func splitFuzzInput(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := int(data[0])
+		data = data[1:]
+		if n > len(data) {
+			n = len(data)
+		}
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+// joinFuzzInput is the inverse of splitFuzzInput, for building seeds.
+func joinFuzzInput(chunks [][]byte) []byte {
+	var out []byte
+	for _, c := range chunks {
+		for len(c) > 255 {
+			out = append(out, 255)
+			out = append(out, c[:255]...)
+			c = c[255:]
+		}
+		out = append(out, byte(len(c)))
+		out = append(out, c...)
+	}
+	return out
+}
+
+func TestReassembleOutOfOrder(t *testing.T) {
+	resetBuffers()
+
+	payload := bytes.Repeat([]byte("hoppy"), 1000)
+	chunks := splitChunks([]byte{1, 2}, payload)
+
+	for i := len(chunks) - 1; i > 0; i-- {
+		if _, ok := reassemble(chunks[i]); ok {
+			t.Fatal("message completed early")
+		}
+	}
+
+	full, ok := reassemble(chunks[0])
+	if !ok || !bytes.Equal(full, payload) {
+		t.Fatal("message not reassembled")
+	}
+}
+
+func TestReassembleRejectsConflictingLast(t *testing.T) {
+	resetBuffers()
+
+	chunks := splitChunks([]byte{1, 2}, bytes.Repeat([]byte{7}, 3*MAX_CHUNK_SIZE))
+	reassemble(chunks[2])
+
+	// a second LAST chunk with another index drops the message
+	bad := append([]byte(nil), chunks[1]...)
+	bad[3] |= 1
+	reassemble(bad)
+
+	reassemble(chunks[0])
+	if _, ok := reassemble(chunks[1]); ok {
+		t.Fatal("conflicting message was reassembled")
+	}
+}
+
+func FuzzReassemble(f *testing.F) {
+	payload := bytes.Repeat([]byte{0x42}, 3*MAX_CHUNK_SIZE+17)
+	f.Add(joinFuzzInput(splitChunks([]byte{1, 2}, payload)))
+	f.Add(joinFuzzInput([][]byte{{1, 2, 0xFF, 0xFF}, {1, 2, 0, 0}}))
+	f.Add(joinFuzzInput([][]byte{{1}, {1, 2, 0, 1}}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resetBuffers()
+
+		for _, chunk := range splitFuzzInput(data) {
+			if full, ok := reassemble(chunk); ok && len(full) > maxMessageChunks*MAX_CHUNK_SIZE {
+				t.Fatalf("reassembled %d bytes", len(full))
+			}
+		}
+
+		assembleMu.Lock()
+		defer assembleMu.Unlock()
+		if len(buffers) > maxPendingMessages {
+			t.Fatalf("%d messages pending", len(buffers))
+		}
+	})
+}
+
+// FuzzBLEMessage runs chunks through reassembly and frame decoding, like
+// handleChunk does.
+func FuzzBLEMessage(f *testing.F) {
+	testkeys.Install(f)
+
+	frame, err := mqttclient.EncodeMessageVersion(mqttclient.CurrentVersion, "text/plain", "note.txt", []byte("hello over BLE"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(joinFuzzInput(splitChunks([]byte{3, 4}, frame)))
+	f.Add(joinFuzzInput(splitChunks([]byte{3, 4}, frame[:len(frame)/2])))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resetBuffers()
+
+		for _, chunk := range splitFuzzInput(data) {
+			full, ok := reassemble(chunk)
+			if !ok {
+				continue
+			}
+
+			_, err := mqttclient.DecodeMessage(full)
+			if err == nil {
+				continue
+			}
+			for _, target := range []error{mqttclient.ErrTruncated, mqttclient.ErrBadHeader, mqttclient.ErrAuth, mqttclient.ErrReplay, mqttclient.ErrStale} {
+				if errors.Is(err, target) {
+					err = nil
+				}
+			}
+			if err != nil {
+				t.Fatalf("untyped error %T: %v", err, err)
+			}
+		}
+	})
+}
@@ -1,11 +1,46 @@
 package clipboard
 
+// Representation is the clipboard contents in one MIME type.
+type Representation struct {
+	Type string
+	Data []byte
+}
+
+// extraTypes are read alongside the main representation, so formatting
+// survives the trip, e.g. HTML copied from a browser or TSV from a
+// spreadsheet.
+var extraTypes = []string{"text/html", "text/rtf", "text/tab-separated-values", "text/plain"}
+
 // Reads content from the clipboard and returns the given MIME type (e.g., "text/plain", "image/png").
 func Read() ([]byte, string, error) {
 	return readClipboard()
 }
 
+// ReadAll reads every representation of the clipboard contents the platform
+// offers. The first one is what Read returns.
+func ReadAll() ([]Representation, error) {
+	data, mimeType, err := readClipboard()
+	if err != nil {
+		return nil, err
+	}
+
+	reps := []Representation{{Type: mimeType, Data: data}}
+	for _, r := range readExtraRepresentations() {
+		if r.Type != mimeType && len(r.Data) > 0 {
+			reps = append(reps, r)
+		}
+	}
+
+	return reps, nil
+}
+
 // Puts content onto the clipboard with the given MIME type (e.g., "text/plain", "image/png").
 func Write(data []byte, mimeType string) error {
 	return writeClipboard(data, mimeType)
 }
+
+// WriteAll puts every representation the platform supports onto the
+// clipboard, so each app can paste the richest one it understands.
+func WriteAll(reps []Representation) error {
+	return writeAllClipboard(reps)
+}
@@ -113,6 +113,42 @@ int WriteClipboard(void* data, int length, const char* mimeType) {
         return -1; // unsupported type
     }
 }
+
+// Reads the clipboard data for one pasteboard type (UTI), or NULL if the
+// type is not on the clipboard. Caller must free the buffer.
+void* ReadClipboardType(const char* uti, int* outLength) {
+    @autoreleasepool {
+        NSPasteboard *pb = [NSPasteboard generalPasteboard];
+        NSString *type = [NSString stringWithUTF8String:uti];
+        if (![[pb types] containsObject:type]) return NULL;
+
+        NSData *data = [pb dataForType:type];
+        if (!data) return NULL;
+
+        *outLength = (int)[data length];
+        void *buffer = malloc(*outLength);
+        memcpy(buffer, [data bytes], *outLength);
+        return buffer;
+    }
+}
+
+// Writes several representations to the clipboard at once, one per
+// pasteboard type (UTI). Returns 0 on success, -1 if nothing was written.
+int WriteClipboardAll(int count, void** data, int* lengths, char** utis) {
+    @autoreleasepool {
+        NSPasteboard *pb = [NSPasteboard generalPasteboard];
+        [pb clearContents];
+
+        int written = 0;
+        for (int i = 0; i < count; i++) {
+            NSData *nsData = [NSData dataWithBytes:data[i] length:lengths[i]];
+            NSString *type = [NSString stringWithUTF8String:utis[i]];
+            if ([pb setData:nsData forType:type]) written++;
+        }
+
+        return written > 0 ? 0 : -1;
+    }
+}
 */
 import "C"
 
@@ -154,3 +190,71 @@ func writeClipboard(data []byte, mimeType string) error {
 	}
 	return nil
 }
+
+// pasteboardTypes maps MIME types to macOS pasteboard types.
+var pasteboardTypes = map[string]string{
+	"text/plain":                "public.utf8-plain-text",
+	"text/html":                 "public.html",
+	"text/rtf":                  "public.rtf",
+	"text/tab-separated-values": "public.utf8-tab-separated-values-text",
+	"image/png":                 "public.png",
+	"image/jpeg":                "public.jpeg",
+	"image/gif":                 "com.compuserve.gif",
+}
+
+func readExtraRepresentations() []Representation {
+	var reps []Representation
+
+	for _, mimeType := range extraTypes {
+		uti := C.CString(pasteboardTypes[mimeType])
+		var length C.int
+		ptr := C.ReadClipboardType(uti, &length)
+		C.free(unsafe.Pointer(uti))
+		if ptr == nil {
+			continue
+		}
+
+		reps = append(reps, Representation{Type: mimeType, Data: C.GoBytes(ptr, length)})
+		C.free(ptr)
+	}
+
+	return reps
+}
+
+func writeAllClipboard(reps []Representation) error {
+	var supported []Representation
+	for _, r := range reps {
+		if _, ok := pasteboardTypes[r.Type]; ok && len(r.Data) > 0 {
+			supported = append(supported, r)
+		}
+	}
+	if len(supported) == 0 {
+		return errors.New("no supported clipboard representation")
+	}
+
+	n := len(supported)
+	ptrSize := C.size_t(unsafe.Sizeof(uintptr(0)))
+	data := (*[1 << 16]unsafe.Pointer)(C.malloc(C.size_t(n) * ptrSize))[:n:n]
+	utis := (*[1 << 16]*C.char)(C.malloc(C.size_t(n) * ptrSize))[:n:n]
+	lengths := (*[1 << 16]C.int)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.int(0)))))[:n:n]
+	defer C.free(unsafe.Pointer(&data[0]))
+	defer C.free(unsafe.Pointer(&utis[0]))
+	defer C.free(unsafe.Pointer(&lengths[0]))
+
+	for i, r := range supported {
+		data[i] = C.CBytes(r.Data)
+		utis[i] = C.CString(pasteboardTypes[r.Type])
+		lengths[i] = C.int(len(r.Data))
+	}
+	defer func() {
+		for i := range supported {
+			C.free(data[i])
+			C.free(unsafe.Pointer(utis[i]))
+		}
+	}()
+
+	if C.WriteClipboardAll(C.int(n), &data[0], &lengths[0], &utis[0]) != 0 {
+		return errors.New("failed to write to clipboard")
+	}
+	return nil
+}
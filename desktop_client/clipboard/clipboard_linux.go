@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"errors"
 	"os/exec"
+	"strings"
 )
 
 func readClipboard() ([]byte, string, error) {
@@ -101,3 +102,69 @@ func writeClipboard(data []byte, mimeType string) error {
 
 	return errors.New("no clipboard tool found, tried wl-copy and xclip")
 }
+
+func readExtraRepresentations() []Representation {
+	var reps []Representation
+
+	// Wayland
+	if _, err := exec.LookPath("wl-paste"); err == nil {
+		types, err := exec.Command("wl-paste", "--list-types").Output()
+		if err != nil {
+			return nil
+		}
+
+		for _, mimeType := range extraTypes {
+			if !hasTarget(types, mimeType) {
+				continue
+			}
+			data, err := exec.Command("wl-paste", "--type", mimeType, "--no-newline").Output()
+			if err == nil {
+				reps = append(reps, Representation{Type: mimeType, Data: data})
+			}
+		}
+		return reps
+	}
+
+	// X11
+	if _, err := exec.LookPath("xclip"); err == nil {
+		targets, err := exec.Command("xclip", "-selection", "clipboard", "-t", "TARGETS", "-o").Output()
+		if err != nil {
+			return nil
+		}
+
+		for _, mimeType := range extraTypes {
+			if !hasTarget(targets, mimeType) {
+				continue
+			}
+			data, err := exec.Command("xclip", "-selection", "clipboard", "-t", mimeType, "-o").Output()
+			if err == nil {
+				reps = append(reps, Representation{Type: mimeType, Data: data})
+			}
+		}
+	}
+
+	return reps
+}
+
+// hasTarget reports whether a newline separated list of clipboard types
+// contains mimeType exactly.
+func hasTarget(list []byte, mimeType string) bool {
+	for _, t := range strings.Split(string(list), "\n") {
+		if strings.TrimSpace(t) == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAllClipboard writes the first representation wl-copy or xclip can
+// take. Both offer a single type per selection, so the rest are dropped.
+func writeAllClipboard(reps []Representation) error {
+	var err error = errors.New("no representation to write")
+	for _, r := range reps {
+		if err = writeClipboard(r.Data, r.Type); err == nil {
+			return nil
+		}
+	}
+	return err
+}
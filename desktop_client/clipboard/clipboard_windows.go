@@ -216,11 +216,108 @@ int WriteClipboard(void* data, int length, const char* mimeType) {
     CloseClipboard();
     return 0;
 }
+// Reads the clipboard data for one format, or NULL if the format is not on
+// the clipboard. "CF_UNICODETEXT" is returned as UTF-8, every other name is
+// a registered format returned as is. Caller must free the buffer.
+void* ReadClipboardFormat(const char* name, int* outLength) {
+    if (!OpenClipboard(NULL)) {
+        return NULL;
+    }
+
+    if (strcmp(name, "CF_UNICODETEXT") == 0) {
+        void* buffer = NULL;
+        HANDLE hData = GetClipboardData(CF_UNICODETEXT);
+        wchar_t* pText = hData ? (wchar_t*)GlobalLock(hData) : NULL;
+        if (pText) {
+            int utf8Len = WideCharToMultiByte(CP_UTF8, 0, pText, -1, NULL, 0, NULL, NULL);
+            if (utf8Len > 0) {
+                buffer = malloc(utf8Len);
+                WideCharToMultiByte(CP_UTF8, 0, pText, -1, buffer, utf8Len, NULL, NULL);
+                *outLength = utf8Len - 1; // exclude null terminator
+            }
+            GlobalUnlock(hData);
+        }
+        CloseClipboard();
+        return buffer;
+    }
+
+    UINT format = RegisterClipboardFormat(name);
+    if (!IsClipboardFormatAvailable(format)) {
+        CloseClipboard();
+        return NULL;
+    }
+
+    void* buffer = NULL;
+    HANDLE hData = GetClipboardData(format);
+    if (hData) {
+        SIZE_T size = GlobalSize(hData);
+        void* pData = GlobalLock(hData);
+        if (pData && size > 0) {
+            *outLength = (int)size;
+            buffer = malloc(size);
+            memcpy(buffer, pData, size);
+        }
+        GlobalUnlock(hData);
+    }
+
+    CloseClipboard();
+    return buffer;
+}
+
+// Writes several representations to the clipboard at once, named like in
+// ReadClipboardFormat. Returns 0 on success, -1 if nothing was written.
+int WriteClipboardAll(int count, void** data, int* lengths, char** names) {
+    if (!OpenClipboard(NULL)) {
+        return -1;
+    }
+
+    EmptyClipboard();
+
+    int written = 0;
+    for (int i = 0; i < count; i++) {
+        HGLOBAL hMem;
+        UINT format;
+
+        if (strcmp(names[i], "CF_UNICODETEXT") == 0) {
+            int wideLen = MultiByteToWideChar(CP_UTF8, 0, (char*)data[i], lengths[i], NULL, 0);
+            if (wideLen <= 0) continue;
+
+            hMem = GlobalAlloc(GMEM_MOVEABLE, (wideLen + 1) * sizeof(wchar_t));
+            if (!hMem) continue;
+
+            wchar_t* pMem = (wchar_t*)GlobalLock(hMem);
+            MultiByteToWideChar(CP_UTF8, 0, (char*)data[i], lengths[i], pMem, wideLen);
+            pMem[wideLen] = L'\0';
+            GlobalUnlock(hMem);
+            format = CF_UNICODETEXT;
+        } else {
+            hMem = GlobalAlloc(GMEM_MOVEABLE, lengths[i]);
+            if (!hMem) continue;
+
+            void* pMem = GlobalLock(hMem);
+            memcpy(pMem, data[i], lengths[i]);
+            GlobalUnlock(hMem);
+            format = RegisterClipboardFormat(names[i]);
+        }
+
+        if (SetClipboardData(format, hMem)) {
+            written++;
+        } else {
+            GlobalFree(hMem);
+        }
+    }
+
+    CloseClipboard();
+    return written > 0 ? 0 : -1;
+}
 */
 import "C"
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"strconv"
 	"unsafe"
 )
 
@@ -257,3 +354,131 @@ func writeClipboard(data []byte, mimeType string) error {
 	}
 	return nil
 }
+
+// clipboardFormats maps MIME types to Windows clipboard format names.
+var clipboardFormats = map[string]string{
+	"text/plain": "CF_UNICODETEXT",
+	"text/html":  "HTML Format",
+	"text/rtf":   "Rich Text Format",
+	"image/png":  "PNG",
+	"image/jpeg": "JFIF",
+	"image/gif":  "GIF",
+}
+
+func readExtraRepresentations() []Representation {
+	var reps []Representation
+
+	for _, mimeType := range extraTypes {
+		format, ok := clipboardFormats[mimeType]
+		if !ok {
+			continue
+		}
+
+		name := C.CString(format)
+		var length C.int
+		ptr := C.ReadClipboardFormat(name, &length)
+		C.free(unsafe.Pointer(name))
+		if ptr == nil {
+			continue
+		}
+
+		data := C.GoBytes(ptr, length)
+		C.free(ptr)
+
+		if mimeType == "text/html" {
+			if data = decodeCFHTML(data); data == nil {
+				continue
+			}
+		}
+		reps = append(reps, Representation{Type: mimeType, Data: data})
+	}
+
+	return reps
+}
+
+func writeAllClipboard(reps []Representation) error {
+	var supported []Representation
+	for _, r := range reps {
+		if _, ok := clipboardFormats[r.Type]; !ok || len(r.Data) == 0 {
+			continue
+		}
+		if r.Type == "text/html" {
+			r.Data = encodeCFHTML(r.Data)
+		}
+		supported = append(supported, r)
+	}
+	if len(supported) == 0 {
+		return errors.New("no supported clipboard representation")
+	}
+
+	n := len(supported)
+	ptrSize := C.size_t(unsafe.Sizeof(uintptr(0)))
+	data := (*[1 << 16]unsafe.Pointer)(C.malloc(C.size_t(n) * ptrSize))[:n:n]
+	names := (*[1 << 16]*C.char)(C.malloc(C.size_t(n) * ptrSize))[:n:n]
+	lengths := (*[1 << 16]C.int)(C.malloc(C.size_t(n) * C.size_t(unsafe.Sizeof(C.int(0)))))[:n:n]
+	defer C.free(unsafe.Pointer(&data[0]))
+	defer C.free(unsafe.Pointer(&names[0]))
+	defer C.free(unsafe.Pointer(&lengths[0]))
+
+	for i, r := range supported {
+		data[i] = C.CBytes(r.Data)
+		names[i] = C.CString(clipboardFormats[r.Type])
+		lengths[i] = C.int(len(r.Data))
+	}
+	defer func() {
+		for i := range supported {
+			C.free(data[i])
+			C.free(unsafe.Pointer(names[i]))
+		}
+	}()
+
+	if C.WriteClipboardAll(C.int(n), &data[0], &lengths[0], &names[0]) != 0 {
+		return errors.New("failed to write to clipboard")
+	}
+	return nil
+}
+
+// decodeCFHTML returns the fragment of a "HTML Format" clipboard entry, which
+// wraps the HTML in a header of byte offsets. Returns nil if the header is
+// malformed.
+func decodeCFHTML(data []byte) []byte {
+	start := cfHTMLOffset(data, "StartFragment:")
+	end := cfHTMLOffset(data, "EndFragment:")
+	if start < 0 || end < start || end > len(data) {
+		return nil
+	}
+	return data[start:end]
+}
+
+func cfHTMLOffset(data []byte, key string) int {
+	i := bytes.Index(data, []byte(key))
+	if i < 0 {
+		return -1
+	}
+	line := data[i+len(key):]
+	if j := bytes.IndexAny(line, "\r\n"); j >= 0 {
+		line = line[:j]
+	}
+	n, err := strconv.Atoi(string(bytes.TrimSpace(line)))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// encodeCFHTML wraps an HTML fragment in the "HTML Format" header.
+func encodeCFHTML(fragment []byte) []byte {
+	const header = "Version:0.9\r\nStartHTML:%010d\r\nEndHTML:%010d\r\nStartFragment:%010d\r\nEndFragment:%010d\r\n"
+	const prefix = "<html><body>\r\n<!--StartFragment-->"
+	const suffix = "<!--EndFragment-->\r\n</body></html>"
+
+	headerLen := len(fmt.Sprintf(header, 0, 0, 0, 0))
+	startFragment := headerLen + len(prefix)
+	endFragment := startFragment + len(fragment)
+	endHTML := endFragment + len(suffix)
+
+	out := fmt.Appendf(nil, header, headerLen, endHTML, startFragment, endFragment)
+	out = append(out, prefix...)
+	out = append(out, fragment...)
+	return append(out, suffix...)
+}
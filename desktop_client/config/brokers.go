@@ -0,0 +1,200 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+)
+
+// DefaultBrokerURL is the hosted broker, used when nothing else is configured.
+const DefaultBrokerURL = "tls://18.188.110.246:8883"
+
+// Broker is one MQTT broker endpoint. Brokers are tried in order; later
+// entries are only used while the earlier ones are unreachable.
+type Broker struct {
+	URL string `json:"url"` // e.g. tls://mqtt.example.com:8883 or wss://mqtt.example.com/mqtt
+
+	// ServerName is the name the broker certificate is verified against.
+	// Empty means the host in URL.
+	ServerName string `json:"server_name,omitempty"`
+
+	// CAPin is the hex SHA-256 of the SubjectPublicKeyInfo of a certificate
+	// that must appear in the broker's verified chain. Empty accepts any
+	// chain that verifies against the CA.
+	CAPin string `json:"ca_pin,omitempty"`
+
+	// Proxy is an http, https, socks5 or socks5h URL to connect through, or
+	// "direct". Empty means HTTPS_PROXY, then ALL_PROXY, minus NO_PROXY.
+	Proxy string `json:"proxy,omitempty"`
+
+	// Protocol pins the MQTT version to "v5" or "v3". Empty tries v5 and
+	// falls back to v3.1.1.
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// Brokers are the brokers this device was installed with. Empty means the
+// default broker.
+var Brokers []Broker
+
+// BrokersFile is the name of the file in the HoppyShare config directory
+// that overrides Brokers, so self-hosted brokers don't need a custom build.
+const BrokersFile = "brokers.json"
+
+// BrokerList returns the brokers to connect to, in order of preference.
+// brokers.json in the config directory wins over the installed brokers; an
+// unreadable or invalid file is reported and ignored.
+func BrokerList() ([]Broker, error) {
+	brokers := Brokers
+
+	var fileErr error
+	if path, err := brokersPath(); err == nil {
+		if data, err := os.ReadFile(path); err == nil {
+			override, err := parseBrokers(data)
+			if err != nil {
+				fileErr = fmt.Errorf("%s: %w", path, err)
+			} else {
+				brokers = override
+			}
+		} else if !os.IsNotExist(err) {
+			fileErr = err
+		}
+	}
+
+	if len(brokers) == 0 {
+		brokers = []Broker{{URL: DefaultBrokerURL}}
+	}
+	return brokers, fileErr
+}
+
+// Validate checks that b can be connected to.
+func (b Broker) Validate() error {
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return fmt.Errorf("broker %q: %w", b.URL, err)
+	}
+	switch u.Scheme {
+	case "tls", "ssl", "mqtts":
+		if u.Port() == "" {
+			return fmt.Errorf("broker %q: port is required", b.URL)
+		}
+	case "wss":
+	default:
+		return fmt.Errorf("broker %q: scheme must be tls, ssl, mqtts or wss", b.URL)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("broker %q: host is required", b.URL)
+	}
+
+	if b.Proxy != "" && b.Proxy != "direct" {
+		p, err := url.Parse(b.Proxy)
+		if err != nil {
+			return fmt.Errorf("broker %q: proxy: %w", b.URL, err)
+		}
+		switch p.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return fmt.Errorf("broker %q: proxy scheme must be http, https, socks5 or socks5h", b.URL)
+		}
+	}
+
+	switch b.Protocol {
+	case "", "v5", "v3":
+	default:
+		return fmt.Errorf("broker %q: protocol must be v5 or v3", b.URL)
+	}
+
+	if b.CAPin != "" {
+		pin, err := hex.DecodeString(b.CAPin)
+		if err != nil || len(pin) != sha256.Size {
+			return fmt.Errorf("broker %q: ca_pin must be a hex SHA-256", b.URL)
+		}
+	}
+	return nil
+}
+
+// Host returns the name the broker certificate must be valid for.
+func (b Broker) Host() string {
+	if b.ServerName != "" {
+		return b.ServerName
+	}
+	if u, err := url.Parse(b.URL); err == nil {
+		return u.Hostname()
+	}
+	return ""
+}
+
+// MatchesPin reports whether one of the verified chains contains the pinned
+// certificate. Brokers without a pin match any chain.
+func (b Broker) MatchesPin(chains [][]*x509.Certificate) bool {
+	if b.CAPin == "" {
+		return true
+	}
+	for _, chain := range chains {
+		for _, cert := range chain {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if strings.EqualFold(hex.EncodeToString(sum[:]), b.CAPin) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseBrokers(data []byte) ([]Broker, error) {
+	var brokers []Broker
+	if err := json.Unmarshal(data, &brokers); err != nil {
+		return nil, err
+	}
+	if len(brokers) == 0 {
+		return nil, errors.New("no brokers listed")
+	}
+	for _, b := range brokers {
+		if err := b.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return brokers, nil
+}
+
+func brokersPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "HoppyShare", BrokersFile), nil
+}
+
+// loadBrokers reads the installed brokers from the keychain. Devices
+// installed before brokers were configurable have none.
+func loadBrokers() error {
+	enc, err := keyring.Get(keyringService, "Brokers")
+	if err == keyring.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("keychain: could not get Brokers: %w", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return fmt.Errorf("keychain: could not Base64-decode Brokers: %w", err)
+	}
+
+	brokers, err := parseBrokers(data)
+	if err != nil {
+		return fmt.Errorf("keychain: could not parse Brokers: %w", err)
+	}
+	Brokers = brokers
+
+	return nil
+}
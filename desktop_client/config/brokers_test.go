@@ -0,0 +1,102 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseBrokers(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"tls", `[{"url": "tls://mqtt.example.com:8883"}]`, ""},
+		{"wss", `[{"url": "wss://mqtt.example.com/mqtt", "protocol": "v3"}]`, ""},
+		{"proxy", `[{"url": "tls://mqtt.example.com:8883", "proxy": "socks5://127.0.0.1:1080"}]`, ""},
+		{"direct", `[{"url": "tls://mqtt.example.com:8883", "proxy": "direct"}]`, ""},
+		{"empty", `[]`, "no brokers"},
+		{"not JSON", `{`, "unexpected"},
+		{"no port", `[{"url": "tls://mqtt.example.com"}]`, "port is required"},
+		{"plain TCP", `[{"url": "tcp://mqtt.example.com:1883"}]`, "scheme"},
+		{"no host", `[{"url": "tls://:8883"}]`, "host is required"},
+		{"bad proxy", `[{"url": "tls://mqtt.example.com:8883", "proxy": "ftp://proxy"}]`, "proxy scheme"},
+		{"bad protocol", `[{"url": "tls://mqtt.example.com:8883", "protocol": "v4"}]`, "protocol"},
+		{"short pin", `[{"url": "tls://mqtt.example.com:8883", "ca_pin": "abcd"}]`, "ca_pin"},
+		{"one bad entry", `[{"url": "tls://a:8883"}, {"url": "http://b"}]`, "scheme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseBrokers([]byte(tt.data))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBrokerList(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+
+	installed := []Broker{{URL: "tls://installed:8883"}, {URL: "tls://fallback:8883"}}
+	saved := Brokers
+	t.Cleanup(func() { Brokers = saved })
+
+	path, err := brokersPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		installed []Broker
+		file      string // not written if empty
+		want      []string
+		wantErr   bool
+	}{
+		{"default", nil, "", []string{DefaultBrokerURL}, false},
+		{"installed, in order", installed, "", []string{"tls://installed:8883", "tls://fallback:8883"}, false},
+		{"file wins", installed, `[{"url": "tls://override:8883"}]`, []string{"tls://override:8883"}, false},
+		{"invalid file is ignored", installed, `[{"url": "tcp://override"}]`, []string{"tls://installed:8883", "tls://fallback:8883"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Brokers = tt.installed
+			os.Remove(path)
+			if tt.file != "" {
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			brokers, err := BrokerList()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want one: %v", err, tt.wantErr)
+			}
+
+			var urls []string
+			for _, b := range brokers {
+				urls = append(urls, b.URL)
+			}
+			if !slices.Equal(urls, tt.want) {
+				t.Errorf("brokers = %v, want %v", urls, tt.want)
+			}
+		})
+	}
+}
@@ -32,6 +32,8 @@ var (
 
 const keyringService = "HoppyShare"
 
+const apiBase = "https://en43r23fua.execute-api.us-east-2.amazonaws.com"
+
 type preDecrypt struct {
 	DeviceID      string `json:"device_id"`
 	EncryptedBlob string `json:"encrypted_blob"`
@@ -68,14 +70,25 @@ func LoadKeysFromKeychain() error {
 
 	DeviceID = string(idBytes)
 
-	return nil
+	if err := loadBrokers(); err != nil {
+		return err
+	}
+
+	if err := loadSettingsKey(); err != nil {
+		return err
+	}
+
+	return loadGroupKeys()
 }
 
 type decryptedConfig struct {
-	Cert     string `json:"cert"`
-	Key      string `json:"key"`
-	CACert   string `json:"ca_cert"`
-	GroupKey string `json:"group_key"` // hex encoded
+	Cert     string   `json:"cert"`
+	Key      string   `json:"key"`
+	CACert   string   `json:"ca_cert"`
+	GroupKey string   `json:"group_key"` // hex encoded
+	Brokers  []Broker `json:"brokers,omitempty"`
+
+	SettingsKey string `json:"settings_key,omitempty"` // PEM, see SettingsKeyPem
 }
 
 func LoadEmbeddedConfig() error {
@@ -122,7 +135,7 @@ func LoadEmbeddedConfig() error {
 
 	DeviceID = embedded.DeviceID
 
-	encKeyBase64, err := FetchEncryptionKey(embedded, "https://en43r23fua.execute-api.us-east-2.amazonaws.com")
+	encKeyBase64, err := FetchEncryptionKey(embedded, apiBase)
 
 	log.Println("device id")
 	print(embedded.DeviceID)
@@ -175,6 +188,18 @@ func LoadEmbeddedConfig() error {
 		return fmt.Errorf("invalid hex group key: %w", err)
 	}
 
+	for _, b := range raw.Brokers {
+		if err := b.Validate(); err != nil {
+			return fmt.Errorf("invalid embedded broker: %w", err)
+		}
+	}
+	Brokers = raw.Brokers
+
+	SettingsKeyPem = []byte(raw.SettingsKey)
+	if _, err := SettingsKeys(); err != nil {
+		return fmt.Errorf("embedded config: %w", err)
+	}
+
 	return nil
 }
 
@@ -215,6 +240,22 @@ func LoadDevFiles() error {
 		return fmt.Errorf("dev mode: device ID is empty")
 	}
 
+	// brokers.json is optional, the default broker is used without it
+	if data, err := read("./config/certs/brokers.json"); err == nil {
+		if Brokers, err = parseBrokers(data); err != nil {
+			return fmt.Errorf("dev mode: invalid brokers.json: %w", err)
+		}
+	}
+
+	// settings_key.pem is optional, without it only the built-in key verifies
+	// settings
+	if data, err := read("./config/certs/settings_key.pem"); err == nil {
+		SettingsKeyPem = data
+		if _, err := SettingsKeys(); err != nil {
+			return fmt.Errorf("dev mode: invalid settings_key.pem: %w", err)
+		}
+	}
+
 	fmt.Println("[config] Loaded config in DEV_MODE")
 
 	return nil
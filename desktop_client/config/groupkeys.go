@@ -0,0 +1,275 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zalando/go-keyring"
+)
+
+// DefaultKeyTransition is how long older group keys keep decrypting after a
+// newer key arrives, unless the rotation says otherwise.
+const DefaultKeyTransition = 7 * 24 * time.Hour
+
+// GroupKeyEntry is one group key in the keyring. Key is wrapped with this
+// device's RSA key, like GroupKey. The key installed with the device has ID 0.
+type GroupKeyEntry struct {
+	ID      uint32    `json:"id"`
+	Key     []byte    `json:"key"`
+	Retires time.Time `json:"retires,omitempty"` // zero while the key is the newest
+}
+
+var (
+	groupKeys   []GroupKeyEntry // sorted by ID, newest last
+	groupKeysMu sync.RWMutex
+)
+
+// ErrUnknownGroupKey means a frame was encrypted with a key this device
+// does not have, or no longer accepts.
+var ErrUnknownGroupKey = errors.New("unknown or retired group key")
+
+// CurrentGroupKey returns the newest group key. Frames are encrypted with it
+// once every recipient advertised it, see GroupKeyIDs.
+func CurrentGroupKey() GroupKeyEntry {
+	groupKeysMu.RLock()
+	defer groupKeysMu.RUnlock()
+
+	if len(groupKeys) == 0 {
+		return GroupKeyEntry{ID: 0, Key: GroupKey}
+	}
+	return groupKeys[len(groupKeys)-1]
+}
+
+// GroupKeyIDs returns the IDs of the group keys that can still decrypt,
+// oldest first. Devices advertise them so senders only switch to a rotated
+// key once every recipient has it.
+func GroupKeyIDs() []uint32 {
+	groupKeysMu.RLock()
+	defer groupKeysMu.RUnlock()
+
+	if len(groupKeys) == 0 {
+		return []uint32{0}
+	}
+
+	now := time.Now()
+	ids := make([]uint32, 0, len(groupKeys))
+	for _, k := range groupKeys {
+		if k.Retires.IsZero() || now.Before(k.Retires) {
+			ids = append(ids, k.ID)
+		}
+	}
+	return ids
+}
+
+// LookupGroupKey returns the group key with the given ID if it can still
+// decrypt: it is the newest key, or its transition window has not ended.
+func LookupGroupKey(id uint32) (GroupKeyEntry, error) {
+	groupKeysMu.RLock()
+	defer groupKeysMu.RUnlock()
+
+	if len(groupKeys) == 0 && id == 0 {
+		return GroupKeyEntry{ID: 0, Key: GroupKey}, nil
+	}
+
+	for _, k := range groupKeys {
+		if k.ID != id {
+			continue
+		}
+		if !k.Retires.IsZero() && time.Now().After(k.Retires) {
+			break
+		}
+		return k, nil
+	}
+
+	return GroupKeyEntry{}, ErrUnknownGroupKey
+}
+
+// UnwrapGroupKey decrypts a group key wrapped with the device key in keyPEM
+// and returns it with its AES-GCM AEAD. Callers should clear the key once
+// they no longer need it.
+func UnwrapGroupKey(wrapped, keyPEM []byte) ([]byte, cipher.AEAD, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, errors.New("failed to parse PEM block")
+	}
+
+	privKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		privKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rsaKey, ok := privKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("not an RSA private key")
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaKey, wrapped, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		clear(key)
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		clear(key)
+		return nil, nil, err
+	}
+
+	return key, aead, nil
+}
+
+// AddGroupKey installs a rotated group key and saves the keyring to the
+// keychain. Every older key keeps decrypting for transition, then retires.
+// Adding a key that is already installed does nothing. A key this device
+// cannot unwrap is rejected before anything changes, since it would become
+// the only key used to encrypt.
+func AddGroupKey(id uint32, wrapped []byte, transition time.Duration) error {
+	key, _, err := UnwrapGroupKey(wrapped, KeyPem)
+	if err != nil {
+		return fmt.Errorf("group key %d does not unwrap: %w", id, err)
+	}
+	clear(key)
+
+	groupKeysMu.Lock()
+	defer groupKeysMu.Unlock()
+
+	seedGroupKeys()
+
+	for _, k := range groupKeys {
+		if k.ID == id {
+			return nil
+		}
+	}
+
+	newest := groupKeys[len(groupKeys)-1]
+	if id < newest.ID {
+		return fmt.Errorf("group key %d is older than current key %d", id, newest.ID)
+	}
+
+	retires := time.Now().Add(transition)
+	for i := range groupKeys {
+		if groupKeys[i].Retires.IsZero() || groupKeys[i].Retires.After(retires) {
+			groupKeys[i].Retires = retires
+		}
+	}
+
+	groupKeys = append(groupKeys, GroupKeyEntry{ID: id, Key: wrapped})
+	pruneGroupKeys()
+
+	return saveGroupKeys()
+}
+
+// seedGroupKeys starts the keyring with the key the device was installed
+// with. Callers must hold groupKeysMu.
+func seedGroupKeys() {
+	if len(groupKeys) == 0 {
+		groupKeys = []GroupKeyEntry{{ID: 0, Key: GroupKey}}
+	}
+}
+
+// pruneGroupKeys drops retired keys. Callers must hold groupKeysMu.
+func pruneGroupKeys() {
+	sort.Slice(groupKeys, func(i, j int) bool { return groupKeys[i].ID < groupKeys[j].ID })
+
+	now := time.Now()
+	kept := groupKeys[:0]
+	for _, k := range groupKeys {
+		if k.Retires.IsZero() || now.Before(k.Retires) {
+			kept = append(kept, k)
+		}
+	}
+	groupKeys = kept
+}
+
+func loadGroupKeys() error {
+	enc, err := keyring.Get(keyringService, "GroupKeys")
+	if err == keyring.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("keychain: could not get GroupKeys: %w", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return fmt.Errorf("keychain: could not Base64-decode GroupKeys: %w", err)
+	}
+
+	groupKeysMu.Lock()
+	defer groupKeysMu.Unlock()
+
+	if err := json.Unmarshal(data, &groupKeys); err != nil {
+		return fmt.Errorf("keychain: could not parse GroupKeys: %w", err)
+	}
+	pruneGroupKeys()
+
+	return nil
+}
+
+// saveGroupKeys stores the keyring next to the other keys. Callers must hold
+// groupKeysMu.
+func saveGroupKeys() error {
+	data, err := json.Marshal(groupKeys)
+	if err != nil {
+		return err
+	}
+
+	if err := keyring.Set(keyringService, "GroupKeys", base64.StdEncoding.EncodeToString(data)); err != nil {
+		return fmt.Errorf("keychain: could not store GroupKeys: %w", err)
+	}
+	return nil
+}
+
+var (
+	keysClearedFns []func()
+	keysClearedMu  sync.Mutex
+)
+
+// OnKeysCleared registers fn to run when ClearKeys is called, so packages
+// holding unwrapped keys can drop them too.
+func OnKeysCleared(fn func()) {
+	keysClearedMu.Lock()
+	defer keysClearedMu.Unlock()
+	keysClearedFns = append(keysClearedFns, fn)
+}
+
+// ClearKeys zeroes the private key and group keys held in memory. It is
+// called on shutdown and uninstall; nothing can be encrypted or decrypted
+// afterwards.
+func ClearKeys() {
+	groupKeysMu.Lock()
+	clear(KeyPem)
+	clear(GroupKey)
+	for _, k := range groupKeys {
+		clear(k.Key)
+	}
+	groupKeys = nil
+	groupKeysMu.Unlock()
+
+	keysClearedMu.Lock()
+	fns := append([]func(){}, keysClearedFns...)
+	keysClearedMu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
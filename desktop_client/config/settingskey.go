@@ -0,0 +1,110 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	_ "embed"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/zalando/go-keyring"
+)
+
+// builtinSettingsKey is the backend's settings key, compiled into every
+// release build, so devices installed before settings were signed verify
+// them once updated. The committed file is a placeholder; CI replaces it with
+// the key before building.
+//
+//go:embed settings_key.pem
+var builtinSettingsKey []byte
+
+// SettingsKeyPem holds the Ed25519 public keys, PEM encoded, that payloads on
+// the settings topic may be signed with besides builtinSettingsKey: the
+// backend's, delivered with the device's encrypted config at onboarding, and
+// any owner keys.
+var SettingsKeyPem []byte
+
+// SettingsKeys parses the built-in key and SettingsKeyPem.
+func SettingsKeys() ([]ed25519.PublicKey, error) {
+	builtin, err := parseSettingsKeys(builtinSettingsKey)
+	if err != nil {
+		return nil, err
+	}
+	pinned, err := parseSettingsKeys(SettingsKeyPem)
+	if err != nil {
+		return nil, err
+	}
+	return append(builtin, pinned...), nil
+}
+
+func parseSettingsKeys(data []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid settings key: %w", err)
+		}
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("invalid settings key: not an Ed25519 key")
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// AccountID returns the account this device belongs to, the common name of
+// its certificate.
+func AccountID() (string, error) {
+	block, _ := pem.Decode(CertPem)
+	if block == nil {
+		return "", errors.New("no device certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	if cert.Subject.CommonName == "" {
+		return "", errors.New("device certificate has no common name")
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// loadSettingsKey reads the settings keys pinned at onboarding from the
+// keychain. Devices installed before settings were signed have none, and rely
+// on builtinSettingsKey.
+func loadSettingsKey() error {
+	enc, err := keyring.Get(keyringService, "SettingsKey")
+	if err == keyring.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("keychain: could not get SettingsKey: %w", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return fmt.Errorf("keychain: could not Base64-decode SettingsKey: %w", err)
+	}
+	SettingsKeyPem = data
+
+	if _, err := SettingsKeys(); err != nil {
+		return fmt.Errorf("keychain: %w", err)
+	}
+
+	return nil
+}
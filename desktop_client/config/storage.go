@@ -0,0 +1,186 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"desktop_client/internal/stream"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/zalando/go-keyring"
+)
+
+// Local storage key
+//
+// Anything the client keeps on disk beyond the spool of the message it is
+// currently handling (the outbox, for one) is sealed with a random AES-256
+// key that never leaves this device's keychain. It is created on first use
+// and deleted on uninstall, which makes whatever is left on disk unreadable.
+
+var (
+	storageKey   []byte
+	storageAEAD  cipher.AEAD
+	storageKeyMu sync.Mutex
+)
+
+// ErrCorruptStorage means sealed data was truncated, altered, or sealed with
+// a storage key this device no longer has.
+var ErrCorruptStorage = errors.New("local storage is corrupt or from another install")
+
+func init() {
+	OnKeysCleared(clearStorageKey)
+}
+
+// SealLocal encrypts data for storage on this device. aad is bound to the
+// result and must be passed to OpenLocal unchanged, e.g. the kind of file.
+func SealLocal(data, aad []byte) ([]byte, error) {
+	aead, err := storageCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, data, aad), nil
+}
+
+// OpenLocal decrypts data sealed by SealLocal.
+func OpenLocal(sealed, aad []byte) ([]byte, error) {
+	aead, err := storageCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrCorruptStorage
+	}
+
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, ErrCorruptStorage
+	}
+	return data, nil
+}
+
+// Files too large to seal at once are sealed as a segmented stream (see
+// internal/stream) with the file's aad, so segments cannot be reordered,
+// dropped or cut off.
+
+// NewLocalWriter writes a stream header to w and returns a writer that seals
+// everything written to it into w. Close seals the last segment and must be
+// called, or the result cannot be opened.
+func NewLocalWriter(w io.Writer, aad []byte) (io.WriteCloser, error) {
+	aead, err := storageCipher()
+	if err != nil {
+		return nil, err
+	}
+	return stream.NewWriter(w, aead, aad)
+}
+
+type localReader struct {
+	r      io.Reader
+	stream *stream.Reader
+}
+
+// NewLocalReader returns a reader that opens data sealed by NewLocalWriter.
+// It fails with ErrCorruptStorage as soon as a segment does not open, so
+// callers must not act on what they read before reaching io.EOF.
+func NewLocalReader(r io.Reader, aad []byte) (io.Reader, error) {
+	aead, err := storageCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	sr, err := stream.NewReader(r, aead, aad)
+	if err != nil {
+		return nil, ErrCorruptStorage
+	}
+	return &localReader{r: r, stream: sr}, nil
+}
+
+func (lr *localReader) Read(p []byte) (int, error) {
+	n, err := lr.stream.Read(p)
+	switch {
+	case err == io.EOF:
+		// nothing may follow the last segment
+		var extra [1]byte
+		if n, _ := lr.r.Read(extra[:]); n > 0 {
+			return 0, ErrCorruptStorage
+		}
+	case errors.Is(err, stream.ErrAuth), errors.Is(err, stream.ErrLength), errors.Is(err, stream.ErrTruncated):
+		return n, ErrCorruptStorage
+	}
+	return n, err
+}
+
+func storageCipher() (cipher.AEAD, error) {
+	storageKeyMu.Lock()
+	defer storageKeyMu.Unlock()
+
+	if storageAEAD != nil {
+		return storageAEAD, nil
+	}
+
+	key, err := loadStorageKey()
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		clear(key)
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		clear(key)
+		return nil, err
+	}
+
+	storageKey = key
+	storageAEAD = aead
+	return aead, nil
+}
+
+// loadStorageKey reads the storage key from the keychain, creating it on
+// first use.
+func loadStorageKey() ([]byte, error) {
+	enc, err := keyring.Get(keyringService, "StorageKey")
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("keychain: invalid StorageKey")
+		}
+		return key, nil
+	}
+	if err != keyring.ErrNotFound {
+		return nil, fmt.Errorf("keychain: could not get StorageKey: %w", err)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	if err := keyring.Set(keyringService, "StorageKey", base64.StdEncoding.EncodeToString(key)); err != nil {
+		return nil, fmt.Errorf("keychain: could not store StorageKey: %w", err)
+	}
+	return key, nil
+}
+
+func clearStorageKey() {
+	storageKeyMu.Lock()
+	defer storageKeyMu.Unlock()
+
+	clear(storageKey)
+	storageKey = nil
+	storageAEAD = nil
+}
@@ -0,0 +1,245 @@
+// Package stream seals a stream of data in segments with an AEAD, so neither
+// side has to hold all of it in memory. It is used for frame bodies (see
+// mqttclient/stream.go) and for files sealed with the local storage key (see
+// config.NewLocalWriter).
+//
+//	noncePrefix [7] | segment | segment | ... | final segment
+//
+// segment:
+//
+//	last uint1 | length uint31 | ciphertext
+//
+// Every segment seals up to SegmentSize bytes of plaintext, using
+// nonce = noncePrefix | counter uint32 | last uint8 and the caller's
+// additional data, like the STREAM construction. Dropping, reordering or
+// truncating segments, or flipping the last bit, fails authentication.
+package stream
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	SegmentSize    = 64 * 1024
+	PrefixSize     = 7
+	lastSegmentBit = 1 << 31
+)
+
+var (
+	ErrAuth      = errors.New("segment failed authentication")
+	ErrTruncated = errors.New("stream is truncated")
+	ErrLength    = errors.New("invalid segment length")
+)
+
+// Writer seals what is written to it into segments. Close must be called to
+// write the final segment.
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	ad      []byte
+	prefix  [PrefixSize]byte
+	counter uint32
+	buf     []byte
+	closed  bool
+	err     error
+}
+
+// NewWriter writes a random nonce prefix to w and returns a Writer for the
+// segments. aead must use 12 byte nonces.
+func NewWriter(w io.Writer, aead cipher.AEAD, ad []byte) (*Writer, error) {
+	sw := &Writer{
+		w:    w,
+		aead: aead,
+		ad:   ad,
+		buf:  make([]byte, 0, SegmentSize),
+	}
+
+	if _, err := rand.Read(sw.prefix[:]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(sw.prefix[:]); err != nil {
+		return nil, err
+	}
+
+	return sw, nil
+}
+
+func (sw *Writer) Write(p []byte) (int, error) {
+	if sw.closed {
+		return 0, errors.New("write to closed stream")
+	}
+	if sw.err != nil {
+		return 0, sw.err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// A full buffer is only sealed once more data shows up, since the
+		// final segment has to be marked as such
+		if len(sw.buf) == SegmentSize {
+			if sw.err = sw.seal(false); sw.err != nil {
+				return n, sw.err
+			}
+		}
+
+		c := copy(sw.buf[len(sw.buf):SegmentSize], p)
+		sw.buf = sw.buf[:len(sw.buf)+c]
+		p = p[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+// Close seals and writes the final segment. It does not close the underlying
+// writer.
+func (sw *Writer) Close() error {
+	if sw.closed {
+		return nil
+	}
+	sw.closed = true
+
+	if sw.err != nil {
+		return sw.err
+	}
+
+	return sw.seal(true)
+}
+
+func (sw *Writer) seal(last bool) error {
+	ciphertext := sw.aead.Seal(nil, nonce(sw.prefix, sw.counter, last), sw.buf, sw.ad)
+
+	length := uint32(len(ciphertext))
+	if last {
+		length |= lastSegmentBit
+	}
+
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], length)
+
+	if _, err := sw.w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(ciphertext); err != nil {
+		return err
+	}
+
+	sw.counter++
+	sw.buf = sw.buf[:0]
+	return nil
+}
+
+// Reader opens segments sealed by a Writer. It never reads past the final
+// segment, so whatever follows it in r can be read from r afterwards.
+type Reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	ad      []byte
+	prefix  [PrefixSize]byte
+	counter uint32
+	segment []byte
+	plain   []byte
+	done    bool
+	err     error
+}
+
+// NewReader reads the nonce prefix from r and returns a Reader for the
+// segments.
+func NewReader(r io.Reader, aead cipher.AEAD, ad []byte) (*Reader, error) {
+	sr := &Reader{r: r, aead: aead, ad: ad}
+
+	if _, err := io.ReadFull(r, sr.prefix[:]); err != nil {
+		return nil, ErrTruncated
+	}
+
+	return sr, nil
+}
+
+// Next opens the next segment and returns its plaintext, which is only valid
+// until the following call, and whether it was the final one. After the final
+// segment it returns io.EOF.
+func (sr *Reader) Next() ([]byte, bool, error) {
+	if sr.err != nil {
+		return nil, false, sr.err
+	}
+	if sr.done {
+		return nil, false, io.EOF
+	}
+
+	plain, last, err := sr.next()
+	if err != nil {
+		sr.err = err
+		return nil, false, err
+	}
+
+	sr.done = last
+	return plain, last, nil
+}
+
+func (sr *Reader) Read(p []byte) (int, error) {
+	for len(sr.plain) == 0 {
+		plain, _, err := sr.Next()
+		if err != nil {
+			return 0, err
+		}
+		sr.plain = plain
+	}
+
+	n := copy(p, sr.plain)
+	sr.plain = sr.plain[n:]
+	return n, nil
+}
+
+func (sr *Reader) next() ([]byte, bool, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(sr.r, prefix[:]); err != nil {
+		return nil, false, truncated(err)
+	}
+
+	length := binary.BigEndian.Uint32(prefix[:])
+	last := length&lastSegmentBit != 0
+	length &^= lastSegmentBit
+
+	overhead := uint32(sr.aead.Overhead())
+	if length < overhead || length > SegmentSize+overhead {
+		return nil, false, ErrLength
+	}
+
+	if cap(sr.segment) < int(length) {
+		sr.segment = make([]byte, SegmentSize+sr.aead.Overhead())
+	}
+	sr.segment = sr.segment[:length]
+
+	if _, err := io.ReadFull(sr.r, sr.segment); err != nil {
+		return nil, false, truncated(err)
+	}
+
+	plain, err := sr.aead.Open(sr.segment[:0], nonce(sr.prefix, sr.counter, last), sr.segment, sr.ad)
+	if err != nil {
+		return nil, false, ErrAuth
+	}
+
+	sr.counter++
+	return plain, last, nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+func nonce(prefix [PrefixSize]byte, counter uint32, last bool) []byte {
+	n := make([]byte, 12)
+	copy(n, prefix[:])
+	binary.BigEndian.PutUint32(n[PrefixSize:], counter)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
@@ -0,0 +1,75 @@
+// Package testkeys generates throwaway device and group keys for the tests of
+// the packages that encode and decode frames.
+package testkeys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"desktop_client/config"
+	"encoding/pem"
+	"sync"
+	"testing"
+)
+
+// DeviceID is the device ID Install puts in config.
+const DeviceID = "test-device"
+
+// Device is the key material of one test device.
+type Device struct {
+	Key      *rsa.PrivateKey
+	KeyPEM   []byte // PKCS#8, like config.KeyPem
+	GroupKey []byte // the shared group key, wrapped with Key like config.GroupKey
+}
+
+var (
+	groupKeyOnce sync.Once
+	groupKey     []byte
+
+	installOnce sync.Once
+)
+
+// NewDevice generates a device key and wraps the group key every test device
+// shares with it.
+func NewDevice(tb testing.TB) Device {
+	tb.Helper()
+
+	groupKeyOnce.Do(func() {
+		groupKey = make([]byte, 32)
+		rand.Read(groupKey)
+	})
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &key.PublicKey, groupKey, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return Device{
+		Key:      key,
+		KeyPEM:   pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		GroupKey: wrapped,
+	}
+}
+
+// Install puts a test device's keys and DeviceID in config, once per test
+// binary.
+func Install(tb testing.TB) {
+	tb.Helper()
+
+	installOnce.Do(func() {
+		d := NewDevice(tb)
+		config.DeviceID = DeviceID
+		config.KeyPem = d.KeyPEM
+		config.GroupKey = d.GroupKey
+	})
+}
@@ -14,11 +14,14 @@ import (
 	"desktop_client/systrayhelpers"
 	"desktop_client/wakewatcher"
 	_ "embed"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"mime"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -37,26 +40,64 @@ var (
 	loadingMu sync.RWMutex
 
 	messageAvailable    bool
-	lastMessageSource   MessageFrom
 	messageMu           sync.RWMutex
 	notificationTimer   *time.Timer
+	notificationAt      time.Time
+	cacheTime           time.Duration // settings.CacheTime
 	notificationTimerMu sync.Mutex
 
 	errorActive bool
 	errorTimer  *time.Timer
 	errorMu     sync.Mutex
 
+	identifying   bool
+	identifyTimer *time.Timer
+	identifyMu    sync.Mutex
+
 	mDownloadRecent  *systray.MenuItem
 	mCopyToClipboard *systray.MenuItem
 
+	mRecent     *systray.MenuItem
+	recentItems []*recentMenuItem
+	recentMu    sync.Mutex
+
+	mSendTo     *systray.MenuItem
+	sendToItems []*sendToItem
+	sendToMu    sync.Mutex
+
+	mOutbox      *systray.MenuItem
+	outboxItems  []*outboxMenuItem
+	outboxMenuMu sync.Mutex
+
+	mSent     *systray.MenuItem
+	sentItems []*sentMenuItem
+	sentMu    sync.Mutex
+
+	mDevices    *systray.MenuItem
+	deviceItems []*systray.MenuItem
+	devicesMu   sync.Mutex
+
+	mCancelUninstall *systray.MenuItem
+
 	networkUp bool = true
 	networkMu sync.Mutex
 	bleState  bool = false
+	autoBLE   bool // settings.AutoBLE
 )
 
 var bleOps = make(chan func(), 1)
 
 func updateIconState() {
+	identifyMu.Lock()
+	isIdentifying := identifying
+	identifyMu.Unlock()
+
+	// Identifying takes precedence so the device stands out even mid-error
+	if isIdentifying {
+		animate.SetState(animate.StateIdentify)
+		return
+	}
+
 	errorMu.Lock()
 	hasError := errorActive
 	errorMu.Unlock()
@@ -107,6 +148,33 @@ func showErrorState() {
 	errorMu.Unlock()
 }
 
+// identifyDevice answers a ping: it beeps, shows this device's nickname and
+// blinks the tray icon for a few seconds.
+func identifyDevice(from string) {
+	playsound.Play(notificationSound)
+
+	msg := "This is " + settings.GetSettings().Nickname
+	if from != "" {
+		msg += " (pinged by " + from + ")"
+	}
+	notification.Notification(msg)
+
+	identifyMu.Lock()
+	if identifyTimer != nil {
+		identifyTimer.Stop()
+	}
+	identifying = true
+	identifyTimer = time.AfterFunc(5*time.Second, func() {
+		identifyMu.Lock()
+		identifying = false
+		identifyMu.Unlock()
+		updateIconState()
+	})
+	identifyMu.Unlock()
+
+	updateIconState()
+}
+
 func main() {
 	// Delete original executable if requested flags are passed
 	handleOriginalDeletion()
@@ -122,6 +190,15 @@ func main() {
 		}
 	}
 
+	settings.OnChange(followSettings)
+	followSettings(settings.Settings{}, settings.GetSettings())
+
+	// Apply the last known settings, so e.g. Enabled and Muted hold while
+	// the broker is unreachable
+	if err := settings.LoadCached(); err != nil {
+		log.Printf("Could not load cached settings: %v", err)
+	}
+
 	go func() {
 		for op := range bleOps {
 			op()
@@ -139,13 +216,8 @@ func main() {
 		log.Printf("Full error with mqtt: %v", err)
 	}
 
-	mqttclient.SetOnMessageCallback(func() {
-		HandleNewNotification(MQTT)
-	})
-
-	ble.SetOnMessageCallback(func() {
-		HandleNewNotification(BLE)
-	})
+	mqttclient.SetOnMessageCallback(HandleNewNotification)
+	ble.SetOnMessageCallback(HandleNewNotification)
 
 	wakewatcher.SetCallback(func() {
 		mqttclient.Disconnect()
@@ -164,17 +236,63 @@ func onReady() {
 	systrayhelpers.SetTooltip("Disconnected")
 	mSendClipboard := systray.AddMenuItem("Send Clipboard", "Send clipboard contents")
 	mSendFile := systray.AddMenuItem("Send File", "Send an file")
+	mSendTo = systray.AddMenuItem("Send to", "Send to one device")
+	mOutbox = systray.AddMenuItem("Outbox", "Items waiting to be sent")
+	mSent = systray.AddMenuItem("Sent", "Which devices received what you sent")
+	mDevices = systray.AddMenuItem("Devices", "Which devices are online")
 	systray.AddSeparator()
 	mDownloadRecent = systray.AddMenuItem("Download", "Download the most recent file")
 	mCopyToClipboard = systray.AddMenuItem("Copy to Clipboard", "Download the most recent file")
+	mRecent = systray.AddMenuItem("Recent", "Items received recently")
 	systray.AddSeparator()
 	mBLE := systray.AddMenuItemCheckbox("BLE", "Use BLE", !networkUp)
 	systray.AddSeparator()
+	mCancelUninstall = systray.AddMenuItem("Cancel Uninstall", "Keep HoppyShare on this device")
 	mRestart := systray.AddMenuItem("Restart", "Restart the app")
 	mQuit := systray.AddMenuItem("Quit", "Quit the app")
 
 	mDownloadRecent.Disable()
 	mCopyToClipboard.Disable()
+	mCancelUninstall.Hide()
+
+	mqttclient.SetOnSettingsCallback(func() {
+		updateSendToMenu()
+		updateDevicesMenu()
+		updateRecentMenu()
+	})
+	updateSendToMenu()
+
+	settings.OnChange(func(old, s settings.Settings) {
+		if s.AutoBLE != old.AutoBLE {
+			go setAutoBLE(s.AutoBLE, mBLE)
+		}
+	})
+	networkMu.Lock()
+	autoBLE = settings.GetSettings().AutoBLE
+	networkMu.Unlock()
+
+	// a destroy may have been scheduled by the cached settings already
+	settings.OnDestroyChange(updateCancelUninstall)
+	if at, ok := settings.PendingDestroy(); ok {
+		updateCancelUninstall(at)
+	}
+
+	mqttclient.OnPing(identifyDevice)
+
+	mqttclient.OnPresenceChange(func() {
+		updateSendToMenu()
+		updateDevicesMenu()
+	})
+	updateDevicesMenu()
+
+	mqttclient.OnOutboxChange(updateOutboxMenu)
+	updateOutboxMenu()
+
+	mqttclient.OnReceiptsChange(updateSentMenu)
+	updateSentMenu()
+
+	mqttclient.OnHistoryChange(updateRecentMenu)
+	updateRecentMenu()
 
 	connectivity.OnChange(func(up bool) {
 		select {
@@ -184,15 +302,17 @@ func onReady() {
 
 			networkUp = up
 
-			if settings.GetSettings().AutoBLE {
+			if autoBLE {
 				if up {
 					ble.Stop()
 					bleState = false
 					mBLE.Uncheck()
+					mqttclient.SetTransport(mqttclient.TransportMQTT)
 				} else {
 					ble.Start(clientID, config.DeviceID)
 					bleState = true
 					mBLE.Check()
+					mqttclient.SetTransport(mqttclient.TransportBLE)
 				}
 			}
 		}:
@@ -203,13 +323,13 @@ func onReady() {
 	go func() {
 		for {
 			<-mSendClipboard.ClickedCh
-			go PublishClipboard()
+			go PublishClipboard(nil)
 		}
 	}()
 	go func() {
 		for {
 			<-mSendFile.ClickedCh
-			go PublishFile()
+			go PublishFile(nil)
 		}
 	}()
 	go func() {
@@ -224,6 +344,14 @@ func onReady() {
 			go CopyRecentToClipboard()
 		}
 	}()
+	go func() {
+		for {
+			<-mCancelUninstall.ClickedCh
+			if settings.CancelDestroy() {
+				notification.Notification("Uninstall cancelled")
+			}
+		}
+	}()
 	go func() {
 		for {
 			<-mRestart.ClickedCh
@@ -255,10 +383,12 @@ func onReady() {
 					ble.Stop()
 					bleState = false
 					mBLE.Uncheck()
+					mqttclient.SetTransport(mqttclient.TransportMQTT)
 				} else {
 					ble.Start(clientID, config.DeviceID)
 					bleState = true
 					mBLE.Check()
+					mqttclient.SetTransport(mqttclient.TransportBLE)
 				}
 			}:
 			default:
@@ -269,19 +399,376 @@ func onReady() {
 
 }
 
-type MessageFrom int
+// sendToItem is one device in the "Send to" submenu. systray cannot remove
+// menu items, so items are reused for whichever device is at their position
+// and hidden when the list gets shorter.
+type sendToItem struct {
+	item      *systray.MenuItem
+	clipboard *systray.MenuItem
+	file      *systray.MenuItem
+	identify  *systray.MenuItem
+	deviceID  string
+}
 
-const (
-	MQTT MessageFrom = iota
-	BLE
-)
+func newSendToItem() *sendToItem {
+	s := &sendToItem{item: mSendTo.AddSubMenuItem("", "")}
+	s.clipboard = s.item.AddSubMenuItem("Clipboard", "Send clipboard contents to this device")
+	s.file = s.item.AddSubMenuItem("File", "Send a file to this device")
+	s.identify = s.item.AddSubMenuItem("Identify", "Make this device beep and flash its icon")
+
+	go func() {
+		for {
+			select {
+			case <-s.clipboard.ClickedCh:
+				go PublishClipboard([]string{s.target()})
+			case <-s.file.ClickedCh:
+				go PublishFile([]string{s.target()})
+			case <-s.identify.ClickedCh:
+				go func(id string) {
+					if err := mqttclient.Ping(id); err != nil {
+						log.Printf("[PING] Could not ping %s: %v", id, err)
+						notification.Notification("Error: Could not ping device")
+					}
+				}(s.target())
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *sendToItem) target() string {
+	sendToMu.Lock()
+	defer sendToMu.Unlock()
+	return s.deviceID
+}
+
+// updateSendToMenu rebuilds the "Send to" submenu from the device list in
+// the settings topic.
+func updateSendToMenu() {
+	sendToMu.Lock()
+	defer sendToMu.Unlock()
+
+	var devices []settings.Device
+	for _, d := range settings.Devices() {
+		if d.ID != config.DeviceID {
+			devices = append(devices, d)
+		}
+	}
+
+	for len(sendToItems) < len(devices) {
+		sendToItems = append(sendToItems, newSendToItem())
+	}
+
+	for i, s := range sendToItems {
+		if i >= len(devices) {
+			s.deviceID = ""
+			s.item.Hide()
+			continue
+		}
+
+		s.deviceID = devices[i].ID
+		title := devices[i].Nickname
+		if p, ok := mqttclient.PeerPresence(devices[i].ID); ok && !p.Online {
+			title += " (offline)"
+		}
+		s.item.SetTitle(title)
+		s.item.Show()
+	}
+
+	if len(devices) == 0 {
+		mSendTo.Disable()
+	} else {
+		mSendTo.Enable()
+	}
+}
+
+// outboxMenuItem is one queued item in the "Outbox" submenu. Clicking it
+// cancels the item. Like sendToItem, items are reused and hidden.
+type outboxMenuItem struct {
+	item *systray.MenuItem
+	id   string
+}
+
+func newOutboxMenuItem() *outboxMenuItem {
+	o := &outboxMenuItem{item: mOutbox.AddSubMenuItem("", "")}
+
+	go func() {
+		for {
+			<-o.item.ClickedCh
+
+			outboxMenuMu.Lock()
+			id := o.id
+			outboxMenuMu.Unlock()
+
+			if id != "" {
+				mqttclient.CancelOutbox(id)
+			}
+		}
+	}()
 
-func HandleNewNotification(source MessageFrom) {
+	return o
+}
+
+// updateOutboxMenu lists the items waiting in the outbox, and hides the menu
+// while it is empty.
+func updateOutboxMenu() {
+	outboxMenuMu.Lock()
+	defer outboxMenuMu.Unlock()
+
+	pending := mqttclient.Outbox()
+
+	for len(outboxItems) < len(pending) {
+		outboxItems = append(outboxItems, newOutboxMenuItem())
+	}
+
+	for i, o := range outboxItems {
+		if i >= len(pending) {
+			o.id = ""
+			o.item.Hide()
+			continue
+		}
+
+		p := pending[i]
+		o.id = p.ID
+		o.item.SetTitle("Cancel " + p.Filename)
+		o.item.SetTooltip(fmt.Sprintf("Queued at %s, expires at %s", p.Queued.Format("15:04"), p.Expires.Format("Jan 2 15:04")))
+		o.item.Show()
+	}
+
+	if len(pending) == 0 {
+		mOutbox.Hide()
+	} else {
+		mOutbox.SetTitle(fmt.Sprintf("Outbox (%d)", len(pending)))
+		mOutbox.Show()
+	}
+}
+
+// updateDevicesMenu lists every device on the account with whether it is
+// online and over which transport. The items are informational only.
+func updateDevicesMenu() {
+	devicesMu.Lock()
+	defer devicesMu.Unlock()
+
+	devices := settings.Devices()
+
+	for len(deviceItems) < len(devices) {
+		item := mDevices.AddSubMenuItem("", "")
+		item.Disable()
+		deviceItems = append(deviceItems, item)
+	}
+
+	online := 0
+	for i, item := range deviceItems {
+		if i >= len(devices) {
+			item.Hide()
+			continue
+		}
+
+		d := devices[i]
+		name := d.Nickname
+		if d.ID == config.DeviceID {
+			name += " (this device)"
+		}
+
+		p, ok := mqttclient.PeerPresence(d.ID)
+		switch {
+		case !ok:
+			item.SetTitle("○ " + name)
+		case p.Online:
+			online++
+			item.SetTitle(fmt.Sprintf("● %s: online over %s", name, strings.ToUpper(p.Transport)))
+		default:
+			item.SetTitle(fmt.Sprintf("○ %s: last seen %s", name, p.Since.Local().Format("Jan 2 15:04")))
+		}
+		item.Show()
+	}
+
+	mDevices.SetTitle(fmt.Sprintf("Devices (%d online)", online))
+}
+
+// recentMenuItem is one received item in the "Recent" submenu, with actions
+// to copy or save it. Like sendToItem, items are reused and hidden.
+type recentMenuItem struct {
+	item      *systray.MenuItem
+	clipboard *systray.MenuItem
+	save      *systray.MenuItem
+	entry     mqttclient.HistoryItem
+}
+
+func newRecentItem() *recentMenuItem {
+	r := &recentMenuItem{item: mRecent.AddSubMenuItem("", "")}
+	r.clipboard = r.item.AddSubMenuItem("Copy to Clipboard", "Copy this item to the clipboard")
+	r.save = r.item.AddSubMenuItem("Save", "Save this item to a file")
+
+	go func() {
+		for {
+			select {
+			case <-r.clipboard.ClickedCh:
+				go CopyHistoryItem(r.current())
+			case <-r.save.ClickedCh:
+				go SaveHistoryItem(r.current())
+			}
+		}
+	}()
+
+	return r
+}
+
+func (r *recentMenuItem) current() mqttclient.HistoryItem {
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	return r.entry
+}
+
+// updateRecentMenu lists the received items, newest first, with who sent
+// them, when, and how large they are.
+func updateRecentMenu() {
+	recentMu.Lock()
+	defer recentMu.Unlock()
+
+	items := mqttclient.History()
+
+	nicknames := make(map[string]string)
+	for _, d := range settings.Devices() {
+		nicknames[d.ID] = d.Nickname
+	}
+
+	for len(recentItems) < len(items) {
+		recentItems = append(recentItems, newRecentItem())
+	}
+
+	for i, r := range recentItems {
+		if i >= len(items) {
+			r.entry = mqttclient.HistoryItem{}
+			r.item.Hide()
+			continue
+		}
+
+		it := items[i]
+		r.entry = it
+
+		sender, ok := nicknames[it.Sender]
+		if !ok {
+			sender = it.Sender[:min(8, len(it.Sender))]
+		}
+
+		title := fmt.Sprintf("%s (%s) from %s at %s", it.Filename, formatSize(it.Size), sender, it.Received.Local().Format("Jan 2 15:04"))
+		if !it.Verified {
+			title += " (unverified sender)"
+		}
+		r.item.SetTitle(title)
+		r.item.SetTooltip(fmt.Sprintf("%s, received over %s", it.ContentType, strings.ToUpper(it.Source)))
+
+		if it.Size > mqttclient.MaxMessageSize {
+			r.clipboard.Disable()
+		} else {
+			r.clipboard.Enable()
+		}
+		r.item.Show()
+	}
+
+	if len(items) == 0 {
+		mRecent.Disable()
+	} else {
+		mRecent.Enable()
+	}
+}
+
+// formatSize formats a byte count for menu titles.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1024*1024*1024:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1024*1024*1024))
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// sentMenuItem is one recently sent note in the "Sent" submenu, with one
+// disabled item per device that sent a receipt. Items are reused and hidden.
+type sentMenuItem struct {
+	item    *systray.MenuItem
+	devices []*systray.MenuItem
+}
+
+// updateSentMenu lists the last notes sent and who received, copied or saved
+// them.
+func updateSentMenu() {
+	sentMu.Lock()
+	defer sentMu.Unlock()
+
+	nicknames := make(map[string]string)
+	for _, d := range settings.Devices() {
+		nicknames[d.ID] = d.Nickname
+	}
+
+	notes := mqttclient.SentNotes()
+
+	for len(sentItems) < len(notes) {
+		sentItems = append(sentItems, &sentMenuItem{item: mSent.AddSubMenuItem("", "")})
+	}
+
+	for i, s := range sentItems {
+		if i >= len(notes) {
+			s.item.Hide()
+			continue
+		}
+
+		n := notes[i]
+		s.item.SetTitle(fmt.Sprintf("%s (%d/%d received)", n.Filename, len(n.Receipts), n.Expected))
+		s.item.SetTooltip("Sent at " + n.Sent.Format("15:04"))
+		s.item.Show()
+
+		for len(s.devices) < len(n.Receipts) {
+			d := s.item.AddSubMenuItem("", "")
+			d.Disable()
+			s.devices = append(s.devices, d)
+		}
+
+		for j, d := range s.devices {
+			if j >= len(n.Receipts) {
+				d.Hide()
+				continue
+			}
+
+			r := n.Receipts[j]
+			name, ok := nicknames[r.Device]
+			if !ok {
+				name = r.Device[:min(8, len(r.Device))]
+			}
+			d.SetTitle(fmt.Sprintf("%s: %s at %s", name, r.Status, r.At.Format("15:04")))
+			d.Show()
+		}
+	}
+
+	if len(notes) == 0 {
+		mSent.Disable()
+	} else {
+		mSent.Enable()
+	}
+}
+
+func HandleNewNotification() {
 	messageMu.Lock()
 	messageAvailable = true
-	lastMessageSource = source
 	messageMu.Unlock()
 
+	latest, _ := mqttclient.LatestHistory()
+	rule := settings.ReceiveFor(latest.Sender, latest.ContentType)
+
+	if latest.Verified {
+		mDownloadRecent.SetTitle("Download")
+		mCopyToClipboard.SetTitle("Copy to Clipboard")
+	} else {
+		mDownloadRecent.SetTitle("Download (unverified sender)")
+		mCopyToClipboard.SetTitle("Copy to Clipboard (unverified sender)")
+	}
+
 	mDownloadRecent.Enable()
 	mCopyToClipboard.Enable()
 
@@ -290,37 +777,103 @@ func HandleNewNotification(source MessageFrom) {
 		notificationTimer.Stop()
 	}
 
-	cacheTime := settings.GetSettings().CacheTime
+	notificationAt = time.Now()
+	notificationTimer = time.AfterFunc(cacheTime, expireNotification)
+	notificationTimerMu.Unlock()
 
-	notificationTimer = time.AfterFunc(time.Duration(cacheTime)*time.Second, func() {
-		messageMu.Lock()
-		messageAvailable = false
-		messageMu.Unlock()
+	updateIconState()
 
-		mDownloadRecent.Disable()
-		mCopyToClipboard.Disable()
+	if !rule.Muted {
+		playsound.Play(notificationSound)
+	}
 
-		mqttclient.ClearMsg()
-		ble.ClearMsg()
+	if rule.AutoCopy {
+		CopyHistoryItem(latest)
+	}
+	if rule.AutoSave {
+		go AutoSaveHistoryItem(latest)
+	}
+}
 
-		messageMu.Lock()
-		messageAvailable = false
-		messageMu.Unlock()
-		updateIconState()
-	})
-	notificationTimerMu.Unlock()
+// expireNotification runs once the newest item has been on display for
+// cacheTime.
+func expireNotification() {
+	messageMu.Lock()
+	messageAvailable = false
+	messageMu.Unlock()
+
+	mDownloadRecent.Disable()
+	mCopyToClipboard.Disable()
+
+	// without a history the item only lasts as long as the icon
+	if settings.GetSettings().HistorySize == 0 {
+		mqttclient.ClearHistory()
+	}
+	ble.ClearMsg()
 
+	messageMu.Lock()
+	messageAvailable = false
+	messageMu.Unlock()
 	updateIconState()
+}
 
-	playsound.Play(notificationSound)
+// setCacheTime follows the cache_time setting, moving the deadline of the
+// item on display.
+func setCacheTime(seconds int) {
+	notificationTimerMu.Lock()
+	defer notificationTimerMu.Unlock()
 
-	if settings.GetSettings().AutoCopy {
-		CopyRecentToClipboard()
+	cacheTime = time.Duration(seconds) * time.Second
+	if notificationTimer != nil && notificationTimer.Stop() {
+		notificationTimer = time.AfterFunc(max(cacheTime-time.Since(notificationAt), 0), expireNotification)
 	}
 }
 
+// followSettings hands the settings that change how the client signals and
+// how long it keeps items on display to where they are used.
+func followSettings(old, s settings.Settings) {
+	playsound.SetMuted(s.Muted)
+	animate.SetLightAnimations(s.LightAnimations)
+
+	if s.CacheTime != old.CacheTime {
+		setCacheTime(s.CacheTime)
+	}
+}
+
+// setAutoBLE follows the auto_ble setting. Turning it on while the network is
+// down switches to BLE right away, as losing the network would have.
+func setAutoBLE(on bool, mBLE *systray.MenuItem) {
+	bleOps <- func() {
+		networkMu.Lock()
+		defer networkMu.Unlock()
+
+		autoBLE = on
+		if on && !networkUp && !bleState {
+			ble.Start(clientID, config.DeviceID)
+			bleState = true
+			mBLE.Check()
+			mqttclient.SetTransport(mqttclient.TransportBLE)
+		}
+	}
+}
+
+// updateCancelUninstall shows the "Cancel Uninstall" item while a destroy
+// from the settings is scheduled, at is zero once it was cancelled.
+func updateCancelUninstall(at time.Time) {
+	if at.IsZero() {
+		mCancelUninstall.Hide()
+		return
+	}
+
+	mCancelUninstall.SetTitle("Cancel Uninstall (" + at.Format(time.Kitchen) + ")")
+	mCancelUninstall.Show()
+	notification.Notification(fmt.Sprintf("This device will uninstall HoppyShare in %d minutes. Choose Cancel Uninstall in the tray to keep it.", int(time.Until(at).Round(time.Minute).Minutes())))
+}
+
 func onExit() {
 	// Cleanup
+	mqttclient.Disconnect()
+	config.ClearKeys()
 }
 
 var defaultExtensions = map[string]string{
@@ -340,17 +893,19 @@ func ExtensionFromMime(mimeType string) string {
 	return exts[0]
 }
 
-func PublishClipboard() {
+// PublishClipboard sends the clipboard to the devices in to, or to every
+// device if to is empty.
+func PublishClipboard(to []string) {
 	loadingMu.Lock()
 	loading = true
 	loadingMu.Unlock()
 	updateIconState()
 
-	content, mimeType, err := clipboard.Read()
-	
-	// clipboard > 25mb
-	if len([]byte(content)) > 25*1024*1024 {
-		notifyErr := notification.Notification("Clipboard too large (>80MB). Operation cancelled.")
+	content, mimeType, ext, err := readClipboardFor(to)
+
+	// clipboard > 4GB
+	if int64(len(content)) > mqttclient.MaxTransferSize {
+		notifyErr := notification.Notification("Clipboard too large (>4GB). Operation cancelled.")
 		if notifyErr != nil {
 			log.Println("Notification error:", notifyErr)
 		}
@@ -372,8 +927,6 @@ func PublishClipboard() {
 		return
 	}
 
-	ext := ExtensionFromMime(mimeType)
-
 	topic := fmt.Sprintf("users/%s/notes", clientID)
 	filename := fmt.Sprintf("clipboard%s", ext)
 
@@ -391,9 +944,15 @@ func PublishClipboard() {
 			return
 		}
 
-		ble.Publish([]byte(content), mimeType, filename)
+		ble.Publish([]byte(content), mimeType, filename, to)
+	} else if len(content) > mqttclient.MaxMessageSize {
+		err = mqttclient.PublishTransferData(topic, to, content, mimeType, filename)
+		if err != nil {
+			notifyTransferError(err)
+			log.Println(err)
+		}
 	} else {
-		err = mqttclient.Publish(topic, []byte(content), mimeType, filename)
+		err = mqttclient.Publish(topic, to, []byte(content), mimeType, filename)
 		if err != nil {
 			log.Println(err)
 		}
@@ -405,7 +964,38 @@ func PublishClipboard() {
 	updateIconState()
 }
 
-func PublishFile() {
+// readClipboardFor reads the clipboard for sending to the devices in to. When
+// it holds several representations and every recipient understands clips,
+// they all go in one clip payload; otherwise only the preferred one is sent.
+// ext is the file extension of the preferred representation.
+func readClipboardFor(to []string) (content []byte, mimeType, ext string, err error) {
+	reps, err := clipboard.ReadAll()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	primary := reps[0]
+	ext = ExtensionFromMime(primary.Type)
+	if len(reps) == 1 || !mqttclient.ClipsSupported(to) {
+		return primary.Data, primary.Type, ext, nil
+	}
+
+	clip := make([]mqttclient.Representation, len(reps))
+	for i, r := range reps {
+		clip[i] = mqttclient.Representation(r)
+	}
+
+	content, err = mqttclient.EncodeClip(clip)
+	if err != nil {
+		log.Println("Sending clipboard without extra representations:", err)
+		return primary.Data, primary.Type, ext, nil
+	}
+	return content, mqttclient.ClipType, ext, nil
+}
+
+// PublishFile asks for a file and sends it to the devices in to, or to every
+// device if to is empty.
+func PublishFile(to []string) {
 	loadingMu.Lock()
 	loading = true
 	loadingMu.Unlock()
@@ -421,7 +1011,7 @@ func PublishFile() {
 		return
 	}
 
-	fileBytes, err := os.ReadFile(filePath)
+	info, err := os.Stat(filePath)
 	if err != nil {
 		notifyErr := notification.Notification("Could not read file: " + err.Error())
 		if notifyErr != nil {
@@ -436,9 +1026,9 @@ func PublishFile() {
 		return
 	}
 
-	// file size > 25MB
-	if len(fileBytes) > 25*1024*1024 {
-		notifyErr := notification.Notification("File is too large (>80MB). Operation cancelled.")
+	// file size > 4GB
+	if info.Size() > mqttclient.MaxTransferSize {
+		notifyErr := notification.Notification("File is too large (>4GB). Operation cancelled.")
 		if notifyErr != nil {
 			log.Println("Notification error:", notifyErr)
 		}
@@ -462,6 +1052,50 @@ func PublishFile() {
 
 	topic := fmt.Sprintf("users/%s/notes", clientID)
 
+	// Over MQTT the file is streamed from disk instead of read in one go
+	if !bleState {
+		if info.Size() > mqttclient.MaxMessageSize {
+			err = mqttclient.PublishTransfer(topic, to, filePath, mimeType, fileName)
+			if err != nil {
+				notifyTransferError(err)
+			}
+		} else {
+			var f *os.File
+			f, err = os.Open(filePath)
+			if err == nil {
+				err = mqttclient.PublishReader(topic, to, f, mimeType, fileName)
+				f.Close()
+			}
+		}
+
+		loadingMu.Lock()
+		loading = false
+		loadingMu.Unlock()
+
+		if err != nil {
+			log.Println(err)
+			showErrorState()
+		} else {
+			updateIconState()
+		}
+		return
+	}
+
+	fileBytes, err := os.ReadFile(filePath)
+	if err != nil {
+		notifyErr := notification.Notification("Could not read file: " + err.Error())
+		if notifyErr != nil {
+			log.Printf("Failed to read file")
+			log.Println("Notification error:", notifyErr)
+		}
+
+		loadingMu.Lock()
+		loading = false
+		loadingMu.Unlock()
+		updateIconState()
+		return
+	}
+
 	if bleState {
 		if len(fileBytes) > 3*1024*1024 {
 			notifyErr := notification.Notification("File too large for BLE (>3MB). Operation cancelled")
@@ -476,19 +1110,10 @@ func PublishFile() {
 			return
 		}
 
-		err := ble.Publish(fileBytes, mimeType, fileName)
+		err := ble.Publish(fileBytes, mimeType, fileName, to)
 		if err != nil {
 			log.Println(err)
 		}
-	} else {
-		err = mqttclient.Publish(topic, fileBytes, mimeType, fileName)
-		if err != nil {
-			loadingMu.Lock()
-			loading = false
-			loadingMu.Unlock()
-			showErrorState()
-			return
-		}
 	}
 
 	loadingMu.Lock()
@@ -497,38 +1122,27 @@ func PublishFile() {
 	updateIconState()
 }
 
+// DownloadRecent saves the newest received item.
 func DownloadRecent() {
-
-	var (
-		fname string
-		data  []byte
-		ok    bool
-	)
-
-	messageMu.RLock()
-	source := lastMessageSource
-	messageMu.RUnlock()
-
-	switch source {
-	case MQTT:
-		fname, _, data, ok = mqttclient.GetLastMessage()
-	case BLE:
-		fname, _, data, ok = ble.GetLastMessage()
-	}
-
+	item, ok := mqttclient.LatestHistory()
 	if !ok {
 		log.Println("No recent message to download")
 		return
 	}
 
+	SaveHistoryItem(item)
+}
+
+// SaveHistoryItem asks where to save a received item and writes it there.
+func SaveHistoryItem(item mqttclient.HistoryItem) {
 	// guess ext by name
-	ft := filepath.Ext(fname)
+	ft := filepath.Ext(item.Filename)
 	// clipboard data has no fname (shouldnt be possible tbh)
 	if ft == "" {
 		ft = ".txt"
 	}
 
-	defaultName := fname
+	defaultName := item.Filename
 	if defaultName == "" {
 		defaultName = "clipboard" + ft
 	}
@@ -545,39 +1159,149 @@ func DownloadRecent() {
 		savePath += ft
 	}
 
-	// Write out file
-	if err := os.WriteFile(savePath, data, 0644); err != nil {
-		log.Printf("Failed to write file: %v", err)
-	} else {
-		log.Printf("Saved recent note to %s", savePath)
+	saveHistoryItemTo(item, savePath)
+}
+
+// AutoSaveHistoryItem saves a received item to the downloads folder without
+// asking, for senders whose receive rule has auto_save. An existing file is
+// not overwritten, the item gets a numbered name instead.
+func AutoSaveHistoryItem(item mqttclient.HistoryItem) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		log.Printf("Could not find the downloads folder: %v", err)
+		return
+	}
+	dir := filepath.Join(home, "Downloads")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("Could not create the downloads folder: %v", err)
+		return
+	}
+
+	name := filepath.Base(item.Filename)
+	if name == "" || name == "." || name == string(filepath.Separator) {
+		name = "clipboard.txt"
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	savePath := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(savePath); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		savePath = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+
+	if saveHistoryItemTo(item, savePath) {
+		notification.Notification("Saved " + filepath.Base(savePath) + " to Downloads")
 	}
 }
 
-func CopyRecentToClipboard() {
-	var (
-		ctype string
-		data  []byte
-		ok    bool
-	)
+// saveHistoryItemTo writes a received item to savePath and reports whether it
+// was saved.
+func saveHistoryItemTo(item mqttclient.HistoryItem, savePath string) bool {
+	var err error
 
-	messageMu.RLock()
-	source := lastMessageSource
-	messageMu.RUnlock()
+	// clips are saved as their preferred representation
+	if item.ContentType == mqttclient.ClipType {
+		var data []byte
+		data, _, err = mqttclient.ReadHistory(item.ID)
+		if err != nil {
+			log.Printf("Failed to read received item: %v", err)
+			return false
+		}
 
-	switch source {
-	case MQTT:
-		_, ctype, data, ok = mqttclient.GetLastMessage()
-	case BLE:
-		_, ctype, data, ok = ble.GetLastMessage()
+		reps, decodeErr := mqttclient.DecodeClip(data)
+		if decodeErr != nil {
+			log.Printf("Failed to decode clip: %v", decodeErr)
+			return false
+		}
+		err = os.WriteFile(savePath, reps[0].Data, 0644)
+	} else {
+		// Large transfers are streamed out of the history
+		err = writeHistoryItem(item.ID, savePath)
 	}
 
+	if err != nil {
+		log.Printf("Failed to write file: %v", err)
+		return false
+	}
+
+	log.Printf("Saved received item to %s", savePath)
+	mqttclient.ReportReceived(item.ID, mqttclient.ReceiptSaved)
+	return true
+}
+
+// CopyRecentToClipboard copies the newest received item.
+func CopyRecentToClipboard() {
+	item, ok := mqttclient.LatestHistory()
 	if !ok {
 		log.Println("No recent message to copy")
 		return
 	}
 
-	if err := clipboard.Write(data, ctype); err != nil {
+	CopyHistoryItem(item)
+}
+
+// CopyHistoryItem copies a received item to the clipboard. Items larger than
+// mqttclient.MaxMessageSize can only be saved.
+func CopyHistoryItem(item mqttclient.HistoryItem) {
+	data, _, err := mqttclient.ReadHistory(item.ID)
+	if err != nil {
+		log.Printf("Failed to read received item: %v", err)
+		return
+	}
+
+	if item.ContentType == mqttclient.ClipType {
+		clip, err := mqttclient.DecodeClip(data)
+		if err != nil {
+			log.Printf("Failed to decode clip: %v", err)
+			return
+		}
+
+		reps := make([]clipboard.Representation, len(clip))
+		for i, r := range clip {
+			reps[i] = clipboard.Representation(r)
+		}
+		if err := clipboard.WriteAll(reps); err != nil {
+			log.Println("Couldn't copy to clipboard")
+			return
+		}
+	} else if err := clipboard.Write(data, item.ContentType); err != nil {
 		log.Println("Couldn't copy to clipboard")
+		return
+	}
+
+	mqttclient.ReportReceived(item.ID, mqttclient.ReceiptCopied)
+}
+
+// writeHistoryItem decrypts a received item to dst. A partly written file is
+// removed if the item turns out to be corrupt.
+func writeHistoryItem(id, dst string) error {
+	in, _, err := mqttclient.OpenHistory(id)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+func notifyTransferError(err error) {
+	if errors.Is(err, mqttclient.ErrTransfersUnsupported) {
+		notification.Notification("Error: Not every device supports large transfers yet")
+	} else {
+		notification.Notification("Error: Large transfer failed")
 	}
 }
 
@@ -0,0 +1,158 @@
+package mqttclient
+
+import (
+	"crypto/tls"
+	"desktop_client/config"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Broker failover
+//
+// The client stays connected to one broker at a time, the first in
+// config.BrokerList that is healthy. A broker that fails to connect, or drops
+// an established connection, backs off for a while so the next one is tried
+// instead. While connected to a fallback, the preferred brokers are probed
+// with a TLS handshake and the client moves back once one answers.
+const (
+	minBrokerBackoff = 5 * time.Second
+	maxBrokerBackoff = 5 * time.Minute
+	failbackInterval = time.Minute
+	probeTimeout     = 10 * time.Second
+)
+
+type brokerHealth struct {
+	failures  int
+	retryAt   time.Time // zero while healthy
+	lastError error
+}
+
+type brokerPool struct {
+	mu      sync.Mutex
+	brokers []config.Broker
+	health  []brokerHealth
+	v3      []bool // refused MQTT v5, see conn.go
+}
+
+func newBrokerPool(brokers []config.Broker) *brokerPool {
+	return &brokerPool{
+		brokers: brokers,
+		health:  make([]brokerHealth, len(brokers)),
+		v3:      make([]bool, len(brokers)),
+	}
+}
+
+// next returns the index of the broker to connect to and how long to wait
+// before trying it. That is the first broker not backing off, or else the
+// one whose backoff ends first.
+func (p *brokerPool) next() (int, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	best := 0
+	for i, h := range p.health {
+		if !now.Before(h.retryAt) {
+			return i, 0
+		}
+		if h.retryAt.Before(p.health[best].retryAt) {
+			best = i
+		}
+	}
+	return best, p.health[best].retryAt.Sub(now)
+}
+
+// failed backs the broker off, doubling the wait for every failure in a row.
+func (p *brokerPool) failed(i int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := &p.health[i]
+	h.failures++
+	h.lastError = err
+
+	backoff := minBrokerBackoff << min(h.failures-1, 10)
+	if backoff > maxBrokerBackoff {
+		backoff = maxBrokerBackoff
+	}
+	h.retryAt = time.Now().Add(backoff)
+
+	log.Printf("[BROKER] %s failed (%d in a row), retrying in %s: %v", p.brokers[i].URL, h.failures, backoff, err)
+}
+
+// succeeded marks the broker healthy.
+func (p *brokerPool) succeeded(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.health[i] = brokerHealth{}
+}
+
+func (p *brokerPool) v3Only(i int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.v3[i]
+}
+
+func (p *brokerPool) setV3Only(i int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.v3[i] = true
+}
+
+// preferred returns the indexes of brokers ahead of current that are due
+// for another try.
+func (p *brokerPool) preferred(current int) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var due []int
+	for i := 0; i < current; i++ {
+		if !now.Before(p.health[i].retryAt) {
+			due = append(due, i)
+		}
+	}
+	return due
+}
+
+// brokerTLSConfig returns base with the broker's server name and CA pin.
+func brokerTLSConfig(base *tls.Config, b config.Broker) *tls.Config {
+	cfg := base.Clone()
+	cfg.ServerName = b.Host()
+	if strings.HasPrefix(b.URL, "wss:") {
+		// tells a shared 443 apart from HTTPS, see mosquitto-docker/nginx
+		cfg.NextProtos = []string{"mqtt", "http/1.1"}
+	}
+	if b.CAPin != "" {
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if !b.MatchesPin(cs.VerifiedChains) {
+				return errors.New("broker certificate chain does not match ca_pin")
+			}
+			return nil
+		}
+	}
+	return cfg
+}
+
+// probeBroker checks that a TLS handshake with the broker succeeds, through
+// the same proxy the connection would use.
+func probeBroker(base *tls.Config, b config.Broker) error {
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return err
+	}
+	proxyURL, err := brokerProxy(b)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialBrokerTLS(brokerAddr(u), brokerTLSConfig(base, b), proxyURL, probeTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
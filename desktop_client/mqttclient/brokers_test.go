@@ -0,0 +1,88 @@
+package mqttclient
+
+import (
+	"desktop_client/config"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testBrokerPool(n int) *brokerPool {
+	brokers := make([]config.Broker, n)
+	for i := range brokers {
+		brokers[i] = config.Broker{URL: "tls://broker" + string(rune('a'+i)) + ":8883"}
+	}
+	return newBrokerPool(brokers)
+}
+
+func TestBrokerPoolFailover(t *testing.T) {
+	errDown := errors.New("down")
+	p := testBrokerPool(3)
+
+	steps := []struct {
+		name     string
+		do       func()
+		want     int
+		waitSome bool
+	}{
+		{"all healthy", func() {}, 0, false},
+		{"first fails", func() { p.failed(0, errDown) }, 1, false},
+		{"second fails", func() { p.failed(1, errDown) }, 2, false},
+		{"first is back", func() { p.succeeded(0) }, 0, false},
+		{"first fails again", func() { p.failed(0, errDown) }, 2, false},
+		// the second failed longest ago, so its backoff ends first
+		{"all fail", func() { p.failed(2, errDown) }, 1, true},
+	}
+
+	for _, step := range steps {
+		step.do()
+		i, wait := p.next()
+		if i != step.want {
+			t.Errorf("%s: next = broker %d, want %d", step.name, i, step.want)
+		}
+		if step.waitSome != (wait > 0) {
+			t.Errorf("%s: next waits %s", step.name, wait)
+		}
+	}
+}
+
+func TestBrokerPoolBackoff(t *testing.T) {
+	p := testBrokerPool(1)
+
+	want := minBrokerBackoff
+	for failures := 1; failures <= 12; failures++ {
+		p.failed(0, errors.New("down"))
+
+		_, wait := p.next()
+		if wait > want || wait < want-time.Second {
+			t.Errorf("after %d failures: waiting %s, want %s", failures, wait, want)
+		}
+		want = min(want*2, maxBrokerBackoff)
+	}
+
+	p.succeeded(0)
+	if _, wait := p.next(); wait != 0 {
+		t.Errorf("waiting %s after success", wait)
+	}
+}
+
+func TestBrokerPoolPreferred(t *testing.T) {
+	p := testBrokerPool(4)
+	p.failed(1, errors.New("down"))
+
+	tests := []struct {
+		current int
+		want    []int
+	}{
+		{0, nil},
+		{1, []int{0}},
+		{3, []int{0, 2}},
+	}
+
+	for _, tt := range tests {
+		if got := p.preferred(tt.current); !slices.Equal(got, tt.want) {
+			t.Errorf("preferred(%d) = %v, want %v", tt.current, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package mqttclient
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"slices"
+	"time"
+)
+
+// Capabilities is the retained message every device publishes to
+// users/<clientID>/caps/<sha256(deviceID) hex> so senders can pick a frame
+// version all recipients understand. Features lists the payloads the device
+// handles beyond what its frame versions imply, so senders only send them to
+// devices that do. Cert is the device's mTLS certificate, used to verify
+// signed frames. KeyIDs lists the group keys the device can decrypt with, so
+// senders keep using the previous key until every recipient has a rotated
+// one; devices that list none only have key 0.
+type Capabilities struct {
+	Device   string   `json:"device"`
+	Versions []int    `json:"versions"`
+	Features []string `json:"features,omitempty"`
+	Cert     string   `json:"cert,omitempty"`
+	KeyIDs   []uint32 `json:"key_ids,omitempty"`
+}
+
+// Features
+const (
+	FeatureClips    = "clips"    // clip payloads, see clip.go
+	FeatureReceipts = "receipts" // delivery receipts, see receipts.go
+)
+
+// SupportedFeatures lists every feature this client handles. It is
+// advertised to the other devices through publishCapabilities.
+var SupportedFeatures = []string{FeatureClips, FeatureReceipts}
+
+// publishCapabilities advertises the frame versions this device can decode,
+// the features it handles and the group keys it has.
+func (c *Client) publishCapabilities(cn conn) error {
+	self := hashDeviceID(c.opts.DeviceID)
+
+	versions := make([]int, len(SupportedVersions))
+	for i, v := range SupportedVersions {
+		versions[i] = int(v)
+	}
+
+	keyIDs := c.groupKeys.IDs()
+	data, err := json.Marshal(Capabilities{
+		Device:   hex.EncodeToString(self[:]),
+		Versions: versions,
+		Features: SupportedFeatures,
+		Cert:     string(c.opts.CertPEM),
+		KeyIDs:   keyIDs,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.peerCapsMu.Lock()
+	c.keyIDs = keyIDs
+	c.peerCapsMu.Unlock()
+
+	return cn.Publish(c.deviceTopic("caps"), data, publishOptions{Retain: true, Timeout: 10 * time.Second})
+}
+
+func (c *Client) handleCapabilities(m message) {
+	// An empty retained payload means the device was removed
+	if len(m.Payload) == 0 {
+		c.peerCapsMu.Lock()
+		for device := range c.peerCaps {
+			if _, ok := c.topicDevice(m.Topic, hex.EncodeToString(device[:])); ok {
+				delete(c.peerCaps, device)
+			}
+		}
+		c.peerCapsMu.Unlock()
+		return
+	}
+
+	var caps Capabilities
+	if err := json.Unmarshal(m.Payload, &caps); err != nil {
+		log.Printf("[CAPS] Failed to parse %s: %v", m.Topic, err)
+		return
+	}
+
+	device, ok := c.topicDevice(m.Topic, caps.Device)
+	if !ok {
+		log.Printf("[CAPS] Device %q does not match topic %s", caps.Device, m.Topic)
+		return
+	}
+	suffix := hex.EncodeToString(device[:])
+
+	c.peerCapsMu.Lock()
+	c.peerCaps[device] = caps
+	c.peerCapsMu.Unlock()
+
+	if caps.Cert != "" {
+		if err := c.registerPeerCert(device, []byte(caps.Cert)); err != nil {
+			log.Printf("[CAPS] Rejected certificate of %s: %v", suffix[:8], err)
+		}
+	}
+
+	log.Printf("[CAPS] %s supports versions %v, features %v", suffix[:8], caps.Versions, caps.Features)
+}
+
+// NegotiateVersion returns the newest frame version that every device listed
+// in the settings topic can decode. Devices that never advertised
+// capabilities are older clients and only understand V0.
+func (c *Client) NegotiateVersion() byte {
+	return c.negotiateVersionFor(nil)
+}
+
+// negotiateVersionFor is NegotiateVersion for a directed send, which only
+// the devices in to have to understand. An empty to means every device.
+func (c *Client) negotiateVersionFor(to []string) byte {
+	return c.negotiateVersionForHashes(recipientHashes(to))
+}
+
+// negotiateVersionForHashes is negotiateVersionFor with the devices named by
+// their hashes, as frames carry them.
+func (c *Client) negotiateVersionForHashes(to [][32]byte) byte {
+	devices := to
+	if len(devices) == 0 {
+		devices = recipientHashes(c.settings.DeviceIDs())
+	}
+	if len(devices) == 0 {
+		return Version0
+	}
+
+	self := hashDeviceID(c.opts.DeviceID)
+
+	c.peerCapsMu.RLock()
+	defer c.peerCapsMu.RUnlock()
+
+	version := CurrentVersion
+	for _, device := range devices {
+		if device == self {
+			continue
+		}
+
+		if v := highestCommonVersion(c.peerCaps[device].Versions); v < version {
+			version = v
+		}
+	}
+
+	return version
+}
+
+func highestCommonVersion(versions []int) byte {
+	best := Version0
+	for _, v := range versions {
+		if v < 0 || v > 255 {
+			continue
+		}
+		if IsSupportedVersion(byte(v)) && byte(v) > best {
+			best = byte(v)
+		}
+	}
+	return best
+}
+
+// allSupport reports whether every device in to, or every device listed in
+// the settings topic if to is empty, advertised feature.
+func (c *Client) allSupport(to []string, feature string) bool {
+	ids := to
+	if len(ids) == 0 {
+		ids = c.settings.DeviceIDs()
+	}
+	if len(ids) == 0 {
+		return false
+	}
+
+	c.peerCapsMu.RLock()
+	defer c.peerCapsMu.RUnlock()
+
+	for _, id := range ids {
+		if id == c.opts.DeviceID {
+			continue
+		}
+
+		if !c.peerCaps[hashDeviceID(id)].supports(feature) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (caps Capabilities) supports(feature string) bool {
+	return slices.Contains(caps.Features, feature)
+}
+
+func (caps Capabilities) hasKey(id uint32) bool {
+	if len(caps.KeyIDs) == 0 {
+		return id == 0
+	}
+	return slices.Contains(caps.KeyIDs, id)
+}
+
+// keysChanged reports whether this device's group keys changed since they
+// were last advertised.
+func (c *Client) keysChanged() bool {
+	c.peerCapsMu.RLock()
+	defer c.peerCapsMu.RUnlock()
+	return !slices.Equal(c.keyIDs, c.groupKeys.IDs())
+}
+
+// groupKeyFor returns the ID of the group key to encrypt a frame to the
+// devices with the given hashes with, or to every device if to is empty: the
+// newest key this device has that all of them advertised, so devices that
+// did not receive a rotated key yet can still decrypt. If they have none in
+// common, e.g. once the previous key retired, it is the newest key.
+func (c *Client) groupKeyFor(to [][32]byte) uint32 {
+	devices := to
+	if len(devices) == 0 {
+		devices = recipientHashes(c.settings.DeviceIDs())
+	}
+	self := hashDeviceID(c.opts.DeviceID)
+	ids := c.groupKeys.IDs()
+
+	c.peerCapsMu.RLock()
+	defer c.peerCapsMu.RUnlock()
+
+next:
+	for i := len(ids) - 1; i >= 0; i-- {
+		for _, device := range devices {
+			if device != self && !c.peerCaps[device].hasKey(ids[i]) {
+				continue next
+			}
+		}
+		return ids[i]
+	}
+
+	return c.groupKeys.Current().ID
+}
@@ -0,0 +1,104 @@
+package mqttclient
+
+import (
+	"desktop_client/config"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// rotatedKeys is a GroupKeyring that holds group keys 0 to newest.
+type rotatedKeys struct {
+	newest uint32
+}
+
+func (k rotatedKeys) Current() config.GroupKeyEntry {
+	return config.GroupKeyEntry{ID: k.newest}
+}
+
+func (k rotatedKeys) IDs() []uint32 {
+	ids := make([]uint32, 0, k.newest+1)
+	for id := range k.newest + 1 {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (k rotatedKeys) Lookup(id uint32) (config.GroupKeyEntry, error) {
+	if id > k.newest {
+		return config.GroupKeyEntry{}, config.ErrUnknownGroupKey
+	}
+	return config.GroupKeyEntry{ID: id}, nil
+}
+
+func TestGroupKeyFor(t *testing.T) {
+	self := hashDeviceID("self")
+	a, b, unknown := hashDeviceID("a"), hashDeviceID("b"), hashDeviceID("unknown")
+
+	tests := []struct {
+		name string
+		to   [][32]byte
+		want uint32
+	}{
+		{"all have the newest key", [][32]byte{a}, 2},
+		{"one lags behind", [][32]byte{a, b}, 1},
+		{"self is not a recipient", [][32]byte{self, a}, 2},
+		{"no capabilities", [][32]byte{a, unknown}, 0},
+		{"only self", [][32]byte{self}, 2},
+	}
+
+	c := newClient(Options{DeviceID: "self", GroupKeys: rotatedKeys{newest: 2}})
+	c.peerCaps[a] = Capabilities{KeyIDs: []uint32{0, 1, 2}}
+	c.peerCaps[b] = Capabilities{KeyIDs: []uint32{1}}
+	c.peerCaps[self] = Capabilities{KeyIDs: []uint32{0}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.groupKeyFor(tt.to); got != tt.want {
+				t.Errorf("groupKeyFor = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// b only has a key this device does not, so the newest one is used
+	c.peerCaps[b] = Capabilities{KeyIDs: []uint32{3}}
+	if got := c.groupKeyFor([][32]byte{b}); got != 2 {
+		t.Errorf("groupKeyFor without a common key = %d, want 2", got)
+	}
+}
+
+func TestTopicDevice(t *testing.T) {
+	c := newClient(Options{DeviceID: "self"})
+	c.id = "account"
+
+	device := hashDeviceID("device")
+	other := hashDeviceID("other")
+	hexOf := func(h [32]byte) string { return hex.EncodeToString(h[:]) }
+
+	tests := []struct {
+		name   string
+		topic  string
+		device string
+		want   bool
+	}{
+		{"own topic", "users/account/caps/" + c.clientIDFor(device), hexOf(device), true},
+		{"upper case hex", "users/account/caps/" + c.clientIDFor(device), strings.ToUpper(hexOf(device)), true},
+		{"other device's topic", "users/account/caps/" + c.clientIDFor(other), hexOf(device), false},
+		{"other account", "users/other/caps/other-" + hexOf(device)[:16], hexOf(device), false},
+		{"full hash as topic", "users/account/caps/" + hexOf(device), hexOf(device), false},
+		{"short device", "users/account/caps/" + c.clientIDFor(device), hexOf(device)[:16], false},
+		{"not hex", "users/account/caps/" + c.clientIDFor(device), "device", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := c.topicDevice(tt.topic, tt.device)
+			if ok != tt.want {
+				t.Fatalf("topicDevice ok = %v, want %v", ok, tt.want)
+			}
+			if ok && got != device {
+				t.Errorf("topicDevice = %x, want %x", got, device)
+			}
+		})
+	}
+}
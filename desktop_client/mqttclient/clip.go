@@ -0,0 +1,105 @@
+package mqttclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Clip payloads
+//
+// A message of type ClipType carries several representations of the same
+// clipboard contents, e.g. HTML and plain text copied from a browser:
+//
+//	count uint8 | { mimeLen uint8 | mime | dataLen uint32 | data } * count
+//
+// Representations are ordered from most to least preferred. Only devices
+// that advertise FeatureClips are sent clips; everyone else gets the first
+// representation as an ordinary message.
+const ClipType = "application/x-hoppyshare-clip"
+
+// Representation is the clipboard contents in one MIME type.
+type Representation struct {
+	Type string
+	Data []byte
+}
+
+// ClipsSupported reports whether every device in to, or every device if to
+// is empty, can decode clip payloads.
+func (c *Client) ClipsSupported(to []string) bool {
+	return c.allSupport(to, FeatureClips)
+}
+
+// EncodeClip packs reps into a clip payload.
+func EncodeClip(reps []Representation) ([]byte, error) {
+	if len(reps) == 0 || len(reps) > 255 {
+		return nil, fmt.Errorf("clip must have between 1 and 255 representations, got %d", len(reps))
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(len(reps)))
+
+	for _, r := range reps {
+		if len(r.Type) > 255 {
+			return nil, errors.New("mime type too long")
+		}
+		if int64(len(r.Data)) > int64(^uint32(0)) {
+			return nil, errors.New("representation too large")
+		}
+
+		buf.WriteByte(byte(len(r.Type)))
+		buf.WriteString(r.Type)
+		binary.Write(buf, binary.BigEndian, uint32(len(r.Data)))
+		buf.Write(r.Data)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeClip unpacks a clip payload. Malformed payloads return ErrTruncated
+// or ErrBadHeader.
+func DecodeClip(payload []byte) ([]Representation, error) {
+	r := bytes.NewReader(payload)
+
+	count, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrTruncated
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("%w: empty clip", ErrBadHeader)
+	}
+
+	reps := make([]Representation, 0, count)
+	for i := 0; i < int(count); i++ {
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrTruncated
+		}
+		mime := make([]byte, n)
+		if _, err := io.ReadFull(r, mime); err != nil {
+			return nil, ErrTruncated
+		}
+
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, ErrTruncated
+		}
+		if int64(size) > int64(r.Len()) {
+			return nil, ErrTruncated
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, ErrTruncated
+		}
+
+		reps = append(reps, Representation{Type: string(mime), Data: data})
+	}
+
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: trailing data after clip", ErrBadHeader)
+	}
+
+	return reps, nil
+}
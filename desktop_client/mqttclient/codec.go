@@ -1,153 +1,473 @@
 package mqttclient
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
-	"desktop_client/config"
-	"encoding/pem"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"time"
 )
 
-type DecodedPayload struct {
+// Frame layout
+//
+// V0 (legacy, no envelope):
+//
+//	mimeLen uint8 | mime | nameLen uint8 | name | sha256(deviceID) [32] | nonce [12] | ciphertext
+//
+// V1 and later:
+//
+//	magic [3] | version uint8 | flags uint8 | mimeLen uint8 | mime | nameLen uint8 | name |
+//	sha256(deviceID) [32] | body
+//
+// V5 and later:
+//
+//	magic [3] | version uint8 | flags uint8 | mimeLen uint8 | mime | nameLen uint8 | name |
+//	sha256(deviceID) [32] | messageID [16] | sent int64 (unix ms) | body
+//
+// V6 and later:
+//
+//	... | sent int64 (unix ms) | keyID uint32 | body
+//
+// V7 and later:
+//
+//	... | keyID uint32 | recipientCount uint8 | sha256(deviceID) [32] * recipientCount | body
+//
+// Everything before the body is the frame header and is authenticated as
+// AES-GCM additional data. A V0 frame starts with the MIME length, so the
+// 0xFF magic byte would mean a 255 byte MIME type starting with "HS", which
+// no client ever sends.
+//
+// V1 and V2 bodies are a single sealed message, nonce [12] | ciphertext.
+// V2 adds the transfer flags used by large multi-part transfers (see
+// transfer.go); a V2 frame without flags is an ordinary note. V3 bodies are
+// a segmented stream (see stream.go) so neither side has to hold the whole
+// plaintext in memory. V4 adds FlagSigned and the signature trailer that
+// follows the stream (see sign.go); V4 senders always sign. V5 adds the
+// message ID and send time used for replay protection (see replay.go). V6
+// adds the ID of the group key the body is encrypted with, so the key can be
+// rotated (see config.AddGroupKey); older frames always use key 0. V7 adds
+// the recipient list of directed sends; an empty list means every device.
+//
+// A new version is only for a new frame layout. Payloads that older devices
+// cannot handle are advertised as features of the Capabilities instead (see
+// caps.go).
+const (
+	Version0 byte = 0
+	Version1 byte = 1
+	Version2 byte = 2
+	Version3 byte = 3
+	Version4 byte = 4
+	Version5 byte = 5
+	Version6 byte = 6
+	Version7 byte = 7
+
+	CurrentVersion = Version7
+)
+
+// Frame flags
+const (
+	FlagManifest byte = 1 << 0 // payload is a transfer Manifest
+	FlagPart     byte = 1 << 1 // payload is one numbered part of a transfer
+	FlagResend   byte = 1 << 2 // payload asks the sender to resend missing parts
+	FlagSigned   byte = 1 << 3 // a signature trailer follows the body
+)
+
+var frameMagic = []byte{0xFF, 'H', 'S'}
+
+// Decoding errors. Every error NewDecoder, Decoder.Read or DecodeMessage
+// return for a malformed or forged frame wraps one of these, or is ErrReplay
+// or ErrStale. A frame encrypted with a group key this device does not have
+// wraps both ErrAuth and config.ErrUnknownGroupKey.
+var (
+	ErrTruncated = errors.New("frame truncated")
+	ErrBadHeader = errors.New("malformed frame")
+	ErrAuth      = errors.New("frame failed authentication")
+)
+
+// SupportedVersions lists every frame version this client can decode.
+// It is advertised to the other devices through publishCapabilities.
+var SupportedVersions = []byte{Version0, Version1, Version2, Version3, Version4, Version5, Version6, Version7}
+
+// knownFlags maps a frame version to the flag bits it defines. A frame with
+// any other bit set is rejected rather than misread.
+var knownFlags = map[byte]byte{
+	Version1: 0,
+	Version2: FlagManifest | FlagPart | FlagResend,
+	Version3: FlagManifest | FlagPart | FlagResend,
+	Version4: FlagManifest | FlagPart | FlagResend | FlagSigned,
+	Version5: FlagManifest | FlagPart | FlagResend | FlagSigned,
+	Version6: FlagManifest | FlagPart | FlagResend | FlagSigned,
+	Version7: FlagManifest | FlagPart | FlagResend | FlagSigned,
+}
+
+// ErrDirectedUnsupported means a directed send was requested but one of the
+// recipients only understands frames without a recipient list.
+var ErrDirectedUnsupported = errors.New("recipient does not support directed messages")
+
+// Header is the authenticated, unencrypted part of a frame.
+type Header struct {
+	Version  byte
+	Flags    byte
 	Type     string
 	Filename string
 	DeviceID [32]byte
-	Payload  []byte
+
+	// V5 and later
+	MessageID [16]byte
+	Sent      time.Time
+
+	// V6 and later
+	KeyID uint32
+
+	// V7 and later. Empty for messages to every device.
+	Recipients [][32]byte
+}
+
+type DecodedPayload struct {
+	Version    byte
+	Flags      byte
+	Type       string
+	Filename   string
+	DeviceID   [32]byte
+	MessageID  [16]byte
+	Sent       time.Time
+	Recipients [][32]byte
+	Payload    []byte
+	Verified   bool // signed by the certificate issued for DeviceID
+}
+
+// EncodeMessage encodes payload from the client's device using the newest
+// frame version every known device understands.
+func (c *Client) EncodeMessage(mimeType string, filename string, payload []byte) ([]byte, error) {
+	return c.EncodeMessageTo(nil, mimeType, filename, payload)
+}
+
+// EncodeMessageTo encodes payload for the devices in to only, or for every
+// device if to is empty, using the newest frame version they all understand.
+func (c *Client) EncodeMessageTo(to []string, mimeType string, filename string, payload []byte) ([]byte, error) {
+	return c.encodeFrame(c.negotiateVersionFor(to), 0, mimeType, filename, recipientHashes(to), payload)
+}
+
+// EncodeMessageVersion encodes payload as a frame of the given version.
+func (c *Client) EncodeMessageVersion(version byte, mimeType string, filename string, payload []byte) ([]byte, error) {
+	return c.encodeFrame(version, 0, mimeType, filename, nil, payload)
+}
+
+// newHeader fills in a header for a new frame from the client's device.
+func (c *Client) newHeader(version byte, flags byte, mimeType string, filename string, to [][32]byte) (Header, error) {
+	h := Header{
+		Version:  version,
+		Flags:    flags | defaultFlags(version),
+		Type:     mimeType,
+		Filename: filename,
+		DeviceID: hashDeviceID(c.opts.DeviceID),
+	}
+
+	if version >= Version5 {
+		if _, err := rand.Read(h.MessageID[:]); err != nil {
+			return h, err
+		}
+		h.Sent = time.Now()
+	}
+
+	// Frames before V6 cannot name a key and always use key 0, which their
+	// recipients never advertise past
+	h.KeyID = c.groupKeyFor(to)
+	if version < Version6 && h.KeyID != 0 {
+		return h, fmt.Errorf("frame version %d cannot use group key %d", version, h.KeyID)
+	}
+
+	// Older frames would reach every device
+	if len(to) > 0 && version < Version7 {
+		return h, ErrDirectedUnsupported
+	}
+	h.Recipients = to
+
+	return h, nil
 }
 
-func EncodeMessage(mimeType string, filename string, deviceID string, payload []byte) ([]byte, error) {
-	groupKey, err := decryptGroupKey(config.GroupKey, config.KeyPem)
+func (c *Client) encodeFrame(version byte, flags byte, mimeType string, filename string, to [][32]byte, payload []byte) ([]byte, error) {
+	h, err := c.newHeader(version, flags, mimeType, filename, to)
 	if err != nil {
 		return nil, err
 	}
+	return c.encodeHeader(h, payload)
+}
 
+// encodeHeader encodes payload as a frame with header h.
+func (c *Client) encodeHeader(h Header, payload []byte) ([]byte, error) {
 	buf := new(bytes.Buffer)
 
-	if len(mimeType) > 255 || len(filename) > 255 {
-		return nil, errors.New("mime or filename too long")
-	}
+	if h.Version >= Version3 {
+		buf.Grow(len(payload) + len(payload)/SegmentSize*segmentOverhead + 2048)
 
-	buf.WriteByte(byte(len(mimeType)))
-	buf.WriteString(mimeType)
-
-	buf.WriteByte(byte(len(filename)))
-	buf.WriteString(filename)
+		enc, err := c.NewEncoder(buf, h)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := enc.Write(payload); err != nil {
+			enc.Close()
+			return nil, err
+		}
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
 
-	hashedID := hashDeviceID(deviceID)
-	buf.Write(hashedID[:])
+	header, err := h.marshal()
+	if err != nil {
+		return nil, err
+	}
 
-	header := buf.Bytes()
+	aead, err := c.session.aead(h.KeyID)
+	if err != nil {
+		return nil, err
+	}
 
-	nonce, ciphertext, err := encryptAESGCM(groupKey, payload, header)
+	nonce, ciphertext, err := encryptAESGCM(aead, payload, header)
 	if err != nil {
 		return nil, err
 	}
 
+	buf.Write(header)
 	buf.Write(nonce)
 	buf.Write(ciphertext)
 
 	return buf.Bytes(), nil
 }
 
-func DecodeMessage(data []byte) (*DecodedPayload, error) {
-	buf := bytes.NewReader(data)
-
-	typeLen, _ := buf.ReadByte()
-	typeBytes := make([]byte, typeLen)
-	buf.Read(typeBytes)
-
-	nameLen, _ := buf.ReadByte()
-	nameBytes := make([]byte, nameLen)
-	buf.Read(nameBytes)
-
-	var devID [32]byte
-	buf.Read(devID[:])
-
-	headerLen := 1 + len(typeBytes) + 1 + len(nameBytes) + 32
-	header := data[:headerLen]
-
-	groupKey, err := decryptGroupKey(config.GroupKey, config.KeyPem)
+// DecodeMessage decodes a whole frame received by the client's device.
+func (c *Client) DecodeMessage(data []byte) (*DecodedPayload, error) {
+	dec, err := c.NewDecoder(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 
-	nonce := make([]byte, 12)
-	buf.Read(nonce)
-
-	ciphertext, _ := io.ReadAll(buf)
-	plaintext, err := decryptAESGCM(groupKey, nonce, ciphertext, header)
+	plaintext, err := io.ReadAll(dec)
 	if err != nil {
 		return nil, err
 	}
 
 	return &DecodedPayload{
-		Type:     string(typeBytes),
-		Filename: string(nameBytes),
-		DeviceID: devID,
-		Payload:  plaintext,
+		Version:    dec.Header.Version,
+		Flags:      dec.Header.Flags,
+		Type:       dec.Header.Type,
+		Filename:   dec.Header.Filename,
+		DeviceID:   dec.Header.DeviceID,
+		MessageID:  dec.Header.MessageID,
+		Sent:       dec.Header.Sent,
+		Recipients: dec.Header.Recipients,
+		Payload:    plaintext,
+		Verified:   dec.Verified,
 	}, nil
 }
 
-func decryptGroupKey(enc []byte, privKeyPEM []byte) ([]byte, error) {
-	block, _ := pem.Decode(privKeyPEM)
-	if block == nil {
-		return nil, errors.New("failed to parse PEM block")
+// IsFor reports whether the frame is addressed to the given device, either
+// directly or because it was sent to every device.
+func (h Header) IsFor(deviceID string) bool {
+	return isAddressedTo(h.Recipients, deviceID)
+}
+
+// IsFor reports whether the message is addressed to the given device, either
+// directly or because it was sent to every device.
+func (d *DecodedPayload) IsFor(deviceID string) bool {
+	return isAddressedTo(d.Recipients, deviceID)
+}
+
+func isAddressedTo(recipients [][32]byte, deviceID string) bool {
+	if len(recipients) == 0 {
+		return true
 	}
 
-	privKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
-	if err != nil {
-		privKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-		if err != nil {
-			return nil, err
+	self := hashDeviceID(deviceID)
+	for _, r := range recipients {
+		if r == self {
+			return true
 		}
 	}
+	return false
+}
+
+func recipientHashes(to []string) [][32]byte {
+	if len(to) == 0 {
+		return nil
+	}
 
-	rsaKey, ok := privKey.(*rsa.PrivateKey)
-	if !ok {
-		return nil, errors.New("not an RSA private key")
+	hashes := make([][32]byte, len(to))
+	for i, id := range to {
+		hashes[i] = hashDeviceID(id)
 	}
+	return hashes
+}
 
-	return rsa.DecryptOAEP(sha256.New(), rand.Reader, rsaKey, enc, nil)
+// defaultFlags returns the flags every frame of the given version carries.
+func defaultFlags(version byte) byte {
+	if version >= Version4 {
+		return FlagSigned
+	}
+	return 0
 }
 
-func encryptAESGCM(key, plaintext, aad []byte) ([]byte, []byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, nil, err
+// marshal returns the header bytes exactly as they are written to the frame
+// and authenticated.
+func (h Header) marshal() ([]byte, error) {
+	if !IsSupportedVersion(h.Version) {
+		return nil, fmt.Errorf("unsupported frame version %d", h.Version)
+	}
+	if h.Flags&^knownFlags[h.Version] != 0 {
+		return nil, fmt.Errorf("flags 0x%02x not valid for frame version %d", h.Flags, h.Version)
+	}
+	if len(h.Type) > 255 || len(h.Filename) > 255 {
+		return nil, errors.New("mime or filename too long")
+	}
+	if len(h.Recipients) > 255 {
+		return nil, errors.New("too many recipients")
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, nil, err
+	buf := new(bytes.Buffer)
+
+	if h.Version > Version0 {
+		buf.Write(frameMagic)
+		buf.WriteByte(h.Version)
+		buf.WriteByte(h.Flags)
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return nil, nil, err
+	buf.WriteByte(byte(len(h.Type)))
+	buf.WriteString(h.Type)
+
+	buf.WriteByte(byte(len(h.Filename)))
+	buf.WriteString(h.Filename)
+
+	buf.Write(h.DeviceID[:])
+
+	if h.Version >= Version5 {
+		buf.Write(h.MessageID[:])
+		binary.Write(buf, binary.BigEndian, h.Sent.UnixMilli())
 	}
 
-	ciphertext := gcm.Seal(nil, nonce, plaintext, aad)
-	return nonce, ciphertext, nil
+	if h.Version >= Version6 {
+		binary.Write(buf, binary.BigEndian, h.KeyID)
+	}
+
+	if h.Version >= Version7 {
+		buf.WriteByte(byte(len(h.Recipients)))
+		for _, r := range h.Recipients {
+			buf.Write(r[:])
+		}
+	}
+
+	return buf.Bytes(), nil
 }
 
-func decryptAESGCM(key, nonce, ciphertext, aad []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+// readHeader reads a frame header from r and returns it along with its raw
+// bytes. Frames without the magic prefix are V0.
+func readHeader(r *bufio.Reader) (Header, []byte, error) {
+	var h Header
+	raw := new(bytes.Buffer)
+	tr := io.TeeReader(r, raw)
+
+	if prefix, _ := r.Peek(len(frameMagic)); bytes.Equal(prefix, frameMagic) {
+		envelope := make([]byte, len(frameMagic)+2)
+		if _, err := io.ReadFull(tr, envelope); err != nil {
+			return h, nil, ErrTruncated
+		}
+
+		h.Version = envelope[len(frameMagic)]
+		h.Flags = envelope[len(frameMagic)+1]
+
+		if h.Version == Version0 || !IsSupportedVersion(h.Version) {
+			return h, nil, fmt.Errorf("%w: unsupported frame version %d", ErrBadHeader, h.Version)
+		}
+		if h.Flags&^knownFlags[h.Version] != 0 {
+			return h, nil, fmt.Errorf("%w: unknown flags 0x%02x for frame version %d", ErrBadHeader, h.Flags, h.Version)
+		}
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
+	readString := func() (string, error) {
+		var n [1]byte
+		if _, err := io.ReadFull(tr, n[:]); err != nil {
+			return "", err
+		}
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(tr, b); err != nil {
+			return "", err
+		}
+		return string(b), nil
 	}
 
-	return gcm.Open(nil, nonce, ciphertext, aad)
+	var err error
+	if h.Type, err = readString(); err != nil {
+		return h, nil, ErrTruncated
+	}
+	if h.Filename, err = readString(); err != nil {
+		return h, nil, ErrTruncated
+	}
+	if _, err := io.ReadFull(tr, h.DeviceID[:]); err != nil {
+		return h, nil, ErrTruncated
+	}
+
+	if h.Version >= Version5 {
+		var sent [8]byte
+		if _, err := io.ReadFull(tr, h.MessageID[:]); err != nil {
+			return h, nil, ErrTruncated
+		}
+		if _, err := io.ReadFull(tr, sent[:]); err != nil {
+			return h, nil, ErrTruncated
+		}
+		h.Sent = time.UnixMilli(int64(binary.BigEndian.Uint64(sent[:])))
+	}
+
+	if h.Version >= Version6 {
+		var keyID [4]byte
+		if _, err := io.ReadFull(tr, keyID[:]); err != nil {
+			return h, nil, ErrTruncated
+		}
+		h.KeyID = binary.BigEndian.Uint32(keyID[:])
+	}
+
+	if h.Version >= Version7 {
+		var n [1]byte
+		if _, err := io.ReadFull(tr, n[:]); err != nil {
+			return h, nil, ErrTruncated
+		}
+		if n[0] > 0 {
+			h.Recipients = make([][32]byte, n[0])
+		}
+		for i := range h.Recipients {
+			if _, err := io.ReadFull(tr, h.Recipients[i][:]); err != nil {
+				return h, nil, ErrTruncated
+			}
+		}
+	}
+
+	return h, raw.Bytes(), nil
+}
+
+// IsSupportedVersion reports whether this client can encode and decode frames
+// of the given version.
+func IsSupportedVersion(version byte) bool {
+	for _, v := range SupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func encryptAESGCM(gcm cipher.AEAD, plaintext, aad []byte) ([]byte, []byte, error) {
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, plaintext, aad)
+	return nonce, ciphertext, nil
 }
 
 func hashDeviceID(id string) [32]byte {
@@ -0,0 +1,142 @@
+package mqttclient
+
+import (
+	"bytes"
+	"desktop_client/internal/testkeys"
+	"errors"
+	"testing"
+)
+
+// resetReplays forgets every received message ID, so the same frame can be
+// decoded more than once.
+func resetReplays() {
+	defaultClient().replays = newReplayCache()
+}
+
+func testFrames(tb testing.TB) [][]byte {
+	tb.Helper()
+
+	payloads := [][]byte{
+		nil,
+		[]byte("hello"),
+		bytes.Repeat([]byte{0xAB}, SegmentSize+1),
+	}
+
+	var frames [][]byte
+	for _, v := range SupportedVersions {
+		for _, p := range payloads {
+			frame, err := EncodeMessageVersion(v, "text/plain", "note.txt", p)
+			if err != nil {
+				tb.Fatalf("encode v%d: %v", v, err)
+			}
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+// isTypedError reports whether err is one of the errors a malformed or
+// forged frame is allowed to produce.
+func isTypedError(err error) bool {
+	for _, target := range []error{ErrTruncated, ErrBadHeader, ErrAuth, ErrReplay, ErrStale} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	testkeys.Install(t)
+
+	frame, err := EncodeMessageVersion(CurrentVersion, "text/plain", "note.txt", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badVersion := append([]byte(nil), frame...)
+	badVersion[len(frameMagic)] = 0xEE
+
+	badFlags := append([]byte(nil), frame...)
+	badFlags[len(frameMagic)+1] = 0x80
+
+	// inside the MIME type, which is authenticated but not encrypted
+	flipped := append([]byte(nil), frame...)
+	flipped[len(frameMagic)+4] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrTruncated},
+		{"magic only", frameMagic, ErrTruncated},
+		{"header cut", frame[:len(frameMagic)+8], ErrTruncated},
+		{"body cut", frame[:len(frame)-40], ErrTruncated},
+		{"unknown version", badVersion, ErrBadHeader},
+		{"unknown flags", badFlags, ErrBadHeader},
+		{"flipped byte", flipped, ErrAuth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetReplays()
+			if _, err := DecodeMessage(tt.data); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	testkeys.Install(f)
+
+	for _, frame := range testFrames(f) {
+		f.Add(frame)
+		f.Add(frame[:len(frame)/2])
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resetReplays()
+
+		decoded, err := DecodeMessage(data)
+		if err != nil {
+			if !isTypedError(err) {
+				t.Fatalf("untyped error %T: %v", err, err)
+			}
+			return
+		}
+
+		if decoded.Flags&^knownFlags[decoded.Version] != 0 {
+			t.Fatalf("accepted unknown flags 0x%02x for v%d", decoded.Flags, decoded.Version)
+		}
+	})
+}
+
+func FuzzDecodeClip(f *testing.F) {
+	clip, err := EncodeClip([]Representation{
+		{Type: "text/html", Data: []byte("<b>hoppy</b>")},
+		{Type: "text/plain", Data: []byte("hoppy")},
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(clip)
+	f.Add(clip[:len(clip)-1])
+	f.Add([]byte{0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reps, err := DecodeClip(data)
+		if err != nil {
+			if !isTypedError(err) {
+				t.Fatalf("untyped error %T: %v", err, err)
+			}
+			return
+		}
+
+		again, err := EncodeClip(reps)
+		if err != nil || !bytes.Equal(again, data) {
+			t.Fatalf("clip does not round trip: %v", err)
+		}
+	})
+}
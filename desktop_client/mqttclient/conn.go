@@ -0,0 +1,426 @@
+package mqttclient
+
+import (
+	"context"
+	"crypto/tls"
+	"desktop_client/config"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT v5 and v3.1.1
+//
+// Brokers are spoken to over MQTT v5 where they support it: publishes carry
+// a message expiry and user properties, and a PUBACK with a failure reason
+// code (e.g. the watchdog revoking write access) becomes a PublishError
+// instead of a silent success. A broker that refuses the v5 CONNECT is
+// retried over v3.1.1 on the same connection attempt, and remembered as
+// v3-only until the client restarts. A broker's "protocol" setting can pin
+// either version.
+//
+// Both keep the session on the broker for offlineTTL, see offline.go. A
+// resumed session delivers queued notes right after the CONNACK, before
+// subscribe has registered any handlers, so those are held in earlyMessages
+// until the handler for their topic arrives.
+
+// conn is a connection to one broker, over either protocol version.
+type conn interface {
+	IsConnected() bool
+	Publish(topic string, payload []byte, opts publishOptions) error
+	Subscribe(topic string, handler func(message)) error
+	Disconnect()
+	Protocol() string
+}
+
+type message struct {
+	Topic   string
+	Payload []byte
+}
+
+// earlyMessages holds messages that arrived before a handler for their topic.
+type earlyMessages struct {
+	mu   sync.Mutex
+	msgs []message
+}
+
+// maxEarlyMessages bounds how many messages wait for a handler. The broker
+// keeps far fewer than this per session by default.
+const maxEarlyMessages = 1000
+
+func (e *earlyMessages) add(m message) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.msgs) >= maxEarlyMessages {
+		log.Printf("[BROKER] Dropping early message on %s, nothing subscribed yet", m.Topic)
+		return
+	}
+	e.msgs = append(e.msgs, m)
+}
+
+// take removes and returns the messages matching filter, oldest first.
+func (e *earlyMessages) take(filter string) []message {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var taken []message
+	kept := e.msgs[:0]
+	for _, m := range e.msgs {
+		if topicMatches(filter, m.Topic) {
+			taken = append(taken, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	e.msgs = kept
+	return taken
+}
+
+type publishOptions struct {
+	Retain  bool
+	Timeout time.Duration
+
+	// v5 only, dropped over v3.1.1
+	Expiry         time.Duration // zero never expires
+	UserProperties map[string]string
+}
+
+// ErrPublishRejected is wrapped by every PublishError.
+var ErrPublishRejected = errors.New("broker rejected publish")
+
+// errPublishTimeout means the broker did not acknowledge a publish in time.
+var errPublishTimeout = errors.New("publish timed out")
+
+// PublishError is a PUBACK with a failure reason code. Only v5 brokers send
+// them; over v3.1.1 a refused publish is indistinguishable from success.
+type PublishError struct {
+	Code   byte
+	Reason string
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("broker rejected publish: %s (0x%02x)", e.Reason, e.Code)
+}
+
+func (e *PublishError) Unwrap() error {
+	return ErrPublishRejected
+}
+
+// reasonNames are the PUBACK failure reason codes of MQTT v5 (3.4.2.1).
+var reasonNames = map[byte]string{
+	0x80: "unspecified error",
+	0x83: "implementation specific error",
+	0x87: "not authorized",
+	0x90: "topic name invalid",
+	0x91: "packet identifier in use",
+	0x97: "quota exceeded",
+	0x99: "payload format invalid",
+}
+
+func newPublishError(code byte, reason string) *PublishError {
+	if reason == "" {
+		reason = reasonNames[code]
+	}
+	if reason == "" {
+		reason = "unknown reason"
+	}
+	return &PublishError{Code: code, Reason: reason}
+}
+
+// errV5Handshake wraps failures after the transport was up, when falling
+// back to v3.1.1 may help.
+var errV5Handshake = errors.New("MQTT v5 handshake failed")
+
+// connectBroker connects to broker i of the pool over v5, falling back to
+// v3.1.1. lost receives the error when an established connection drops.
+func connectBroker(pool *brokerPool, i int, base *tls.Config, s brokerSession, lost chan error) (conn, error) {
+	b := pool.brokers[i]
+	tlsConfig := brokerTLSConfig(base, b)
+
+	if b.Protocol != "v3" && !pool.v3Only(i) {
+		c, err := connectV5(b, tlsConfig, s, lost)
+		if err == nil || b.Protocol == "v5" || !errors.Is(err, errV5Handshake) {
+			return c, err
+		}
+
+		c3, err3 := connectV3(b, tlsConfig, s, lost)
+		if err3 != nil {
+			return nil, err
+		}
+		log.Printf("[BROKER] %s does not speak MQTT v5, using v3.1.1: %v", b.URL, err)
+		pool.setV3Only(i)
+		return c3, nil
+	}
+
+	return connectV3(b, tlsConfig, s, lost)
+}
+
+// v5Conn is a connection over MQTT v5.
+type v5Conn struct {
+	client    *paho.Client
+	connected atomic.Bool
+	lost      chan error
+
+	mu       sync.Mutex
+	handlers map[string]func(message)
+	early    earlyMessages
+}
+
+func connectV5(b config.Broker, tlsConfig *tls.Config, s brokerSession, lost chan error) (*v5Conn, error) {
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return nil, err
+	}
+	proxyURL, err := brokerProxy(b)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+
+	var netConn net.Conn
+	if u.Scheme == "wss" {
+		ws := &mqtt.WebsocketOptions{
+			Proxy: func(*http.Request) (*url.URL, error) { return proxyURL, nil },
+		}
+		netConn, err = mqtt.NewWebsocket(u.String(), tlsConfig, dialTimeout, nil, ws)
+	} else {
+		netConn, err = dialBrokerTLS(brokerAddr(u), tlsConfig, proxyURL, dialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &v5Conn{lost: lost, handlers: make(map[string]func(message))}
+	c.client = paho.NewClient(paho.ClientConfig{
+		Conn:              packets.NewThreadSafeConn(netConn),
+		PacketTimeout:     30 * time.Second, // publishOptions.Timeout is the real limit
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){c.route},
+		OnClientError:     c.connectionLost,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			reason := fmt.Sprintf("reason code 0x%02x", d.ReasonCode)
+			if d.Properties != nil && d.Properties.ReasonString != "" {
+				reason = d.Properties.ReasonString
+			}
+			c.connectionLost(fmt.Errorf("broker disconnected: %s", reason))
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	expiry := uint32(s.TTL / time.Second)
+
+	if _, err := c.client.Connect(ctx, &paho.Connect{
+		ClientID:    s.ClientID,
+		KeepAlive:   60,
+		CleanStart:  s.TTL == 0,
+		Properties:  &paho.ConnectProperties{SessionExpiryInterval: &expiry},
+		WillMessage: &paho.WillMessage{Retain: true, QoS: 1, Topic: s.WillTopic, Payload: s.WillPayload},
+	}); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("%w: %v", errV5Handshake, err)
+	}
+
+	c.connected.Store(true)
+	return c, nil
+}
+
+func (c *v5Conn) connectionLost(err error) {
+	if !c.connected.Swap(false) {
+		return
+	}
+	select {
+	case c.lost <- err:
+	default:
+	}
+}
+
+func (c *v5Conn) route(pr paho.PublishReceived) (bool, error) {
+	c.mu.Lock()
+	var handler func(message)
+	for filter, h := range c.handlers {
+		if topicMatches(filter, pr.Packet.Topic) {
+			handler = h
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if handler == nil {
+		c.early.add(message{Topic: pr.Packet.Topic, Payload: pr.Packet.Payload})
+		return true, nil
+	}
+	handler(message{Topic: pr.Packet.Topic, Payload: pr.Packet.Payload})
+	return true, nil
+}
+
+func (c *v5Conn) IsConnected() bool { return c.connected.Load() }
+
+func (c *v5Conn) Protocol() string { return "v5" }
+
+func (c *v5Conn) Publish(topic string, payload []byte, opts publishOptions) error {
+	p := &paho.Publish{
+		QoS:        1,
+		Retain:     opts.Retain,
+		Topic:      topic,
+		Payload:    payload,
+		Properties: &paho.PublishProperties{},
+	}
+	if opts.Expiry > 0 {
+		expiry := uint32(opts.Expiry / time.Second)
+		p.Properties.MessageExpiry = &expiry
+	}
+	for k, v := range opts.UserProperties {
+		p.Properties.User.Add(k, v)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	resp, err := c.client.Publish(ctx, p)
+	if resp != nil && resp.ReasonCode >= 0x80 {
+		var reason string
+		if resp.Properties != nil {
+			reason = resp.Properties.ReasonString
+		}
+		return newPublishError(resp.ReasonCode, reason)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errPublishTimeout
+	}
+	return err
+}
+
+func (c *v5Conn) Subscribe(topic string, handler func(message)) error {
+	c.mu.Lock()
+	c.handlers[topic] = handler
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	_, err := c.client.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: 1}},
+	})
+
+	for _, m := range c.early.take(topic) {
+		handler(m)
+	}
+	return err
+}
+
+func (c *v5Conn) Disconnect() {
+	if c.connected.Swap(false) {
+		c.client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+}
+
+// topicMatches reports whether topic matches a subscription filter with
+// + and # wildcards.
+func topicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// v3Conn is a connection over MQTT v3.1.1.
+type v3Conn struct {
+	client mqtt.Client
+	early  earlyMessages
+}
+
+func connectV3(b config.Broker, tlsConfig *tls.Config, s brokerSession, lost chan error) (*v3Conn, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(b.URL)
+	opts.SetCustomOpenConnectionFn(openBrokerConn(b))
+	opts.SetClientID(s.ClientID)
+	opts.SetTLSConfig(tlsConfig)
+	opts.SetKeepAlive(60 * time.Second)
+	// reconnects go through connectLoop, which may pick another broker
+	opts.SetAutoReconnect(false)
+	opts.SetCleanSession(s.TTL == 0)
+	opts.SetBinaryWill(s.WillTopic, s.WillPayload, 1, true)
+
+	conn := &v3Conn{}
+
+	// a resumed session's messages have no subscription handler yet
+	opts.SetDefaultPublishHandler(func(_ mqtt.Client, m mqtt.Message) {
+		conn.early.add(message{Topic: m.Topic(), Payload: m.Payload()})
+	})
+
+	opts.OnConnectionLost = func(c mqtt.Client, err error) {
+		select {
+		case lost <- err:
+		default:
+		}
+	}
+
+	conn.client = mqtt.NewClient(opts)
+
+	token := conn.client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (c *v3Conn) IsConnected() bool { return c.client.IsConnected() }
+
+func (c *v3Conn) Protocol() string { return "v3.1.1" }
+
+func (c *v3Conn) Publish(topic string, payload []byte, opts publishOptions) error {
+	token := c.client.Publish(topic, 1, opts.Retain, payload)
+	if !token.WaitTimeout(opts.Timeout) {
+		return errPublishTimeout
+	}
+	return token.Error()
+}
+
+func (c *v3Conn) Subscribe(topic string, handler func(message)) error {
+	token := c.client.Subscribe(topic, 1, func(_ mqtt.Client, m mqtt.Message) {
+		handler(message{Topic: m.Topic(), Payload: m.Payload()})
+	})
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return err
+	}
+
+	// v3.1.1 brokers refuse a subscription with 0x80 in the SUBACK, which
+	// paho does not report as an error
+	if st, ok := token.(*mqtt.SubscribeToken); ok {
+		if qos, ok := st.Result()[topic]; ok && qos == 0x80 {
+			return fmt.Errorf("broker refused subscription to %s", topic)
+		}
+	}
+
+	for _, m := range c.early.take(topic) {
+		handler(m)
+	}
+	return nil
+}
+
+func (c *v3Conn) Disconnect() {
+	c.client.Disconnect(250)
+}
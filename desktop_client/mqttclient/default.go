@@ -0,0 +1,297 @@
+package mqttclient
+
+import (
+	"bytes"
+	"desktop_client/config"
+	"desktop_client/systrayhelpers"
+	"io"
+	"log"
+	"sync"
+)
+
+// The package-level functions below drive one Client built from the config
+// package, as main did before there was a Client type. It is created on
+// first use, so BLE, the history and the outbox work before Connect.
+
+var (
+	stdMu sync.Mutex
+	std   *Client
+
+	callbacksMu sync.Mutex
+	onMessage   func()
+	onSettings  func()
+)
+
+func init() {
+	config.OnKeysCleared(CloseSession)
+}
+
+// defaultClient returns the Client of the device in the config package.
+func defaultClient() *Client {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+
+	if std == nil {
+		std = newClient(Options{
+			CertPEM:  config.CertPem,
+			KeyPEM:   config.KeyPem,
+			CAPEM:    config.CAPem,
+			DeviceID: config.DeviceID,
+			OnMessage: func() {
+				callbacksMu.Lock()
+				cb := onMessage
+				callbacksMu.Unlock()
+
+				if cb != nil {
+					cb()
+				}
+			},
+			OnSettings: func() {
+				callbacksMu.Lock()
+				cb := onSettings
+				callbacksMu.Unlock()
+
+				if cb != nil {
+					cb()
+				}
+			},
+			OnStatus: systrayhelpers.SetTooltip,
+		})
+	}
+	return std
+}
+
+// Connect connects the default client to the brokers of the config package
+// and returns the account ID. Calling it again reconnects.
+func Connect() (string, error) {
+	brokers, err := config.BrokerList()
+	if err != nil {
+		log.Printf("Ignoring %s: %v", config.BrokersFile, err)
+	}
+
+	c := defaultClient()
+	c.setBrokers(brokers)
+	if err := c.Connect(); err != nil {
+		return "", err
+	}
+	return c.ID(), nil
+}
+
+// Disconnect disconnects the default client.
+func Disconnect() {
+	defaultClient().Disconnect()
+}
+
+// CloseSession zeroes and forgets every key the default client cached. It
+// runs when config clears its keys.
+func CloseSession() {
+	stdMu.Lock()
+	c := std
+	stdMu.Unlock()
+
+	if c != nil {
+		c.CloseSession()
+	}
+}
+
+// SetOnMessageCallback sets cb to run after a note was added to the
+// history.
+func SetOnMessageCallback(cb func()) {
+	callbacksMu.Lock()
+	defer callbacksMu.Unlock()
+	onMessage = cb
+}
+
+// SetOnSettingsCallback sets cb to run after every update on the settings
+// topic, e.g. to refresh the device list.
+func SetOnSettingsCallback(cb func()) {
+	callbacksMu.Lock()
+	defer callbacksMu.Unlock()
+	onSettings = cb
+}
+
+// Publish sends data to the devices in to, or to every device if to is empty.
+func Publish(topic string, to []string, data []byte, contentType, filename string) error {
+	return PublishReader(topic, to, bytes.NewReader(data), contentType, filename)
+}
+
+// PublishReader is Client.PublishReader on the default client, publishing to
+// topic. Before Connect, the note is queued in the outbox.
+func PublishReader(topic string, to []string, r io.Reader, contentType, filename string) error {
+	c := defaultClient()
+	if !c.IsConnected() {
+		return c.queueOffline(topic, to, r, contentType, filename)
+	}
+
+	return c.sendNote(topic, to, r, contentType, filename)
+}
+
+// PublishTransfer is Client.PublishTransfer on the default client,
+// publishing to topic.
+func PublishTransfer(topic string, to []string, path, contentType, filename string) error {
+	return defaultClient().publishTransfer(topic, to, path, contentType, filename, false)
+}
+
+// PublishTransferData is Client.PublishTransferData on the default client,
+// publishing to topic.
+func PublishTransferData(topic string, to []string, data []byte, contentType, filename string) error {
+	return defaultClient().publishTransferData(topic, to, data, contentType, filename)
+}
+
+// PublishPresence announces this device as online on the default client.
+func PublishPresence() {
+	defaultClient().PublishPresence()
+}
+
+// FlushOutbox sends queued items over the default client.
+func FlushOutbox() {
+	defaultClient().FlushOutbox()
+}
+
+// Ping asks the device with the given ID to identify itself, over the
+// default client.
+func Ping(deviceID string) error {
+	return defaultClient().Ping(deviceID)
+}
+
+// ReportReceived is Client.ReportReceived on the default client.
+func ReportReceived(id string, status ReceiptStatus) {
+	defaultClient().ReportReceived(id, status)
+}
+
+// EncodeMessage is Client.EncodeMessage on the default client.
+func EncodeMessage(mimeType string, filename string, payload []byte) ([]byte, error) {
+	return defaultClient().EncodeMessage(mimeType, filename, payload)
+}
+
+// EncodeMessageTo is Client.EncodeMessageTo on the default client.
+func EncodeMessageTo(to []string, mimeType string, filename string, payload []byte) ([]byte, error) {
+	return defaultClient().EncodeMessageTo(to, mimeType, filename, payload)
+}
+
+// EncodeMessageVersion is Client.EncodeMessageVersion on the default client.
+func EncodeMessageVersion(version byte, mimeType string, filename string, payload []byte) ([]byte, error) {
+	return defaultClient().EncodeMessageVersion(version, mimeType, filename, payload)
+}
+
+// DecodeMessage is Client.DecodeMessage on the default client.
+func DecodeMessage(data []byte) (*DecodedPayload, error) {
+	return defaultClient().DecodeMessage(data)
+}
+
+// NewEncoder is Client.NewEncoder on the default client.
+func NewEncoder(w io.Writer, h Header) (*Encoder, error) {
+	return defaultClient().NewEncoder(w, h)
+}
+
+// NewDecoder is Client.NewDecoder on the default client.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	return defaultClient().NewDecoder(r)
+}
+
+// NegotiateVersion is Client.NegotiateVersion on the default client.
+func NegotiateVersion() byte {
+	return defaultClient().NegotiateVersion()
+}
+
+// ClipsSupported is Client.ClipsSupported on the default client.
+func ClipsSupported(to []string) bool {
+	return defaultClient().ClipsSupported(to)
+}
+
+// AcceptSender reports whether a message with the given verification state
+// should be shown, according to the RequireSigned setting.
+func AcceptSender(verified bool) bool {
+	return defaultClient().acceptSender(verified)
+}
+
+// AcceptNote is Client.AcceptNote on the default client.
+func AcceptNote(d *DecodedPayload) bool {
+	return defaultClient().AcceptNote(d)
+}
+
+// History returns the items the default client received, newest first.
+func History() []HistoryItem {
+	return defaultClient().History()
+}
+
+// LatestHistory is Client.LatestHistory on the default client.
+func LatestHistory() (HistoryItem, bool) {
+	return defaultClient().LatestHistory()
+}
+
+// OnHistoryChange is Client.OnHistoryChange on the default client.
+func OnHistoryChange(fn func()) {
+	defaultClient().OnHistoryChange(fn)
+}
+
+// OpenHistory is Client.OpenHistory on the default client.
+func OpenHistory(id string) (io.ReadCloser, HistoryItem, error) {
+	return defaultClient().OpenHistory(id)
+}
+
+// ReadHistory is Client.ReadHistory on the default client.
+func ReadHistory(id string) ([]byte, HistoryItem, error) {
+	return defaultClient().ReadHistory(id)
+}
+
+// RemoveHistory is Client.RemoveHistory on the default client.
+func RemoveHistory(id string) {
+	defaultClient().RemoveHistory(id)
+}
+
+// ClearHistory is Client.ClearHistory on the default client.
+func ClearHistory() {
+	defaultClient().ClearHistory()
+}
+
+// SaveReceived adds a note received over BLE to the default client's
+// history.
+func SaveReceived(d *DecodedPayload) error {
+	return defaultClient().SaveReceived(d)
+}
+
+// Outbox returns the items the default client has queued, oldest first.
+func Outbox() []OutboxItem {
+	return defaultClient().Outbox()
+}
+
+// CancelOutbox is Client.CancelOutbox on the default client.
+func CancelOutbox(id string) {
+	defaultClient().CancelOutbox(id)
+}
+
+// OnOutboxChange is Client.OnOutboxChange on the default client.
+func OnOutboxChange(fn func()) {
+	defaultClient().OnOutboxChange(fn)
+}
+
+// SentNotes returns the last notes the default client sent, newest first.
+func SentNotes() []SentNote {
+	return defaultClient().SentNotes()
+}
+
+// OnReceiptsChange is Client.OnReceiptsChange on the default client.
+func OnReceiptsChange(fn func()) {
+	defaultClient().OnReceiptsChange(fn)
+}
+
+// SetTransport is Client.SetTransport on the default client.
+func SetTransport(t string) {
+	defaultClient().SetTransport(t)
+}
+
+// PeerPresence is Client.PeerPresence on the default client.
+func PeerPresence(deviceID string) (Presence, bool) {
+	return defaultClient().PeerPresence(deviceID)
+}
+
+// OnPresenceChange is Client.OnPresenceChange on the default client.
+func OnPresenceChange(fn func()) {
+	defaultClient().OnPresenceChange(fn)
+}
+
+// OnPing is Client.OnPing on the default client.
+func OnPing(fn func(from string)) {
+	defaultClient().OnPing(fn)
+}
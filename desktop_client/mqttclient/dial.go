@@ -0,0 +1,187 @@
+package mqttclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"desktop_client/config"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// Dialing
+//
+// Locked-down networks often allow nothing out but HTTPS, so brokers can be
+// wss:// URLs on 443 and every connection can go through a proxy. paho only
+// looks at all_proxy for tls:// brokers, so the client dials brokers itself:
+// a broker's own proxy setting wins, then HTTPS_PROXY, then ALL_PROXY, and
+// NO_PROXY applies to both environment proxies.
+
+const dialTimeout = 30 * time.Second
+
+// brokerProxy returns the proxy to reach the broker through, or nil.
+func brokerProxy(b config.Broker) (*url.URL, error) {
+	switch b.Proxy {
+	case "direct":
+		return nil, nil
+	case "":
+	default:
+		return url.Parse(b.Proxy)
+	}
+
+	u, err := url.Parse(b.URL)
+	if err != nil {
+		return nil, err
+	}
+	target := &url.URL{Scheme: "https", Host: brokerAddr(u)}
+
+	env := httpproxy.FromEnvironment()
+	if p, err := env.ProxyFunc()(target); p != nil || err != nil {
+		return p, err
+	}
+
+	allProxy := os.Getenv("ALL_PROXY")
+	if allProxy == "" {
+		allProxy = os.Getenv("all_proxy")
+	}
+	if allProxy == "" {
+		return nil, nil
+	}
+	all := &httpproxy.Config{HTTPSProxy: allProxy, NoProxy: env.NoProxy}
+	return all.ProxyFunc()(target)
+}
+
+// brokerAddr returns host:port of a broker URL, with the default port for
+// its scheme.
+func brokerAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "wss" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "8883")
+}
+
+// openBrokerConn is paho's OpenConnectionFunc for broker b.
+func openBrokerConn(b config.Broker) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, opts mqtt.ClientOptions) (net.Conn, error) {
+		proxyURL, err := brokerProxy(b)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+
+		if uri.Scheme == "wss" {
+			ws := &mqtt.WebsocketOptions{
+				Proxy: func(*http.Request) (*url.URL, error) { return proxyURL, nil },
+			}
+			return mqtt.NewWebsocket(uri.String(), opts.TLSConfig, opts.ConnectTimeout, opts.HTTPHeaders, ws)
+		}
+
+		return dialBrokerTLS(brokerAddr(uri), opts.TLSConfig, proxyURL, opts.ConnectTimeout)
+	}
+}
+
+// dialBrokerTLS opens a TLS connection to addr, through proxyURL if set.
+func dialBrokerTLS(addr string, tlsConfig *tls.Config, proxyURL *url.URL, timeout time.Duration) (net.Conn, error) {
+	if timeout == 0 {
+		timeout = dialTimeout
+	}
+
+	conn, err := dialTCP(addr, proxyURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func dialTCP(addr string, proxyURL *url.URL, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if proxyURL == nil {
+		return dialer.Dial("tcp", addr)
+	}
+
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return d.Dial("tcp", addr)
+	case "http", "https":
+		return dialConnect(dialer, proxyURL, addr, timeout)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request.
+func dialConnect(dialer *net.Dialer, proxyURL *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	port := proxyURL.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[proxyURL.Scheme]
+	}
+
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(proxyURL.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		pass, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy sent data before the tunnel was established")
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,420 @@
+package mqttclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"desktop_client/config"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Received history
+//
+// Every note received over MQTT or BLE is kept in a local history, so a burst
+// of notes no longer overwrites the one before. Each item is sealed with the
+// local storage key (see config.NewLocalWriter) into the history dir of the
+// spool, next to a sealed index of their metadata, so the history survives
+// restarts and is unreadable once the client is uninstalled.
+//
+// The history keeps the newest settings.HistorySize items, at most
+// MaxHistorySize. With a size of 0 only the newest item is kept, and main
+// clears it once settings.CacheTime runs out, as before there was a history.
+const MaxHistorySize = 50
+
+// Where a received item came from.
+const (
+	SourceMQTT = "mqtt"
+	SourceBLE  = "ble"
+)
+
+// HistoryItem is one received note.
+type HistoryItem struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Sender      string    `json:"sender"` // device ID, or the hex device hash if it is not in settings
+	Source      string    `json:"source"` // SourceMQTT or SourceBLE
+	Received    time.Time `json:"received"`
+	Verified    bool      `json:"verified"` // signed by the sending device, see sign.go
+}
+
+type historyEntry struct {
+	HistoryItem
+
+	// for receipts, see receipts.go
+	SenderHash [32]byte `json:"sender_hash"`
+	Version    byte     `json:"version"`
+	MessageID  [16]byte `json:"message_id"`
+}
+
+var historyIndexAAD = []byte("history/index")
+
+// historyAAD binds a sealed history file to its item ID.
+func historyAAD(id string) []byte {
+	return []byte("history/" + id)
+}
+
+// historySize is the number of items to keep, never less than one.
+func (c *Client) historySize() int {
+	return min(max(c.settings.Get().HistorySize, 1), MaxHistorySize)
+}
+
+// History returns the received items, newest first.
+func (c *Client) History() []HistoryItem {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	if err := c.loadHistoryLocked(); err != nil {
+		log.Printf("[HISTORY] Could not load history: %v", err)
+	}
+
+	items := make([]HistoryItem, len(c.history))
+	for i, e := range c.history {
+		items[len(items)-1-i] = e.HistoryItem
+	}
+	return items
+}
+
+// LatestHistory returns the newest received item.
+func (c *Client) LatestHistory() (HistoryItem, bool) {
+	items := c.History()
+	if len(items) == 0 {
+		return HistoryItem{}, false
+	}
+	return items[0], true
+}
+
+// OnHistoryChange registers fn to run after an item is added to or removed
+// from the history.
+func (c *Client) OnHistoryChange(fn func()) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	c.onHistoryFns = append(c.onHistoryFns, fn)
+}
+
+func (c *Client) historyChanged() {
+	c.historyMu.Lock()
+	fns := append([]func(){}, c.onHistoryFns...)
+	c.historyMu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// OpenHistory opens the item with the given ID. Reads fail with
+// config.ErrCorruptStorage if the file was altered, so nothing read may be
+// acted on before io.EOF.
+func (c *Client) OpenHistory(id string) (io.ReadCloser, HistoryItem, error) {
+	item, ok := c.historyItem(id)
+	if !ok {
+		return nil, HistoryItem{}, os.ErrNotExist
+	}
+
+	dir, err := c.spoolDir("history")
+	if err != nil {
+		return nil, HistoryItem{}, err
+	}
+
+	f, err := os.Open(filepath.Join(dir, id))
+	if err != nil {
+		return nil, HistoryItem{}, err
+	}
+
+	r, err := config.NewLocalReader(f, historyAAD(id))
+	if err != nil {
+		f.Close()
+		return nil, HistoryItem{}, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, item.HistoryItem, nil
+}
+
+// ReadHistory reads the item with the given ID into memory. Items larger than
+// MaxMessageSize are only available through OpenHistory.
+func (c *Client) ReadHistory(id string) ([]byte, HistoryItem, error) {
+	rc, item, err := c.OpenHistory(id)
+	if err != nil {
+		return nil, HistoryItem{}, err
+	}
+	defer rc.Close()
+
+	if item.Size > MaxMessageSize {
+		return nil, HistoryItem{}, errors.New("item too large to read into memory")
+	}
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, HistoryItem{}, err
+	}
+	return data, item, nil
+}
+
+// RemoveHistory deletes the item with the given ID.
+func (c *Client) RemoveHistory(id string) {
+	c.historyMu.Lock()
+	if err := c.loadHistoryLocked(); err != nil {
+		c.historyMu.Unlock()
+		log.Printf("[HISTORY] Could not load history: %v", err)
+		return
+	}
+	removed := false
+	for i, e := range c.history {
+		if e.ID == id {
+			c.history = append(c.history[:i], c.history[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	if removed {
+		c.saveHistoryLocked()
+	}
+	c.historyMu.Unlock()
+
+	if removed {
+		c.removeHistoryFile(id)
+		c.historyChanged()
+	}
+}
+
+// ClearHistory deletes every received item.
+func (c *Client) ClearHistory() {
+	c.historyMu.Lock()
+	if err := c.loadHistoryLocked(); err != nil {
+		c.historyMu.Unlock()
+		log.Printf("[HISTORY] Could not load history: %v", err)
+		return
+	}
+	old := c.history
+	c.history = nil
+	if len(old) > 0 {
+		c.saveHistoryLocked()
+	}
+	c.historyMu.Unlock()
+
+	for _, e := range old {
+		c.removeHistoryFile(e.ID)
+	}
+	if len(old) > 0 {
+		c.historyChanged()
+	}
+}
+
+// SaveReceived adds a note received over BLE to the history.
+func (c *Client) SaveReceived(d *DecodedPayload) error {
+	id, size, err := c.sealHistory(bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+
+	c.addHistory(historyEntry{
+		HistoryItem: HistoryItem{
+			ID:          id,
+			Filename:    d.Filename,
+			ContentType: d.Type,
+			Size:        size,
+			Source:      SourceBLE,
+			Verified:    d.Verified,
+		},
+		SenderHash: d.DeviceID,
+		Version:    d.Version,
+		MessageID:  d.MessageID,
+	})
+	return nil
+}
+
+// sealHistory writes everything read from r to a new sealed history file and
+// returns its ID and plaintext size. The item is not part of the history
+// until it is passed to addHistory; callers that drop it must call
+// removeHistoryFile.
+func (c *Client) sealHistory(r io.Reader) (string, int64, error) {
+	// loading cleans up files missing from the index, which must not
+	// include this one
+	c.historyMu.Lock()
+	err := c.loadHistoryLocked()
+	c.historyMu.Unlock()
+	if err != nil {
+		return "", 0, err
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", 0, err
+	}
+	id := hex.EncodeToString(raw)
+
+	dir, err := c.spoolDir("history")
+	if err != nil {
+		return "", 0, err
+	}
+
+	path := filepath.Join(dir, id)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var size int64
+	w, err := config.NewLocalWriter(f, historyAAD(id))
+	if err == nil {
+		size, err = io.Copy(w, r)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", 0, err
+	}
+
+	return id, size, nil
+}
+
+func (c *Client) removeHistoryFile(id string) {
+	dir, err := c.spoolDir("history")
+	if err != nil {
+		return
+	}
+	if err := os.Remove(filepath.Join(dir, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("[HISTORY] Failed to remove %s: %v", id, err)
+	}
+}
+
+// addHistory adds a sealed item to the history and drops the oldest items
+// beyond the history size.
+func (c *Client) addHistory(e historyEntry) {
+	e.Sender = c.deviceName(e.SenderHash)
+	e.Received = time.Now()
+
+	c.historyMu.Lock()
+	c.history = append(c.history, e)
+
+	var dropped []historyEntry
+	if n := len(c.history) - c.historySize(); n > 0 {
+		dropped = append(dropped, c.history[:n]...)
+		c.history = append([]historyEntry(nil), c.history[n:]...)
+	}
+	c.saveHistoryLocked()
+	c.historyMu.Unlock()
+
+	for _, d := range dropped {
+		c.removeHistoryFile(d.ID)
+	}
+
+	log.Printf("[HISTORY] Added %s from %s, %d bytes", e.Filename, e.Source, e.Size)
+	c.historyChanged()
+}
+
+// historyItem returns the entry with the given ID.
+func (c *Client) historyItem(id string) (historyEntry, bool) {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+
+	if err := c.loadHistoryLocked(); err != nil {
+		log.Printf("[HISTORY] Could not load history: %v", err)
+	}
+
+	for _, e := range c.history {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return historyEntry{}, false
+}
+
+// loadHistoryLocked reads the index once, and removes files it does not list,
+// e.g. after a crash between sealHistory and addHistory. An index that does
+// not open, e.g. after the storage key was lost, drops the whole history.
+// Callers must hold c.historyMu.
+func (c *Client) loadHistoryLocked() error {
+	if c.historyLoaded {
+		return nil
+	}
+
+	dir, err := c.spoolDir("history")
+	if err != nil {
+		return err
+	}
+
+	var entries []historyEntry
+	sealed, err := os.ReadFile(filepath.Join(dir, "index"))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		data, err := config.OpenLocal(sealed, historyIndexAAD)
+		if errors.Is(err, config.ErrCorruptStorage) {
+			log.Printf("[HISTORY] Dropping unreadable history")
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &entries); err != nil {
+			log.Printf("[HISTORY] Dropping unreadable history: %v", err)
+			entries = nil
+		}
+	}
+
+	listed := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		listed[e.ID] = true
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Name() != "index" && !listed[f.Name()] {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+
+	c.history = entries
+	c.historyLoaded = true
+	return nil
+}
+
+// saveHistoryLocked writes the sealed index. Callers must hold c.historyMu.
+func (c *Client) saveHistoryLocked() {
+	data, err := json.Marshal(c.history)
+	if err != nil {
+		return
+	}
+
+	sealed, err := config.SealLocal(data, historyIndexAAD)
+	if err != nil {
+		log.Printf("[HISTORY] Could not seal index: %v", err)
+		return
+	}
+
+	dir, err := c.spoolDir("history")
+	if err != nil {
+		log.Printf("[HISTORY] Could not save index: %v", err)
+		return
+	}
+
+	tmp := filepath.Join(dir, "index.tmp")
+	if err := os.WriteFile(tmp, sealed, 0o600); err != nil {
+		log.Printf("[HISTORY] Could not save index: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "index")); err != nil {
+		log.Printf("[HISTORY] Could not save index: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package mqttclient
+
+import (
+	"bytes"
+	"desktop_client/config"
+	"desktop_client/settings"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/zalando/go-keyring"
+)
+
+func newHistoryClient(spool string, size int) *Client {
+	return newClient(Options{
+		SpoolDir: spool,
+		Settings: &testSettings{s: settings.Settings{HistorySize: size}},
+	})
+}
+
+func saveTestNotes(t *testing.T, c *Client, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		d := &DecodedPayload{Type: "text/plain", Filename: name, Payload: []byte("note " + name)}
+		if err := c.SaveReceived(d); err != nil {
+			t.Fatalf("saving %s: %v", name, err)
+		}
+	}
+}
+
+func historyNames(items []HistoryItem) string {
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = item.Filename
+	}
+	return strings.Join(names, ",")
+}
+
+// historyFiles lists the sealed items in the history dir.
+func historyFiles(t *testing.T, spool string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(spool, "history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Name() != "index" {
+			files = append(files, e.Name())
+		}
+	}
+	return files
+}
+
+func TestHistorySurvivesRestart(t *testing.T) {
+	keyring.MockInit()
+	spool := t.TempDir()
+
+	c := newHistoryClient(spool, 10)
+	saveTestNotes(t, c, "a", "b")
+
+	restarted := newHistoryClient(spool, 10)
+	items := restarted.History()
+	if got := historyNames(items); got != "b,a" {
+		t.Fatalf("history after restart = %s, want b,a", got)
+	}
+
+	data, item, err := restarted.ReadHistory(items[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "note a" || item.Size != int64(len("note a")) || item.Source != SourceBLE {
+		t.Errorf("read %q as %+v", data, item)
+	}
+}
+
+func TestHistoryKeepsNewest(t *testing.T) {
+	keyring.MockInit()
+	spool := t.TempDir()
+
+	c := newHistoryClient(spool, 2)
+	saveTestNotes(t, c, "a", "b", "c", "d")
+
+	items := c.History()
+	if got := historyNames(items); got != "d,c" {
+		t.Fatalf("history = %s, want d,c", got)
+	}
+
+	want := []string{items[0].ID, items[1].ID}
+	got := historyFiles(t, spool)
+	slices.Sort(want)
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("files of dropped items were kept: %v, want %v", got, want)
+	}
+}
+
+func TestHistoryRemoveAndClear(t *testing.T) {
+	keyring.MockInit()
+	spool := t.TempDir()
+
+	c := newHistoryClient(spool, 10)
+	saveTestNotes(t, c, "a", "b", "c")
+
+	changes := 0
+	c.OnHistoryChange(func() { changes++ })
+
+	c.RemoveHistory(c.History()[1].ID)
+	c.RemoveHistory("unknown")
+	if got := historyNames(newHistoryClient(spool, 10).History()); got != "c,a" {
+		t.Errorf("history after remove = %s, want c,a", got)
+	}
+
+	c.ClearHistory()
+	c.ClearHistory()
+	if got := newHistoryClient(spool, 10).History(); len(got) != 0 {
+		t.Errorf("history after clear = %s", historyNames(got))
+	}
+	if files := historyFiles(t, spool); len(files) != 0 {
+		t.Errorf("files left after clear: %v", files)
+	}
+
+	if changes != 2 {
+		t.Errorf("%d change callbacks, want 2", changes)
+	}
+}
+
+func TestHistoryRemovesUnlistedFiles(t *testing.T) {
+	keyring.MockInit()
+	spool := t.TempDir()
+
+	c := newHistoryClient(spool, 10)
+	saveTestNotes(t, c, "a")
+
+	// sealed, but the client stopped before adding it to the index
+	orphan, _, err := c.sealHistory(strings.NewReader("orphan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newHistoryClient(spool, 10)
+	items := restarted.History()
+	if got := historyNames(items); got != "a" {
+		t.Fatalf("history = %s, want a", got)
+	}
+	if files := historyFiles(t, spool); !slices.Equal(files, []string{items[0].ID}) {
+		t.Errorf("files = %v, want only %s and not %s", files, items[0].ID, orphan)
+	}
+}
+
+func TestHistoryTampered(t *testing.T) {
+	keyring.MockInit()
+
+	t.Run("item", func(t *testing.T) {
+		spool := t.TempDir()
+		c := newHistoryClient(spool, 10)
+		saveTestNotes(t, c, "a")
+		id := c.History()[0].ID
+
+		path := filepath.Join(spool, "history", id)
+		sealed, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed[len(sealed)-1] ^= 1
+		if err := os.WriteFile(path, sealed, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := c.ReadHistory(id); !errors.Is(err, config.ErrCorruptStorage) {
+			t.Errorf("reading a tampered item = %v, want ErrCorruptStorage", err)
+		}
+	})
+
+	t.Run("index", func(t *testing.T) {
+		spool := t.TempDir()
+		saveTestNotes(t, newHistoryClient(spool, 10), "a")
+
+		if err := os.WriteFile(filepath.Join(spool, "history", "index"), bytes.Repeat([]byte{1}, 64), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		restarted := newHistoryClient(spool, 10)
+		if got := restarted.History(); len(got) != 0 {
+			t.Errorf("history with a tampered index = %s", historyNames(got))
+		}
+		if files := historyFiles(t, spool); len(files) != 0 {
+			t.Errorf("files of the dropped history were kept: %v", files)
+		}
+	})
+}
@@ -0,0 +1,496 @@
+package mqttclient
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"desktop_client/config"
+	"desktop_client/internal/testkeys"
+	"desktop_client/settings"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/zalando/go-keyring"
+)
+
+// The integration tests run two Clients on one account against an embedded
+// broker that, like the production one, only accepts device certificates
+// issued by its CA. Each device has its own key, certificate, copy of the
+// group key and spool dir; only the settings package is shared.
+
+const testAccount = "test-account"
+
+// testPKI is a throwaway CA with a broker certificate for 127.0.0.1.
+type testPKI struct {
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caPEM  []byte
+	broker tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "HoppyShare Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testPKI{
+		ca:    ca,
+		caKey: caKey,
+		caPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+	}
+
+	brokerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	brokerDER := p.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "broker"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &brokerKey.PublicKey)
+	p.broker = tls.Certificate{Certificate: [][]byte{brokerDER}, PrivateKey: brokerKey}
+
+	return p
+}
+
+func (p *testPKI) issue(t *testing.T, tmpl *x509.Certificate, pub any) []byte {
+	t.Helper()
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.ca, pub, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// deviceCert issues a client certificate for the account and deviceID.
+func (p *testPKI) deviceCert(t *testing.T, deviceID string, pub any) []byte {
+	t.Helper()
+
+	der := p.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: testAccount},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		URIs:        []*url.URL{{Scheme: "urn", Opaque: deviceURIPrefix + deviceID}},
+	}, pub)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// startTestBroker starts an embedded broker that requires a client
+// certificate issued by the test CA.
+func startTestBroker(t *testing.T, p *testPKI) (*mochi.Server, config.Broker) {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(p.ca)
+
+	srv := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := srv.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	l := listeners.NewTCP(listeners.Config{
+		ID:      "mtls",
+		Address: "127.0.0.1:0",
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{p.broker},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		},
+	})
+	if err := srv.AddListener(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	return srv, config.Broker{URL: "tls://" + l.Address(), Proxy: "direct"}
+}
+
+// testSettings is a SettingsProvider that applies the settings topic entry
+// of one device.
+type testSettings struct {
+	mu       sync.Mutex
+	deviceID string
+	s        settings.Settings
+	rules    []settings.ReceiveRule
+	devices  []string
+}
+
+func (p *testSettings) Get() settings.Settings {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.s
+}
+
+func (p *testSettings) ReceiveRules() []settings.ReceiveRule {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rules
+}
+
+func (p *testSettings) DeviceIDs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.devices...)
+}
+
+func (p *testSettings) Update(data []byte) error {
+	var all []settings.DeviceSettings
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.devices = p.devices[:0]
+	for _, d := range all {
+		p.devices = append(p.devices, d.DeviceID)
+		if d.DeviceID != p.deviceID {
+			continue
+		}
+		if d.Settings.Nickname != nil {
+			p.s.Nickname = *d.Settings.Nickname
+		}
+		if d.Settings.Enabled != nil {
+			p.s.Enabled = *d.Settings.Enabled
+		}
+		if d.Settings.ReceiveRules != nil {
+			p.rules = d.Settings.ReceiveRules
+		}
+	}
+	return nil
+}
+
+// testGroupKeys is a GroupKeyring holding the group key of one device.
+type testGroupKeys struct {
+	key []byte // wrapped with the device key
+}
+
+func (k testGroupKeys) Current() config.GroupKeyEntry {
+	return config.GroupKeyEntry{ID: 0, Key: k.key}
+}
+
+func (k testGroupKeys) IDs() []uint32 {
+	return []uint32{0}
+}
+
+func (k testGroupKeys) Lookup(id uint32) (config.GroupKeyEntry, error) {
+	if id != 0 {
+		return config.GroupKeyEntry{}, config.ErrUnknownGroupKey
+	}
+	return k.Current(), nil
+}
+
+// testDevice is a connected Client with its callbacks turned into channels.
+type testDevice struct {
+	*Client
+	settings *testSettings
+	messages chan struct{}
+	updates  chan struct{}
+	status   chan string
+}
+
+func newTestDevice(t *testing.T, p *testPKI, broker config.Broker, deviceID string, s settings.Settings) *testDevice {
+	t.Helper()
+
+	d := &testDevice{
+		settings: &testSettings{deviceID: deviceID, s: s},
+		messages: make(chan struct{}, 16),
+		updates:  make(chan struct{}, 16),
+		status:   make(chan string, 16),
+	}
+
+	keys := testkeys.NewDevice(t)
+
+	c, err := NewClient(Options{
+		CertPEM:    p.deviceCert(t, deviceID, &keys.Key.PublicKey),
+		KeyPEM:     keys.KeyPEM,
+		CAPEM:      p.caPEM,
+		DeviceID:   deviceID,
+		Brokers:    []config.Broker{broker},
+		Settings:   d.settings,
+		GroupKeys:  testGroupKeys{key: keys.GroupKey},
+		SpoolDir:   t.TempDir(),
+		OnMessage:  func() { d.messages <- struct{}{} },
+		OnSettings: func() { d.updates <- struct{}{} },
+		OnStatus:   func(s string) { d.status <- s },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Client = c
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Disconnect)
+
+	d.waitStatus(t, "Connected", 10*time.Second)
+	return d
+}
+
+// waitStatus waits for the client to report status, skipping any other.
+func (d *testDevice) waitStatus(t *testing.T, status string, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.After(timeout)
+	for {
+		select {
+		case s := <-d.status:
+			if s == status {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("%s: no %q status after %s", d.opts.DeviceID, status, timeout)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// expectNote publishes data from one device to another and checks it reaches
+// the receiver's history intact.
+func expectNote(t *testing.T, from, to *testDevice, data []byte) {
+	t.Helper()
+
+	if err := from.Publish([]string{to.opts.DeviceID}, data, "text/plain", "note.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-to.messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("note was not delivered")
+	}
+
+	item, ok := to.LatestHistory()
+	if !ok {
+		t.Fatal("note missing from history")
+	}
+	got, _, err := to.ReadHistory(item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("received %q, want %q", got, data)
+	}
+	if item.Filename != "note.txt" || item.ContentType != "text/plain" || item.Source != SourceMQTT {
+		t.Fatalf("unexpected history item %+v", item)
+	}
+	if !item.Verified {
+		t.Fatal("note from a device with a CA-issued certificate was not verified")
+	}
+}
+
+func TestIntegration(t *testing.T) {
+	testkeys.Install(t)
+	keyring.MockInit()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	pki := newTestPKI(t)
+	srv, broker := startTestBroker(t, pki)
+
+	a := newTestDevice(t, pki, broker, "test-device-a", settings.Settings{Nickname: "Device A", Enabled: true})
+	b := newTestDevice(t, pki, broker, "test-device-b", settings.Settings{Nickname: "Device B", Enabled: true, HistorySize: 10})
+
+	// frames are only signed and streamed once the receiver's capabilities
+	// have arrived
+	waitFor(t, "capabilities of device B", func() bool {
+		return a.negotiateVersionFor([]string{b.opts.DeviceID}) == CurrentVersion
+	})
+
+	t.Run("Publish", func(t *testing.T) {
+		expectNote(t, a, b, []byte("hello from A"))
+	})
+
+	t.Run("CertForAnotherDevice", func(t *testing.T) {
+		// B advertising its own certificate for A must not let it sign as A
+		err := a.registerPeerCert(hashDeviceID(a.opts.DeviceID), b.opts.CertPEM)
+		if err == nil {
+			t.Fatal("accepted a certificate issued for another device")
+		}
+	})
+
+	t.Run("Reconnect", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip("waits out the broker backoff")
+		}
+
+		cl, ok := srv.Clients.Get(b.sessionClientID())
+		if !ok {
+			t.Fatal("device B is not connected to the broker")
+		}
+		cl.Stop(errors.New("dropped by test"))
+
+		b.waitStatus(t, "Disconnected", 5*time.Second)
+		b.waitStatus(t, "Connected", minBrokerBackoff+10*time.Second)
+
+		expectNote(t, a, b, []byte("hello again"))
+	})
+
+	t.Run("ReceiveRules", func(t *testing.T) {
+		deny := []byte(`[{"deviceid":"` + b.opts.DeviceID + `","settings":{"receive_rules":[{"sender":"` + a.opts.DeviceID + `","action":"deny"}]}}]`)
+		if err := b.settings.Update(deny); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			b.settings.Update([]byte(`[{"deviceid":"` + b.opts.DeviceID + `","settings":{"receive_rules":[]}}]`))
+		})
+
+		if err := a.Publish([]string{b.opts.DeviceID}, []byte("denied"), "text/plain", "note.txt"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-b.messages:
+			t.Fatal("note from a denied sender was delivered")
+		case <-time.After(time.Second):
+		}
+
+		limit := []byte(`[{"deviceid":"` + b.opts.DeviceID + `","settings":{"receive_rules":[{"sender":"*","types":["text/*"],"max_size":16}]}}]`)
+		if err := b.settings.Update(limit); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Publish([]string{b.opts.DeviceID}, []byte("longer than sixteen bytes"), "text/plain", "note.txt"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-b.messages:
+			t.Fatal("note over the size limit was delivered")
+		case <-time.After(time.Second):
+		}
+
+		expectNote(t, a, b, []byte("short"))
+	})
+
+	t.Run("Ping", func(t *testing.T) {
+		pings := make(chan string, 4)
+		b.OnPing(func(from string) { pings <- from })
+
+		expectPing := func(want bool) {
+			t.Helper()
+			select {
+			case from := <-pings:
+				if !want {
+					t.Fatalf("unexpected ping from %q", from)
+				}
+				if from != "Device A" {
+					t.Fatalf("ping from %q, want Device A", from)
+				}
+			case <-time.After(time.Second):
+				if want {
+					t.Fatal("ping was not delivered")
+				}
+			}
+		}
+
+		if err := a.Ping(b.opts.DeviceID); err != nil {
+			t.Fatal(err)
+		}
+		expectPing(true)
+
+		// a frame A encoded, published once on the topic of another device
+		// and then twice on A's own
+		frame, err := a.encodeFrame(CurrentVersion, 0, PingType, "", [][32]byte{hashDeviceID(b.opts.DeviceID)},
+			[]byte(`{"device":"`+b.opts.DeviceID+`","from":"Device A"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		other := a.topic("ping/" + a.clientIDFor(hashDeviceID("test-device-c")))
+		if err := srv.Publish(other, frame, false, 1); err != nil {
+			t.Fatal(err)
+		}
+		expectPing(false)
+
+		for _, want := range []bool{true, false} {
+			if err := srv.Publish(a.deviceTopic("ping"), frame, false, 1); err != nil {
+				t.Fatal(err)
+			}
+			expectPing(want)
+		}
+	})
+
+	t.Run("Settings", func(t *testing.T) {
+		payload := []byte(`[{"deviceid":"test-device-b","settings":{"nickname":"Renamed B"}}]`)
+		if err := srv.Publish(b.topic("settings"), payload, true, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-b.updates:
+		case <-time.After(5 * time.Second):
+			t.Fatal("settings update was not delivered")
+		}
+
+		if got := b.settings.Get().Nickname; got != "Renamed B" {
+			t.Fatalf("nickname is %q after update", got)
+		}
+
+		// the new nickname is republished as B's presence
+		waitFor(t, "presence with the new nickname", func() bool {
+			p, ok := a.PeerPresence(b.opts.DeviceID)
+			return ok && p.Online && p.Nickname == "Renamed B"
+		})
+	})
+}
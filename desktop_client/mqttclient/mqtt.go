@@ -1,217 +1,722 @@
 package mqttclient
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"desktop_client/config"
 	"desktop_client/notification"
 	"desktop_client/settings"
-	"desktop_client/systrayhelpers"
 	_ "embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
-
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-var (
-	client   mqtt.Client
-	clientID string
-)
+// Client is one device identity on the broker: its mTLS certificate and key,
+// the brokers to reach, where its settings and group keys come from and what
+// to call when something arrives. Everything a device keeps while it runs,
+// e.g. the replay cache, peer certificates, transfers, the outbox and the
+// received history, belongs to its Client. The package-level functions in
+// default.go drive one Client built from the config package.
+type Client struct {
+	opts      Options
+	id        string // account ID, the common name of the device certificate
+	tls       *tls.Config
+	settings  SettingsProvider
+	groupKeys GroupKeyring
+
+	mu   sync.Mutex
+	conn conn          // current connection, nil until the first one
+	stop chan struct{} // closed to stop connectLoop
+
+	session *cryptoSession // see session.go
+	replays *replayCache   // see replay.go
+
+	peerCapsMu  sync.RWMutex // see caps.go
+	peerCaps    map[[32]byte]Capabilities
+	keyIDs      []uint32     // group keys last advertised
+	peerCertsMu sync.RWMutex // see sign.go
+	peerCerts   map[[32]byte]*x509.Certificate
+
+	transfersMu  sync.Mutex // see transfer.go
+	outgoing     map[string]*outgoingTransfer
+	incoming     map[string]*incomingTransfer
+	loadOnce     sync.Once
+	paceMu       sync.Mutex
+	lastPartSent time.Time
+
+	historyMu     sync.Mutex     // see history.go
+	history       []historyEntry // oldest first
+	historyLoaded bool
+	onHistoryFns  []func()
+
+	outboxMu      sync.Mutex   // see outbox.go
+	outbox        []OutboxItem // oldest first
+	outboxLoaded  bool
+	flushMu       sync.Mutex // one flush at a time keeps items in order
+	onOutboxFuncs []func()
+
+	sentMu        sync.Mutex  // see receipts.go
+	sentNotes     []*SentNote // oldest first
+	onReceiptsFns []func()
+
+	presenceMu    sync.Mutex // see presence.go
+	peerPresence  map[[32]byte]Presence
+	transport     string
+	onPresenceFns []func()
+
+	pingMu            sync.Mutex // see ping.go
+	onPings           []func(from string)
+	lastDashboardPing time.Time
+}
+
+// Options configure a Client. CertPEM, KeyPEM, CAPEM, DeviceID and at least
+// one broker are required.
+type Options struct {
+	CertPEM  []byte // device certificate; its common name is the account ID
+	KeyPEM   []byte // signs frames and unwraps the group keys
+	CAPEM    []byte // CA of the broker and of every device certificate
+	DeviceID string
+
+	Brokers   []config.Broker  // in order of preference, see brokers.go
+	Settings  SettingsProvider // nil uses the settings package
+	GroupKeys GroupKeyring     // nil uses the config package
+	SpoolDir  string           // received notes, outbox and transfers; empty uses the user cache dir
+
+	OnMessage  func()              // a note was added to the history
+	OnSettings func()              // after every update on the settings topic
+	OnStatus   func(status string) // connection status, e.g. for the tray tooltip
+}
+
+// SettingsProvider is where a Client reads its settings and hands updates
+// from the settings topic.
+type SettingsProvider interface {
+	Get() settings.Settings
+	ReceiveRules() []settings.ReceiveRule // see settings.ApplyReceiveRules
+	DeviceIDs() []string                  // every device on the account, including this one
+	Update(data []byte) error
+}
+
+// packageSettings is the SettingsProvider backed by the settings package.
+type packageSettings struct{}
+
+func (packageSettings) Get() settings.Settings               { return settings.GetSettings() }
+func (packageSettings) ReceiveRules() []settings.ReceiveRule { return settings.ReceiveRules() }
+func (packageSettings) DeviceIDs() []string                  { return settings.DeviceIDs() }
+func (packageSettings) Update(data []byte) error             { return settings.ParseSettings(data) }
+
+// GroupKeyring is where a Client finds the group keys, wrapped with its
+// KeyPEM like config.GroupKey. See config.AddGroupKey for rotation.
+type GroupKeyring interface {
+	Current() config.GroupKeyEntry
+	Lookup(id uint32) (config.GroupKeyEntry, error)
+	IDs() []uint32 // keys that can still decrypt, oldest first
+}
+
+// packageGroupKeys is the GroupKeyring backed by the config package.
+type packageGroupKeys struct{}
+
+func (packageGroupKeys) Current() config.GroupKeyEntry { return config.CurrentGroupKey() }
+func (packageGroupKeys) IDs() []uint32                 { return config.GroupKeyIDs() }
+func (packageGroupKeys) Lookup(id uint32) (config.GroupKeyEntry, error) {
+	return config.LookupGroupKey(id)
+}
+
+// NewClient checks opts and returns a Client that is not connected yet.
+func NewClient(opts Options) (*Client, error) {
+	if opts.DeviceID == "" {
+		return nil, errors.New("no device ID")
+	}
+	if len(opts.Brokers) == 0 {
+		return nil, errors.New("no brokers")
+	}
 
-// Connect sets up the MQTT client with mTLS and connects to the broker
-func Connect() (string, error) {
+	c := newClient(opts)
+	if err := c.loadCertificate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
-	cert, err := tls.X509KeyPair(config.CertPem, config.KeyPem)
+// newClient returns a Client for opts without checking them. The
+// certificate is only loaded on Connect, so a client that never connects,
+// like the default one before Connect, can still encode and decode frames.
+func newClient(opts Options) *Client {
+	c := &Client{
+		opts:         opts,
+		settings:     opts.Settings,
+		groupKeys:    opts.GroupKeys,
+		replays:      newReplayCache(),
+		peerCaps:     make(map[[32]byte]Capabilities),
+		peerCerts:    make(map[[32]byte]*x509.Certificate),
+		outgoing:     make(map[string]*outgoingTransfer),
+		incoming:     make(map[string]*incomingTransfer),
+		peerPresence: make(map[[32]byte]Presence),
+		transport:    TransportMQTT,
+	}
+	if c.settings == nil {
+		c.settings = packageSettings{}
+	}
+	if c.groupKeys == nil {
+		c.groupKeys = packageGroupKeys{}
+	}
+	c.session = newCryptoSession(opts.KeyPEM, c.groupKeys)
+	return c
+}
+
+// loadCertificate sets up mTLS with the certificate, key and CA of the
+// options, and takes the account ID from the certificate.
+func (c *Client) loadCertificate() error {
+	cert, err := tls.X509KeyPair(c.opts.CertPEM, c.opts.KeyPEM)
 	if err != nil {
-		log.Fatalf("Failed to load client certificate/key: %v", err)
+		return fmt.Errorf("load client certificate/key: %w", err)
 	}
 
 	pool := x509.NewCertPool()
-	if ok := pool.AppendCertsFromPEM(config.CAPem); !ok {
-		log.Fatalf("Failed to append CA certs")
+	if ok := pool.AppendCertsFromPEM(c.opts.CAPEM); !ok {
+		return errors.New("no CA certificate in CAPEM")
 	}
 
 	leafCert, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
-		log.Fatalf("Failed to parse client certificate: %v", err)
+		return fmt.Errorf("parse client certificate: %w", err)
 	}
 	cert.Leaf = leafCert
-	clientID = leafCert.Subject.CommonName
 
-	tlsConfig := &tls.Config{
+	if leafCert.Subject.CommonName == "" {
+		return errors.New("client certificate has no common name")
+	}
+
+	c.id = leafCert.Subject.CommonName
+	c.tls = &tls.Config{
 		RootCAs:      pool,
 		Certificates: []tls.Certificate{cert},
-		// ServerName omitted - will skip hostname verification when connecting to IP
-		// TODO: Add ServerName when using proper domain name
-	}
-
-	go func() {
-		opts := mqtt.NewClientOptions()
-		opts.AddBroker("tls://18.188.110.246:8883")
-		opts.SetClientID(fmt.Sprintf("%s-%d", clientID, time.Now().Unix()))
-		opts.SetTLSConfig(tlsConfig)
-		opts.SetKeepAlive(60 * time.Second)
-		opts.SetAutoReconnect(true)
-		opts.SetConnectRetry(true)
-		opts.SetConnectRetryInterval(5 * time.Second)
-		opts.SetMaxReconnectInterval(30 * time.Second)
-
-		opts.OnConnect = func(c mqtt.Client) {
-			Subscribe(c)
-			systrayhelpers.SetTooltip("Connected")
+	}
+	return nil
+}
+
+// ID returns the account ID the client connects as.
+func (c *Client) ID() string {
+	return c.id
+}
+
+// IsConnected reports whether the client is connected to a broker.
+func (c *Client) IsConnected() bool {
+	cn := c.current()
+	return cn != nil && cn.IsConnected()
+}
+
+// current returns the connection to the broker, or nil before the first one.
+func (c *Client) current() conn {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+func (c *Client) setStatus(status string) {
+	if c.opts.OnStatus != nil {
+		c.opts.OnStatus(status)
+	}
+}
+
+// topic returns the topic kind of this client's account, e.g. "notes".
+func (c *Client) topic(kind string) string {
+	return fmt.Sprintf("users/%s/%s", c.id, kind)
+}
+
+// Device topics
+//
+// Every device publishes its caps, presence and pings to a subtopic of the
+// kind named after its MQTT client ID, e.g. users/<account>/caps/<client ID>.
+// Devices of an account share the broker username, so the broker ACL tells
+// them apart by client ID and only lets each connection write its own
+// subtopic (see mosquitto-docker/api/app.py). The client ID is chosen by
+// the device and not authenticated, so receivers still check that the
+// device in the payload is the one the topic belongs to, and tie it to its
+// certificate where it matters (see sign.go).
+
+// clientIDFor returns the MQTT client ID of the device with the given hash.
+func (c *Client) clientIDFor(deviceHash [32]byte) string {
+	return fmt.Sprintf("%s-%s", c.id, hex.EncodeToString(deviceHash[:8]))
+}
+
+// deviceTopic returns this device's subtopic of the topic kind.
+func (c *Client) deviceTopic(kind string) string {
+	return c.topic(kind + "/" + c.sessionClientID())
+}
+
+// topicDevice returns the hash of the device a message on a device topic
+// claims to come from, given as hex in its payload, and reports whether
+// that device may publish to the topic.
+func (c *Client) topicDevice(topic, device string) ([32]byte, bool) {
+	var hash [32]byte
+
+	raw, err := hex.DecodeString(device)
+	if err != nil || len(raw) != len(hash) {
+		return hash, false
+	}
+	copy(hash[:], raw)
+
+	return hash, topic[strings.LastIndex(topic, "/")+1:] == c.clientIDFor(hash)
+}
+
+// Connect starts connecting to the brokers in the background and keeps the
+// client connected until Disconnect. Calling it again restarts the loop.
+func (c *Client) Connect() error {
+	c.mu.Lock()
+	if c.tls == nil {
+		if err := c.loadCertificate(); err != nil {
+			c.mu.Unlock()
+			return err
 		}
+	}
+	brokers := c.opts.Brokers
+	c.mu.Unlock()
 
-		opts.OnConnectionLost = func(c mqtt.Client, err error) {
-			fmt.Printf("Connection lost: %v\n", err)
+	if c.opts.DeviceID == "" {
+		return errors.New("no device ID")
+	}
+	if len(brokers) == 0 {
+		return errors.New("no brokers")
+	}
 
-			systrayhelpers.SetTooltip("Disconnected")
+	// notes queued on the broker while offline may be up to offlineTTL old
+	if ttl := c.offlineTTL(); ttl > 0 {
+		path, err := c.replayPath()
+		if err != nil {
+			log.Printf("[REPLAY] Keeping the cache in memory only: %v", err)
 		}
+		c.replays.setWindow(ttl, path)
+	}
+
+	c.mu.Lock()
+	if c.stop != nil {
+		close(c.stop)
+	}
+	stop := make(chan struct{})
+	c.stop = stop
+	c.mu.Unlock()
 
-		opts.OnReconnecting = func(c mqtt.Client, opts *mqtt.ClientOptions) {
-			log.Println("Attempting MQTT reconnect...")
+	go c.connectLoop(newBrokerPool(brokers), stop)
+
+	return nil
+}
+
+// setBrokers replaces the brokers the next Connect uses.
+func (c *Client) setBrokers(brokers []config.Broker) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opts.Brokers = brokers
+}
+
+// connectLoop keeps the client connected to the healthiest broker until stop
+// is closed. See brokers.go.
+func (c *Client) connectLoop(pool *brokerPool, stop chan struct{}) {
+	for {
+		i, wait := pool.next()
+		if wait > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
 		}
 
-		client = mqtt.NewClient(opts)
+		broker := pool.brokers[i]
+		lost := make(chan error, 1)
 
-		token := client.Connect()
-		token.Wait()
-		err = token.Error()
+		cn, err := connectBroker(pool, i, c.tls, c.brokerSession(), lost)
 		if err != nil {
-			log.Printf("Count not connect to MQTT as %s", clientID)
+			log.Printf("Could not connect to MQTT broker %s as %s", broker.URL, c.id)
+			c.setStatus("Disconnected: cannot reach " + broker.Host())
+			pool.failed(i, err)
+			continue
 		}
 
-		log.Printf("Connected to MQTT as %s", clientID)
-	}()
+		pool.succeeded(i)
+		c.mu.Lock()
+		c.conn = cn
+		c.mu.Unlock()
+		log.Printf("Connected to MQTT broker %s over %s as %s", broker.URL, cn.Protocol(), c.id)
+
+		c.subscribe(cn)
+		c.setStatus("Connected")
+		c.resumeTransfers()
+		go c.FlushOutbox()
 
-	return clientID, nil
+		reconnect := c.stayConnected(pool, i, lost, stop)
+		if cn.IsConnected() {
+			c.publishOffline(cn)
+		}
+		cn.Disconnect()
+		if !reconnect {
+			return
+		}
+	}
 }
 
-func Disconnect() {
-	if client != nil && client.IsConnected() {
-		client.Disconnect(250)
+// stayConnected waits until the connection to broker current is lost or a
+// preferred broker is reachable again, and reports whether to reconnect.
+// It returns false once stop is closed.
+func (c *Client) stayConnected(pool *brokerPool, current int, lost chan error, stop chan struct{}) bool {
+	ticker := time.NewTicker(failbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return false
+		case err := <-lost:
+			fmt.Printf("Connection lost: %v\n", err)
+			c.setStatus("Disconnected")
+			pool.failed(current, err)
+			return true
+		case <-ticker.C:
+			for _, i := range pool.preferred(current) {
+				if err := probeBroker(c.tls, pool.brokers[i]); err != nil {
+					pool.failed(i, err)
+					continue
+				}
+				log.Printf("[BROKER] %s is reachable again, switching back", pool.brokers[i].URL)
+				return true
+			}
+		}
 	}
 }
 
-type lastMessage struct {
-	Filename    string
-	ContentType string
-	Payload     []byte
+// Disconnect stops reconnecting and closes the connection, after marking this
+// device offline.
+func (c *Client) Disconnect() {
+	c.mu.Lock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	cn := c.conn
+	c.mu.Unlock()
+
+	if cn != nil && cn.IsConnected() {
+		c.publishOffline(cn)
+		cn.Disconnect()
+	}
 }
 
-var (
-	lastMsg   lastMessage
-	lastMsgMu sync.RWMutex
-)
+func (c *Client) subscribe(cn conn) {
+	// Restores transfers and clears the spool of leftovers, which must happen
+	// before anything received can be spooled.
+	c.loadTransfers()
 
-func Subscribe(client mqtt.Client) {
+	notesTopic := c.topic("notes")
+	settingsTopic := c.topic("settings")
+	capsTopic := c.topic("caps/+")
+	presenceTopic := c.topic("presence/+")
 
-	notesTopic := fmt.Sprintf("users/%s/notes", clientID)
-	settingsTopic := fmt.Sprintf("users/%s/settings", clientID)
+	log.Printf("Subscribing to %s, %s, %s, %s, %s and %s", notesTopic, settingsTopic, capsTopic, presenceTopic, c.receiptsTopic(), c.pingTopic())
 
-	log.Printf("Subscribing to %s and %s", notesTopic, settingsTopic)
+	if err := cn.Subscribe(notesTopic, c.handleNote); err != nil {
+		notification.Notification("Error: Could not subscribe to server")
+		log.Printf("Subscribe error (notes): %v", err)
+	}
 
-	if token := client.Subscribe(notesTopic, 1, func(client mqtt.Client, m mqtt.Message) {
+	if err := cn.Subscribe(settingsTopic, func(m message) {
+		log.Printf("[SETTINGS] %s: %s", m.Topic, string(m.Payload))
 
-		if !settings.GetSettings().Enabled {
-			return
+		if err := c.settings.Update(m.Payload); err != nil {
+			log.Printf("[SETTINGS] %v", err)
 		}
 
-		decoded, err := DecodeMessage(m.Payload())
-
-		if err != nil {
-			log.Printf("Failed to decode message: %v", err)
-			return
+		if c.opts.OnSettings != nil {
+			c.opts.OnSettings()
 		}
 
-		if !settings.GetSettings().SendToSelf && decoded.DeviceID == hashDeviceID(config.DeviceID) {
-			return
+		// the nickname may have changed
+		go c.PublishPresence()
+
+		// and a rotated group key has to be advertised before anyone
+		// encrypts with it
+		if c.keysChanged() {
+			go func() {
+				if err := c.publishCapabilities(cn); err != nil {
+					log.Printf("Failed to publish capabilities: %v", err)
+				}
+			}()
 		}
 
-		cacheMsg(decoded.Filename, decoded.Type, decoded.Payload)
+	}); err != nil {
+		notification.Notification("Error: Could not subscribe to server")
+		log.Printf("Subscribe error (settings): %v", err)
+	}
 
-		log.Printf("[NOTES] Received %s (%s), %d bytes", decoded.Filename, decoded.Type, len(decoded.Payload))
+	if err := cn.Subscribe(capsTopic, c.handleCapabilities); err != nil {
+		log.Printf("Subscribe error (caps): %v", err)
+	}
 
-	}); token.Wait() && token.Error() != nil {
-		notification.Notification("Error: Could not subscribe to server")
-		log.Printf("Subscribe error (notes): %v", token.Error())
+	if err := cn.Subscribe(c.receiptsTopic(), c.handleReceipt); err != nil {
+		log.Printf("Subscribe error (receipts): %v", err)
 	}
 
-	if token := client.Subscribe(settingsTopic, 1, func(client mqtt.Client, m mqtt.Message) {
-		log.Printf("[SETTINGS] %s: %s", m.Topic(), string(m.Payload()))
+	if err := c.publishCapabilities(cn); err != nil {
+		log.Printf("Failed to publish capabilities: %v", err)
+	}
 
-		settings.ParseSettings(m.Payload())
+	if err := cn.Subscribe(presenceTopic, c.handlePresence); err != nil {
+		log.Printf("Subscribe error (presence): %v", err)
+	}
 
-	}); token.Wait() && token.Error() != nil {
-		notification.Notification("Error: Could not subscribe to server")
+	if err := cn.Subscribe(c.pingTopic(), c.handlePing); err != nil {
+		log.Printf("Subscribe error (ping): %v", err)
 	}
+
+	c.publishPresence(cn)
 }
 
-var onMessage func()
+func (c *Client) handleNote(m message) {
+	s := c.settings.Get()
+	if !s.Enabled {
+		return
+	}
+
+	dec, err := c.NewDecoder(bytes.NewReader(m.Payload))
 
-func SetOnMessageCallback(cb func()) {
-	onMessage = cb
-}
-func cacheMsg(fname, ctype string, payload []byte) {
-	lastMsgMu.Lock()
-	lastMsg = lastMessage{
-		Filename:    fname,
-		ContentType: ctype,
-		Payload:     payload,
+	if errors.Is(err, ErrReplay) || errors.Is(err, ErrStale) {
+		log.Printf("[NOTES] Dropped message: %v", err)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to decode message: %v", err)
+		return
 	}
-	lastMsgMu.Unlock()
 
-	if onMessage != nil {
-		onMessage()
+	if !dec.Header.IsFor(c.opts.DeviceID) {
+		return
 	}
 
-}
+	if !s.SendToSelf && dec.Header.DeviceID == hashDeviceID(c.opts.DeviceID) {
+		return
+	}
+
+	if isTransferFrame(dec.Header) {
+		payload, err := io.ReadAll(dec)
+		if err != nil {
+			log.Printf("Failed to decode message: %v", err)
+			return
+		}
+
+		c.handleTransferFrame(m.Topic, &DecodedPayload{
+			Version:    dec.Header.Version,
+			Flags:      dec.Header.Flags,
+			Type:       dec.Header.Type,
+			Filename:   dec.Header.Filename,
+			DeviceID:   dec.Header.DeviceID,
+			MessageID:  dec.Header.MessageID,
+			Sent:       dec.Header.Sent,
+			Recipients: dec.Header.Recipients,
+			Payload:    payload,
+			Verified:   dec.Verified,
+		})
+		return
+	}
+
+	rule := c.receiveFor(dec.Header.DeviceID, dec.Header.Type)
+	if rule.Deny {
+		log.Printf("[NOTES] Dropped %s (%s) by a receive rule", dec.Header.Filename, dec.Header.Type)
+		return
+	}
 
-func ClearMsg() {
-	lastMsgMu.Lock()
-	defer lastMsgMu.Unlock()
-	lastMsg = lastMessage{}
+	// decrypted straight into the history so the plaintext never has to sit
+	// in memory or on disk as a whole, and only up to the rule's size limit
+	var r io.Reader = dec
+	if rule.MaxSize > 0 {
+		r = io.LimitReader(dec, rule.MaxSize+1)
+	}
+	id, size, err := c.sealHistory(r)
+	if err != nil {
+		log.Printf("Failed to decode message: %v", err)
+		return
+	}
+
+	if !c.acceptSender(dec.Verified) {
+		log.Printf("[NOTES] Dropped unverified message %s", dec.Header.Filename)
+		c.removeHistoryFile(id)
+		return
+	}
+
+	if !rule.Accepts(size) {
+		log.Printf("[NOTES] Dropped %s, larger than the receive rule allows", dec.Header.Filename)
+		c.removeHistoryFile(id)
+		return
+	}
+
+	c.cacheFile(historyEntry{
+		HistoryItem: HistoryItem{
+			ID:          id,
+			Filename:    dec.Header.Filename,
+			ContentType: dec.Header.Type,
+			Size:        size,
+			Source:      SourceMQTT,
+			Verified:    dec.Verified,
+		},
+		SenderHash: dec.Header.DeviceID,
+		Version:    dec.Header.Version,
+		MessageID:  dec.Header.MessageID,
+	})
+
+	log.Printf("[NOTES] Received %s (%s), %d bytes", dec.Header.Filename, dec.Header.Type, size)
 }
 
-func GetLastMessage() (filename, contentType string, data []byte, ok bool) {
-	lastMsgMu.RLock()
+// cacheFile adds a received message to the history, and tells its sender it
+// was delivered.
+func (c *Client) cacheFile(e historyEntry) {
+	c.addHistory(e)
+
+	c.sendReceipt(e.SenderHash, e.Version, e.MessageID, ReceiptDelivered)
 
-	defer lastMsgMu.RUnlock()
+	if c.opts.OnMessage != nil {
+		c.opts.OnMessage()
+	}
+}
 
-	if len(lastMsg.Payload) == 0 {
-		return "", "", nil, false
+// Publish sends data to the devices in to, or to every device if to is empty.
+func (c *Client) Publish(to []string, data []byte, contentType, filename string) error {
+	return c.PublishReader(to, bytes.NewReader(data), contentType, filename)
+}
+
+// PublishReader encodes everything read from r as one message on the notes
+// topic. When every recipient understands stream frames, r is encrypted
+// segment by segment without being read into memory first.
+//
+// While the client is disconnected, the note is queued in the outbox instead
+// and sent after the next connect, see outbox.go.
+func (c *Client) PublishReader(to []string, r io.Reader, contentType, filename string) error {
+	if !c.IsConnected() {
+		return c.queueOffline(c.topic("notes"), to, r, contentType, filename)
 	}
 
-	return lastMsg.Filename, lastMsg.ContentType, lastMsg.Payload, true
+	return c.sendNote(c.topic("notes"), to, r, contentType, filename)
+}
+
+// queueOffline queues a note in the outbox and tells the user.
+func (c *Client) queueOffline(topic string, to []string, r io.Reader, contentType, filename string) error {
+	if err := c.queueNote(topic, to, r, contentType, filename); err != nil {
+		if errors.Is(err, ErrOutboxFull) {
+			notification.Notification("Error: Too many messages waiting to be sent while offline")
+		} else {
+			notification.Notification("Error: Could not queue message while offline")
+		}
+		return err
+	}
+	notification.Notification("Offline: " + filename + " will be sent once reconnected")
+	return nil
 }
 
-func Publish(topic string, data []byte, contentType, filename string) error {
-	if client == nil || !client.IsConnected() {
-		return fmt.Errorf("cannot publish: client not connected")
+// sendNote encodes and publishes a note on the current connection.
+func (c *Client) sendNote(topic string, to []string, r io.Reader, contentType, filename string) error {
+	cn := c.current()
+	if cn == nil {
+		return errors.New("not connected")
 	}
 
-	encoded, err := EncodeMessage(contentType, filename, config.DeviceID, data)
+	version := c.negotiateVersionFor(to)
+	encoded, id, err := c.encodeReader(version, recipientHashes(to), r, contentType, filename)
 
 	if err != nil {
 		notification.Notification("Fatal: Failed to encode message")
+		return err
 	}
 
-	token := client.Publish(topic, 1, false, encoded)
+	err = cn.Publish(topic, encoded, c.frameOptions(version, "note", 10*time.Second))
 
-	ok := token.WaitTimeout(10 * time.Second)
-	if !ok {
+	var rejected *PublishError
+	switch {
+	case errors.Is(err, errPublishTimeout):
 		notification.Notification("Error: Publish timeout reached")
-		return fmt.Errorf("cannot publish: client not connected")
-	}
-
-	if err := token.Error(); err != nil {
+		return fmt.Errorf("cannot publish: %w", err)
+	case errors.As(err, &rejected):
+		notification.Notification("Error: Server rejected message (" + rejected.Reason + ")")
+		return err
+	case err != nil:
 		notification.Notification("Error: Could not publish")
 		return err
-	} else {
-		log.Printf("Published %s (%s)", filename, contentType)
 	}
 
+	log.Printf("Published %s (%s)", filename, contentType)
+
+	if version >= Version5 {
+		c.recordSent(id, filename, to)
+	}
 	return nil
 }
+
+// frameOptions are the publish options for a frame. V5 frames older than
+// ReplayWindow are rejected as stale, so the broker can drop them too, except
+// for notes, which wait on the broker for devices that are offline for up to
+// offlineTTL. The user properties let the broker side see what it is relaying
+// without decrypting anything.
+func (c *Client) frameOptions(version byte, kind string, timeout time.Duration) publishOptions {
+	opts := publishOptions{
+		Timeout: timeout,
+		UserProperties: map[string]string{
+			"frame-version": strconv.Itoa(int(version)),
+			"kind":          kind,
+		},
+	}
+	if version >= Version5 {
+		opts.Expiry = ReplayWindow
+		if kind == "note" {
+			opts.Expiry = max(c.offlineTTL(), ReplayWindow)
+		}
+	}
+	return opts
+}
+
+// encodeReader encodes everything read from r as one frame, and returns it
+// with its message ID (zero before V5).
+func (c *Client) encodeReader(version byte, to [][32]byte, r io.Reader, contentType, filename string) ([]byte, [16]byte, error) {
+	if version < Version3 {
+		data, err := io.ReadAll(io.LimitReader(r, MaxMessageSize+1))
+		if err != nil {
+			return nil, [16]byte{}, err
+		}
+		if len(data) > MaxMessageSize {
+			return nil, [16]byte{}, errors.New("message too large")
+		}
+		encoded, err := c.encodeFrame(version, 0, contentType, filename, to, data)
+		return encoded, [16]byte{}, err
+	}
+
+	h, err := c.newHeader(version, 0, contentType, filename, to)
+	if err != nil {
+		return nil, h.MessageID, err
+	}
+
+	buf := new(bytes.Buffer)
+	enc, err := c.NewEncoder(buf, h)
+	if err != nil {
+		return nil, h.MessageID, err
+	}
+
+	n, err := io.Copy(enc, io.LimitReader(r, MaxMessageSize+1))
+	if err != nil {
+		enc.Close()
+		return nil, h.MessageID, err
+	}
+	if n > MaxMessageSize {
+		enc.Close()
+		return nil, h.MessageID, errors.New("message too large")
+	}
+	if err := enc.Close(); err != nil {
+		return nil, h.MessageID, err
+	}
+
+	return buf.Bytes(), h.MessageID, nil
+}
@@ -0,0 +1,49 @@
+package mqttclient
+
+import (
+	"time"
+)
+
+// Offline delivery
+//
+// Every device connects with the same client ID on every start and asks the
+// broker to keep its session, its subscriptions and the QoS 1 notes it has
+// not received yet, for its offline TTL (the "offline_ttl" setting). A device
+// that was asleep or shut down receives the notes it missed once it
+// reconnects. Over v5 notes expire on the broker after the sender's TTL;
+// v3.1.1 sessions last as long as the broker's persistent_client_expiration.
+//
+// A TTL of zero turns this off: the device starts a clean session on every
+// connect, as it used to.
+const MaxOfflineTTL = 7 * 24 * time.Hour
+
+// offlineTTL is how long the broker keeps this device's session and the
+// notes it sends.
+func (c *Client) offlineTTL() time.Duration {
+	ttl := time.Duration(c.settings.Get().OfflineTTL) * time.Hour
+	return min(max(ttl, 0), MaxOfflineTTL)
+}
+
+// sessionClientID is the MQTT client ID of this device. It must be the same
+// across restarts for the broker to hand back the session.
+func (c *Client) sessionClientID() string {
+	return c.clientIDFor(hashDeviceID(c.opts.DeviceID))
+}
+
+// brokerSession is what a connection asks of the broker on connect.
+type brokerSession struct {
+	ClientID    string
+	TTL         time.Duration // zero starts a clean session
+	WillTopic   string
+	WillPayload []byte
+}
+
+func (c *Client) brokerSession() brokerSession {
+	willTopic, willPayload := c.presenceWill()
+	return brokerSession{
+		ClientID:    c.sessionClientID(),
+		TTL:         c.offlineTTL(),
+		WillTopic:   willTopic,
+		WillPayload: willPayload,
+	}
+}
@@ -0,0 +1,339 @@
+package mqttclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"desktop_client/config"
+	"desktop_client/notification"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Offline outbox
+//
+// Notes published while the client is disconnected are queued instead of
+// failing. Each one is sealed with the local storage key (see
+// config.SealLocal) and written to the outbox dir of the spool, so queued
+// items survive restarts. They are encoded only when they are sent, so the
+// frame gets a fresh timestamp and the recipients' current capabilities.
+//
+// The outbox is flushed in the order items were queued after every
+// (re)connect. Items that are still queued at their expiry are dropped.
+// Multi-part transfers are not queued; they wait out disconnects themselves.
+//
+// At most MaxOutboxItems notes totalling MaxOutboxBytes are queued; further
+// notes fail with ErrOutboxFull until the outbox drains.
+const (
+	OutboxLifetime = 24 * time.Hour
+	MaxOutboxItems = 50
+	MaxOutboxBytes = 100 * 1024 * 1024
+)
+
+// ErrOutboxFull means a note could not be queued because the outbox holds
+// MaxOutboxItems notes or MaxOutboxBytes already.
+var ErrOutboxFull = errors.New("outbox full")
+
+// OutboxItem is a note waiting in the outbox.
+type OutboxItem struct {
+	ID          string    `json:"id"`
+	Topic       string    `json:"topic"`
+	To          []string  `json:"to,omitempty"`
+	ContentType string    `json:"content_type"`
+	Filename    string    `json:"filename"`
+	Size        int64     `json:"size"`
+	Queued      time.Time `json:"queued"`
+	Expires     time.Time `json:"expires"`
+}
+
+type outboxEntry struct {
+	OutboxItem
+	Data []byte `json:"data"`
+}
+
+// outboxAAD binds a sealed outbox file to its item ID.
+func outboxAAD(id string) []byte {
+	return []byte("outbox/" + id)
+}
+
+// queueNote seals everything read from r into the outbox.
+func (c *Client) queueNote(topic string, to []string, r io.Reader, contentType, filename string) error {
+	data, err := io.ReadAll(io.LimitReader(r, MaxMessageSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxMessageSize {
+		return errors.New("message too large")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entry := outboxEntry{
+		OutboxItem: OutboxItem{
+			ID:          hex.EncodeToString(id),
+			Topic:       topic,
+			To:          to,
+			ContentType: contentType,
+			Filename:    filename,
+			Size:        int64(len(data)),
+			Queued:      now,
+			Expires:     now.Add(OutboxLifetime),
+		},
+		Data: data,
+	}
+
+	c.outboxMu.Lock()
+	c.loadOutboxLocked()
+	err = c.outboxRoomLocked(entry.Size)
+	if err == nil {
+		err = c.writeOutboxEntry(entry)
+	}
+	if err == nil {
+		c.outbox = append(c.outbox, entry.OutboxItem)
+	}
+	c.outboxMu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("could not queue %s: %w", filename, err)
+	}
+
+	log.Printf("[OUTBOX] Queued %s (%s) until the broker is reachable", filename, contentType)
+	c.outboxChanged()
+	return nil
+}
+
+// outboxRoomLocked checks that a note of the given size fits in the outbox.
+// Callers must hold c.outboxMu.
+func (c *Client) outboxRoomLocked(size int64) error {
+	total := size
+	for _, item := range c.outbox {
+		total += item.Size
+	}
+	if len(c.outbox) >= MaxOutboxItems || total > MaxOutboxBytes {
+		return ErrOutboxFull
+	}
+	return nil
+}
+
+// Outbox returns the items waiting to be sent, oldest first.
+func (c *Client) Outbox() []OutboxItem {
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+
+	c.loadOutboxLocked()
+	return append([]OutboxItem(nil), c.outbox...)
+}
+
+// CancelOutbox removes a queued item so it is never sent. It does nothing if
+// the item was already sent.
+func (c *Client) CancelOutbox(id string) {
+	if c.removeOutbox(id) {
+		log.Printf("[OUTBOX] Cancelled %s", id)
+		c.outboxChanged()
+	}
+}
+
+// OnOutboxChange registers fn to run whenever an item is queued, sent,
+// cancelled or expires.
+func (c *Client) OnOutboxChange(fn func()) {
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+	c.onOutboxFuncs = append(c.onOutboxFuncs, fn)
+}
+
+func (c *Client) outboxChanged() {
+	c.outboxMu.Lock()
+	fns := append([]func(){}, c.onOutboxFuncs...)
+	c.outboxMu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// FlushOutbox sends queued items in order. It stops at the first item that
+// fails to send for a reason that may go away, which keeps it and everything
+// after it queued for the next connect. It is called on every (re)connect.
+func (c *Client) FlushOutbox() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	for _, item := range c.Outbox() {
+		if time.Now().After(item.Expires) {
+			log.Printf("[OUTBOX] %s expired before it could be sent", item.Filename)
+			notification.Notification("Could not send " + item.Filename + ": still offline")
+			c.removeOutbox(item.ID)
+			c.outboxChanged()
+			continue
+		}
+
+		cn := c.current()
+		if cn == nil || !cn.IsConnected() {
+			return
+		}
+
+		entry, err := c.readOutboxEntry(item.ID)
+		if err != nil {
+			log.Printf("[OUTBOX] Dropping %s: %v", item.Filename, err)
+			c.removeOutbox(item.ID)
+			c.outboxChanged()
+			continue
+		}
+
+		err = c.sendNote(entry.Topic, entry.To, bytes.NewReader(entry.Data), entry.ContentType, entry.Filename)
+		clear(entry.Data)
+
+		switch {
+		case err == nil:
+			log.Printf("[OUTBOX] Sent %s, queued %s ago", item.Filename, time.Since(item.Queued).Round(time.Second))
+		case errors.Is(err, errPublishTimeout) || !cn.IsConnected():
+			log.Printf("[OUTBOX] Could not send %s, keeping it queued: %v", item.Filename, err)
+			return
+		default:
+			// rejected by the broker or unencodable, retrying won't help
+			log.Printf("[OUTBOX] Dropping %s: %v", item.Filename, err)
+		}
+
+		c.removeOutbox(item.ID)
+		c.outboxChanged()
+	}
+}
+
+// removeOutbox deletes a queued item and reports whether it was queued.
+func (c *Client) removeOutbox(id string) bool {
+	c.outboxMu.Lock()
+	defer c.outboxMu.Unlock()
+
+	for i, item := range c.outbox {
+		if item.ID != id {
+			continue
+		}
+
+		c.outbox = append(c.outbox[:i], c.outbox[i+1:]...)
+		if dir, err := c.spoolDir("outbox"); err == nil {
+			os.Remove(filepath.Join(dir, id))
+		}
+		return true
+	}
+	return false
+}
+
+// loadOutboxLocked reads the items a previous run left queued. Files that no
+// longer open, e.g. after a reinstall replaced the storage key, are removed.
+// If any other file cannot be read, nothing is loaded and the next call tries
+// again; items queued meanwhile are merged by ID. Callers must hold
+// c.outboxMu.
+func (c *Client) loadOutboxLocked() {
+	if c.outboxLoaded {
+		return
+	}
+
+	dir, err := c.spoolDir("outbox")
+	if err != nil {
+		log.Printf("[OUTBOX] Could not open outbox: %v", err)
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("[OUTBOX] Could not open outbox: %v", err)
+		return
+	}
+
+	loaded := make([]OutboxItem, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		entry, err := c.readOutboxEntry(e.Name())
+		if errors.Is(err, config.ErrCorruptStorage) {
+			log.Printf("[OUTBOX] Removing unreadable item %s", e.Name())
+			os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		if err != nil {
+			// e.g. the keychain is locked, try again on the next load
+			log.Printf("[OUTBOX] Could not read %s: %v", e.Name(), err)
+			return
+		}
+		// queued before items recorded their size
+		entry.Size = int64(len(entry.Data))
+		clear(entry.Data)
+
+		loaded = append(loaded, entry.OutboxItem)
+		seen[entry.ID] = true
+	}
+
+	for _, item := range c.outbox {
+		if !seen[item.ID] {
+			loaded = append(loaded, item)
+		}
+	}
+
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].Queued.Before(loaded[j].Queued) })
+	c.outbox = loaded
+	c.outboxLoaded = true
+}
+
+func (c *Client) writeOutboxEntry(entry outboxEntry) error {
+	dir, err := c.spoolDir("outbox")
+	if err != nil {
+		return err
+	}
+
+	plain, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	sealed, err := config.SealLocal(plain, outboxAAD(entry.ID))
+	clear(plain)
+	if err != nil {
+		return err
+	}
+
+	// write then rename, so a crash never leaves half an item behind
+	tmp := filepath.Join(dir, "."+entry.ID)
+	if err := os.WriteFile(tmp, sealed, 0o600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, entry.ID))
+}
+
+func (c *Client) readOutboxEntry(id string) (outboxEntry, error) {
+	var entry outboxEntry
+
+	dir, err := c.spoolDir("outbox")
+	if err != nil {
+		return entry, err
+	}
+
+	sealed, err := os.ReadFile(filepath.Join(dir, id))
+	if err != nil {
+		return entry, err
+	}
+
+	plain, err := config.OpenLocal(sealed, outboxAAD(id))
+	if err != nil {
+		return entry, err
+	}
+	defer clear(plain)
+
+	if err := json.Unmarshal(plain, &entry); err != nil || entry.ID != id {
+		return entry, config.ErrCorruptStorage
+	}
+	return entry, nil
+}
@@ -0,0 +1,135 @@
+package mqttclient
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zalando/go-keyring"
+)
+
+func queueTestNotes(t *testing.T, c *Client, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := c.queueNote("notes", nil, strings.NewReader("note "+name), "text/plain", name); err != nil {
+			t.Fatalf("queueing %s: %v", name, err)
+		}
+	}
+}
+
+func outboxNames(items []OutboxItem) []string {
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = item.Filename
+	}
+	return names
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	keyring.MockInit()
+	spool := t.TempDir()
+
+	c := newClient(Options{SpoolDir: spool})
+	queueTestNotes(t, c, "a", "b", "c")
+	c.CancelOutbox(c.Outbox()[1].ID)
+
+	restarted := newClient(Options{SpoolDir: spool})
+	items := restarted.Outbox()
+	if got := strings.Join(outboxNames(items), ","); got != "a,c" {
+		t.Fatalf("outbox after restart = %s, want a,c", got)
+	}
+	if items[0].Size != int64(len("note a")) {
+		t.Errorf("size = %d, want %d", items[0].Size, len("note a"))
+	}
+
+	entry, err := restarted.readOutboxEntry(items[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(entry.Data) != "note c" {
+		t.Errorf("data = %q, want %q", entry.Data, "note c")
+	}
+}
+
+func TestOutboxRemovesCorruptItems(t *testing.T) {
+	keyring.MockInit()
+	spool := t.TempDir()
+
+	c := newClient(Options{SpoolDir: spool})
+	queueTestNotes(t, c, "a")
+
+	corrupt := filepath.Join(spool, "outbox", "00112233445566778899aabbccddeeff")
+	if err := os.WriteFile(corrupt, []byte("not sealed"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newClient(Options{SpoolDir: spool})
+	if got := strings.Join(outboxNames(restarted.Outbox()), ","); got != "a" {
+		t.Errorf("outbox = %s, want a", got)
+	}
+	if _, err := os.Stat(corrupt); !os.IsNotExist(err) {
+		t.Errorf("corrupt item was not removed: %v", err)
+	}
+}
+
+func TestOutboxMergesAfterFailedLoad(t *testing.T) {
+	keyring.MockInit()
+	spool := t.TempDir()
+
+	c := newClient(Options{SpoolDir: spool})
+	queueTestNotes(t, c, "a")
+
+	// an item that cannot be read for now fails the whole load
+	blocked := filepath.Join(spool, "outbox", "ffeeddccbbaa99887766554433221100")
+	if err := os.Mkdir(blocked, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newClient(Options{SpoolDir: spool})
+	queueTestNotes(t, restarted, "b")
+	if restarted.outboxLoaded {
+		t.Fatal("outbox loaded despite an unreadable item")
+	}
+	if got := strings.Join(outboxNames(restarted.Outbox()), ","); got != "b" {
+		t.Errorf("outbox before the item is readable = %s, want b", got)
+	}
+
+	if err := os.Remove(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(outboxNames(restarted.Outbox()), ","); got != "a,b" {
+		t.Errorf("outbox after loading = %s, want a,b", got)
+	}
+}
+
+func TestOutboxLimits(t *testing.T) {
+	keyring.MockInit()
+
+	t.Run("count", func(t *testing.T) {
+		c := newClient(Options{SpoolDir: t.TempDir()})
+		for range MaxOutboxItems {
+			queueTestNotes(t, c, "note")
+		}
+
+		err := c.queueNote("notes", nil, strings.NewReader("one more"), "text/plain", "more")
+		if !errors.Is(err, ErrOutboxFull) {
+			t.Errorf("queueing past MaxOutboxItems = %v, want ErrOutboxFull", err)
+		}
+	})
+
+	t.Run("size", func(t *testing.T) {
+		c := newClient(Options{SpoolDir: t.TempDir()})
+		c.outbox = []OutboxItem{{ID: "queued", Size: MaxOutboxBytes - 4}}
+		c.outboxLoaded = true
+
+		err := c.queueNote("notes", nil, strings.NewReader("12345"), "text/plain", "too big")
+		if !errors.Is(err, ErrOutboxFull) {
+			t.Errorf("queueing past MaxOutboxBytes = %v, want ErrOutboxFull", err)
+		}
+		if err := c.queueNote("notes", nil, strings.NewReader("1234"), "text/plain", "fits"); err != nil {
+			t.Errorf("queueing up to MaxOutboxBytes = %v", err)
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package mqttclient
+
+import (
+	"bytes"
+	"desktop_client/settings"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// Pings ask one device to identify itself by flashing its tray icon and
+// playing the notification sound. A device sends a ping as a frame of type
+// PingType, directed at the target only and sent on its own ping topic, so it
+// is encrypted, signed and replay protected like any other frame. The
+// dashboard has no group key; it publishes on users/<account>/ping/dashboard
+// in an envelope the backend signs like the settings (see
+// settings.OpenSigned). Pings are never retained, and ones older than
+// maxPingAge are ignored so a resumed session does not replay them.
+const PingType = "application/x-hoppyshare-ping"
+
+type pingPayload struct {
+	Device string `json:"device"`         // device ID of the target
+	From   string `json:"from,omitempty"` // nickname of the sender, or "dashboard"
+}
+
+const maxPingAge = time.Minute
+
+// pingTopic is the filter for the pings of every device and the dashboard.
+func (c *Client) pingTopic() string {
+	return c.topic("ping/+")
+}
+
+// OnPing registers fn to run when another device or the dashboard asks this
+// device to identify itself.
+func (c *Client) OnPing(fn func(from string)) {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+	c.onPings = append(c.onPings, fn)
+}
+
+// Ping asks the device with the given ID to identify itself.
+func (c *Client) Ping(deviceID string) error {
+	cn := c.current()
+	if cn == nil || !cn.IsConnected() {
+		return errors.New("not connected")
+	}
+
+	target := hashDeviceID(deviceID)
+	c.peerCapsMu.RLock()
+	v := highestCommonVersion(c.peerCaps[target].Versions)
+	c.peerCapsMu.RUnlock()
+	if v < Version7 {
+		return ErrDirectedUnsupported
+	}
+
+	data, err := json.Marshal(pingPayload{
+		Device: deviceID,
+		From:   c.settings.Get().Nickname,
+	})
+	if err != nil {
+		return err
+	}
+
+	encoded, err := c.encodeFrame(v, 0, PingType, "", [][32]byte{target}, data)
+	if err != nil {
+		return err
+	}
+
+	opts := c.frameOptions(v, "ping", 10*time.Second)
+	opts.Expiry = maxPingAge
+	return cn.Publish(c.deviceTopic("ping"), encoded, opts)
+}
+
+func (c *Client) handlePing(m message) {
+	var (
+		p    pingPayload
+		sent time.Time
+		err  error
+	)
+	if strings.HasSuffix(m.Topic, "/dashboard") {
+		sent, err = c.openDashboardPing(m.Payload, &p)
+	} else {
+		sent, err = c.openDevicePing(m, &p)
+	}
+	if err != nil {
+		log.Printf("[PING] Dropped ping on %s: %v", m.Topic, err)
+		return
+	}
+
+	if p.Device != c.opts.DeviceID {
+		return
+	}
+
+	age := time.Since(sent)
+	if age > maxPingAge || age < -maxPingAge {
+		log.Printf("[PING] Ignoring ping from %q sent %s ago", p.From, age.Round(time.Second))
+		return
+	}
+
+	log.Printf("[PING] Pinged by %q", p.From)
+
+	c.pingMu.Lock()
+	fns := append([]func(string){}, c.onPings...)
+	c.pingMu.Unlock()
+
+	for _, fn := range fns {
+		fn(p.From)
+	}
+}
+
+// openDevicePing decodes a ping frame from the device the topic belongs to
+// into p and returns when it was sent.
+func (c *Client) openDevicePing(m message, p *pingPayload) (time.Time, error) {
+	dec, err := c.NewDecoder(bytes.NewReader(m.Payload))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !dec.Header.IsFor(c.opts.DeviceID) || dec.Header.Type != PingType {
+		return time.Time{}, errors.New("not a ping for this device")
+	}
+	if _, ok := c.topicDevice(m.Topic, hex.EncodeToString(dec.Header.DeviceID[:])); !ok {
+		return time.Time{}, errors.New("sent from another device's topic")
+	}
+
+	data, err := io.ReadAll(io.LimitReader(dec, 1024))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !c.acceptSender(dec.Verified) {
+		return time.Time{}, errors.New("sender is not verified")
+	}
+
+	return dec.Header.Sent, json.Unmarshal(data, p)
+}
+
+// openDashboardPing verifies a ping from the dashboard into p and returns
+// when it was signed. Each ping must be signed after the last one, so a
+// captured ping cannot be replayed within maxPingAge.
+func (c *Client) openDashboardPing(data []byte, p *pingPayload) (time.Time, error) {
+	payload, signed, err := settings.OpenSigned(settings.PingDomain, c.id, data)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+	if !signed.After(c.lastDashboardPing) {
+		return time.Time{}, ErrReplay
+	}
+	c.lastDashboardPing = signed
+
+	return signed, json.Unmarshal(payload, p)
+}
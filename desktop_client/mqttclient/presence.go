@@ -0,0 +1,140 @@
+package mqttclient
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Presence is the retained message every device publishes to its presence
+// topic, users/<account>/presence/<client ID>, on connect. The same topic
+// is the connection's Last Will, with Online false, so the broker marks the
+// device offline when it drops off without disconnecting. A clean disconnect
+// publishes the offline message itself.
+type Presence struct {
+	Device    string    `json:"device"`
+	Online    bool      `json:"online"`
+	Nickname  string    `json:"nickname,omitempty"`
+	Transport string    `json:"transport,omitempty"` // TransportMQTT or TransportBLE while online
+	Since     time.Time `json:"since"`               // for a Last Will, when the lost connection was made
+}
+
+// Transports a device can be reached over.
+const (
+	TransportMQTT = "mqtt"
+	TransportBLE  = "ble"
+)
+
+// selfPresence is this device's presence message.
+func (c *Client) selfPresence(online bool) (string, []byte) {
+	self := hashDeviceID(c.opts.DeviceID)
+
+	c.presenceMu.Lock()
+	p := Presence{
+		Device:   hex.EncodeToString(self[:]),
+		Online:   online,
+		Nickname: c.settings.Get().Nickname,
+		Since:    time.Now().UTC().Truncate(time.Second),
+	}
+	if online {
+		p.Transport = c.transport
+	}
+	c.presenceMu.Unlock()
+
+	data, _ := json.Marshal(p)
+	return c.deviceTopic("presence"), data
+}
+
+// presenceWill is the Last Will of every connection.
+func (c *Client) presenceWill() (string, []byte) {
+	return c.selfPresence(false)
+}
+
+// PublishPresence announces this device as online, e.g. after the nickname
+// changed.
+func (c *Client) PublishPresence() {
+	c.publishPresence(c.current())
+}
+
+func (c *Client) publishPresence(cn conn) {
+	if cn == nil || !cn.IsConnected() {
+		return
+	}
+
+	topic, data := c.selfPresence(true)
+	if err := cn.Publish(topic, data, publishOptions{Retain: true, Timeout: 10 * time.Second}); err != nil {
+		log.Printf("[PRESENCE] Could not publish presence: %v", err)
+	}
+}
+
+// publishOffline marks this device offline before a clean disconnect, which
+// does not trigger the Last Will.
+func (c *Client) publishOffline(cn conn) {
+	topic, data := c.selfPresence(false)
+	if err := cn.Publish(topic, data, publishOptions{Retain: true, Timeout: 2 * time.Second}); err != nil {
+		log.Printf("[PRESENCE] Could not publish offline presence: %v", err)
+	}
+}
+
+// SetTransport records whether this device is currently reached over MQTT or
+// BLE, and republishes its presence.
+func (c *Client) SetTransport(t string) {
+	c.presenceMu.Lock()
+	changed := c.transport != t
+	c.transport = t
+	c.presenceMu.Unlock()
+
+	if changed {
+		c.PublishPresence()
+	}
+}
+
+// PeerPresence returns the last presence message of the device with the given
+// ID, and whether one was received.
+func (c *Client) PeerPresence(deviceID string) (Presence, bool) {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+
+	p, ok := c.peerPresence[hashDeviceID(deviceID)]
+	return p, ok
+}
+
+// OnPresenceChange registers fn to run when a device's presence changes.
+func (c *Client) OnPresenceChange(fn func()) {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	c.onPresenceFns = append(c.onPresenceFns, fn)
+}
+
+func (c *Client) handlePresence(m message) {
+	c.presenceMu.Lock()
+	// An empty retained payload means the device was removed
+	if len(m.Payload) == 0 {
+		for device := range c.peerPresence {
+			if _, ok := c.topicDevice(m.Topic, hex.EncodeToString(device[:])); ok {
+				delete(c.peerPresence, device)
+			}
+		}
+	} else {
+		var p Presence
+		if err := json.Unmarshal(m.Payload, &p); err != nil {
+			c.presenceMu.Unlock()
+			log.Printf("[PRESENCE] Failed to parse %s: %v", m.Topic, err)
+			return
+		}
+		device, ok := c.topicDevice(m.Topic, p.Device)
+		if !ok {
+			c.presenceMu.Unlock()
+			log.Printf("[PRESENCE] Device %q does not match topic %s", p.Device, m.Topic)
+			return
+		}
+		c.peerPresence[device] = p
+	}
+	fns := append([]func(){}, c.onPresenceFns...)
+	c.presenceMu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
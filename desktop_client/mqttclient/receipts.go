@@ -0,0 +1,245 @@
+package mqttclient
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+)
+
+// Delivery receipts
+//
+// A device that receives a note from a sender that advertises
+// FeatureReceipts acknowledges it on the receipts topic: "delivered" once the
+// note decoded and was cached, then "copied" or "saved" when the user copies or saves it. Receipts are frames
+// like any other, encrypted with the group key and directed at the sender
+// only, with a JSON payload of type ReceiptType.
+//
+// Senders remember the receipts of the last maxSentNotes notes they sent.
+// Notes without a message ID (before V5) cannot be acknowledged.
+const ReceiptType = "application/x-hoppyshare-receipt"
+
+const maxSentNotes = 10
+
+type ReceiptStatus string
+
+const (
+	ReceiptDelivered ReceiptStatus = "delivered"
+	ReceiptCopied    ReceiptStatus = "copied"
+	ReceiptSaved     ReceiptStatus = "saved"
+)
+
+type receiptPayload struct {
+	ID     string        `json:"id"`
+	Status ReceiptStatus `json:"status"`
+}
+
+// SentNote is a note this device published, with the receipts it got so far.
+type SentNote struct {
+	ID       string
+	Filename string
+	Sent     time.Time
+	Expected int       // devices the note was sent to, not counting this one
+	Receipts []Receipt // one per device that answered, in order of arrival
+}
+
+// Receipt is the latest status one device reported for a note.
+type Receipt struct {
+	Device string // device ID, or the hex device hash if it is not in settings
+	Status ReceiptStatus
+	At     time.Time
+}
+
+func (c *Client) receiptsTopic() string {
+	return c.topic("receipts")
+}
+
+// SentNotes returns the last notes this device sent, newest first.
+func (c *Client) SentNotes() []SentNote {
+	c.sentMu.Lock()
+	defer c.sentMu.Unlock()
+
+	notes := make([]SentNote, len(c.sentNotes))
+	for i, n := range c.sentNotes {
+		notes[len(notes)-1-i] = *n
+		notes[len(notes)-1-i].Receipts = append([]Receipt(nil), n.Receipts...)
+	}
+	return notes
+}
+
+// OnReceiptsChange registers fn to run after a note is sent or a receipt
+// arrives.
+func (c *Client) OnReceiptsChange(fn func()) {
+	c.sentMu.Lock()
+	defer c.sentMu.Unlock()
+	c.onReceiptsFns = append(c.onReceiptsFns, fn)
+}
+
+func (c *Client) receiptsChanged() {
+	c.sentMu.Lock()
+	fns := append([]func(){}, c.onReceiptsFns...)
+	c.sentMu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// recordSent remembers a published note so its receipts can be shown.
+func (c *Client) recordSent(id [16]byte, filename string, to []string) {
+	expected := len(to)
+	if expected == 0 {
+		for _, d := range c.settings.DeviceIDs() {
+			if d != c.opts.DeviceID {
+				expected++
+			}
+		}
+	}
+
+	c.sentMu.Lock()
+	c.sentNotes = append(c.sentNotes, &SentNote{
+		ID:       hex.EncodeToString(id[:]),
+		Filename: filename,
+		Sent:     time.Now(),
+		Expected: expected,
+	})
+	if len(c.sentNotes) > maxSentNotes {
+		c.sentNotes = c.sentNotes[len(c.sentNotes)-maxSentNotes:]
+	}
+	c.sentMu.Unlock()
+
+	c.receiptsChanged()
+}
+
+// sendReceipt acknowledges the note with the given ID to its sender, if the
+// sender reads receipts. Receipts are best effort and never queued.
+func (c *Client) sendReceipt(sender [32]byte, version byte, id [16]byte, status ReceiptStatus) {
+	if version < Version5 || sender == hashDeviceID(c.opts.DeviceID) {
+		return
+	}
+
+	c.peerCapsMu.RLock()
+	caps := c.peerCaps[sender]
+	c.peerCapsMu.RUnlock()
+	v := highestCommonVersion(caps.Versions)
+	if v < Version7 || !caps.supports(FeatureReceipts) {
+		return
+	}
+
+	cn := c.current()
+	if cn == nil || !cn.IsConnected() {
+		return
+	}
+
+	payload, err := json.Marshal(receiptPayload{ID: hex.EncodeToString(id[:]), Status: status})
+	if err != nil {
+		return
+	}
+
+	encoded, err := c.encodeFrame(v, 0, ReceiptType, "", [][32]byte{sender}, payload)
+	if err != nil {
+		log.Printf("[RECEIPTS] Could not encode receipt: %v", err)
+		return
+	}
+
+	go func() {
+		if err := cn.Publish(c.receiptsTopic(), encoded, c.frameOptions(v, "receipt", 10*time.Second)); err != nil {
+			log.Printf("[RECEIPTS] Could not send receipt: %v", err)
+		}
+	}()
+}
+
+// ReportReceived tells the sender of the history item with the given ID that
+// it was copied or saved. Only notes received over MQTT are acknowledged.
+func (c *Client) ReportReceived(id string, status ReceiptStatus) {
+	e, ok := c.historyItem(id)
+	if !ok || e.Source != SourceMQTT {
+		return
+	}
+	c.sendReceipt(e.SenderHash, e.Version, e.MessageID, status)
+}
+
+// handleReceipt records a receipt addressed to the client's device.
+func (c *Client) handleReceipt(m message) {
+	dec, err := c.NewDecoder(bytes.NewReader(m.Payload))
+	if err != nil {
+		log.Printf("[RECEIPTS] Dropped receipt: %v", err)
+		return
+	}
+
+	if !dec.Header.IsFor(c.opts.DeviceID) || dec.Header.Type != ReceiptType {
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(dec, 1024))
+	if err != nil {
+		log.Printf("[RECEIPTS] Dropped receipt: %v", err)
+		return
+	}
+
+	if !c.acceptSender(dec.Verified) {
+		log.Printf("[RECEIPTS] Dropped unverified receipt")
+		return
+	}
+
+	var r receiptPayload
+	if err := json.Unmarshal(data, &r); err != nil {
+		log.Printf("[RECEIPTS] Bad receipt: %v", err)
+		return
+	}
+
+	switch r.Status {
+	case ReceiptDelivered, ReceiptCopied, ReceiptSaved:
+	default:
+		log.Printf("[RECEIPTS] Unknown receipt status %q", r.Status)
+		return
+	}
+
+	device := c.deviceName(dec.Header.DeviceID)
+
+	c.sentMu.Lock()
+	var note *SentNote
+	for _, n := range c.sentNotes {
+		if n.ID == r.ID {
+			note = n
+			break
+		}
+	}
+	if note == nil {
+		c.sentMu.Unlock()
+		return
+	}
+
+	updated := false
+	for i := range note.Receipts {
+		if note.Receipts[i].Device != device {
+			continue
+		}
+		// a late "delivered" must not hide a copy or save
+		if r.Status != ReceiptDelivered {
+			note.Receipts[i].Status = r.Status
+			note.Receipts[i].At = time.Now()
+		}
+		updated = true
+	}
+	if !updated {
+		note.Receipts = append(note.Receipts, Receipt{Device: device, Status: r.Status, At: time.Now()})
+	}
+	c.sentMu.Unlock()
+
+	log.Printf("[RECEIPTS] %s %s on %s", note.Filename, r.Status, device)
+	c.receiptsChanged()
+}
+
+// deviceName returns the ID of the device with the given hash if it is in
+// this Client's settings, or the hash otherwise.
+func (c *Client) deviceName(hash [32]byte) string {
+	for _, id := range c.settings.DeviceIDs() {
+		if hashDeviceID(id) == hash {
+			return id
+		}
+	}
+	return hex.EncodeToString(hash[:])
+}
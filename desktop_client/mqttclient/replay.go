@@ -0,0 +1,265 @@
+package mqttclient
+
+import (
+	"desktop_client/config"
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Replay protection (V5)
+//
+// V5 headers carry a random message ID and the time the frame was sent, both
+// authenticated along with the rest of the header. A frame is accepted once:
+// its ID is remembered after the body authenticates, and frames sent outside
+// ReplayWindow of the local clock are rejected because their IDs may already
+// have been forgotten. The same cache is shared by MQTT and BLE, so a message
+// that arrives over both is only delivered the first time.
+//
+// A device that keeps a persistent session on the broker (see offline.go)
+// receives notes that waited there for up to its offline TTL, so its window
+// for past timestamps widens to that TTL and the cache is kept on disk,
+// sealed with the local storage key, so restarts inside the window do not
+// forget what was already delivered.
+//
+// Older frames carry neither field, and are deduplicated by the SHA-256 of
+// the frame up to any signature trailer instead. Frames are sealed with a
+// random nonce, so two sends of the same note never collide, while a copy of
+// a frame always does. Only the last replayCacheSize digests are kept, in
+// memory, so such a frame can be replayed once it was forgotten or after a
+// restart; V5 frames are needed for anything stronger, and Android only sends
+// V0.
+const (
+	ReplayWindow    = 10 * time.Minute
+	replayCacheSize = 4096
+)
+
+var (
+	// ErrReplay means a frame with the same message ID was already received.
+	ErrReplay = errors.New("message already received")
+
+	// ErrStale means a frame was sent too long ago, or too far in the
+	// future, to be checked against the replay cache.
+	ErrStale = errors.New("message timestamp outside replay window")
+)
+
+type replayEntry struct {
+	id   [16]byte
+	sent time.Time
+}
+
+// replayCache remembers the IDs of recently received frames. Once it holds
+// replayCacheSize entries the oldest one is evicted and its send time becomes
+// the floor below which frames are rejected, so an evicted ID can never be
+// accepted again.
+type replayCache struct {
+	mu      sync.Mutex
+	seen    map[[16]byte]struct{}
+	entries []replayEntry
+	digests map[[32]byte]struct{} // of frames older than V5, see recordDigest
+	order   [][32]byte            // digests, oldest first
+	floor   time.Time
+	window  time.Duration // how old a frame may be, never less than ReplayWindow
+	path    string        // saved there after every record, empty to keep it in memory
+	saving  *time.Timer
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{
+		seen:    make(map[[16]byte]struct{}),
+		digests: make(map[[32]byte]struct{}),
+	}
+}
+
+// check reports whether a frame with header h could still be accepted
+// without recording it. Frames older than V5 are only checked once their
+// digest is known, by recordDigest.
+func (c *replayCache) check(h Header) error {
+	if h.Version < Version5 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checkLocked(h, time.Now())
+}
+
+// record marks the frame with header h as received. It fails if the frame
+// was already recorded or is outside the replay window.
+func (c *replayCache) record(h Header) error {
+	if h.Version < Version5 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if err := c.checkLocked(h, now); err != nil {
+		return err
+	}
+
+	c.expireLocked(now)
+	if len(c.entries) >= replayCacheSize {
+		c.evictLocked()
+	}
+
+	c.seen[h.MessageID] = struct{}{}
+	c.entries = append(c.entries, replayEntry{id: h.MessageID, sent: h.Sent})
+	c.scheduleSaveLocked()
+	return nil
+}
+
+// recordDigest marks a frame older than V5 with the given digest as
+// received. It fails if a frame with the same digest was recorded already.
+func (c *replayCache) recordDigest(digest [32]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.digests[digest]; ok {
+		return ErrReplay
+	}
+
+	if len(c.order) >= replayCacheSize {
+		delete(c.digests, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.digests[digest] = struct{}{}
+	c.order = append(c.order, digest)
+	return nil
+}
+
+// maxAgeLocked is how long ago a frame may have been sent.
+func (c *replayCache) maxAgeLocked() time.Duration {
+	return max(c.window, ReplayWindow)
+}
+
+func (c *replayCache) checkLocked(h Header, now time.Time) error {
+	if h.Sent.Before(now.Add(-c.maxAgeLocked())) || h.Sent.After(now.Add(ReplayWindow)) {
+		return ErrStale
+	}
+	if !h.Sent.After(c.floor) {
+		return ErrStale
+	}
+	if _, ok := c.seen[h.MessageID]; ok {
+		return ErrReplay
+	}
+	return nil
+}
+
+// expireLocked forgets entries that fell out of the replay window, since
+// checkLocked rejects those frames by timestamp anyway.
+func (c *replayCache) expireLocked(now time.Time) {
+	cutoff := now.Add(-c.maxAgeLocked())
+	for len(c.entries) > 0 && c.entries[0].sent.Before(cutoff) {
+		delete(c.seen, c.entries[0].id)
+		c.entries = c.entries[1:]
+	}
+}
+
+func (c *replayCache) evictLocked() {
+	oldest := c.entries[0]
+	delete(c.seen, oldest.id)
+	c.entries = c.entries[1:]
+
+	if oldest.sent.After(c.floor) {
+		c.floor = oldest.sent
+	}
+}
+
+// setWindow widens the accepted age of frames to window, and starts keeping
+// the cache at path unless it is empty. The cache saved there by a previous
+// run is loaded first.
+func (c *replayCache) setWindow(window time.Duration, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path == "" && path != "" {
+		c.path = path
+		c.loadLocked()
+	}
+	c.window = window
+}
+
+// replayPath is where the client keeps its replay cache.
+func (c *Client) replayPath() (string, error) {
+	dir, err := c.spoolDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "replay"), nil
+}
+
+var replayAAD = []byte("replay")
+
+// loadLocked merges the cache saved by a previous run. Callers must hold
+// c.mu.
+func (c *replayCache) loadLocked() {
+	sealed, err := os.ReadFile(c.path)
+	if err != nil {
+		return
+	}
+	data, err := config.OpenLocal(sealed, replayAAD)
+	if err != nil {
+		log.Printf("[REPLAY] Ignoring saved cache: %v", err)
+		return
+	}
+
+	// floor int64 | (id [16] | sent int64)...
+	if len(data) < 8 || (len(data)-8)%24 != 0 {
+		return
+	}
+
+	if n := int64(binary.BigEndian.Uint64(data)); n != 0 {
+		if floor := time.Unix(0, n); floor.After(c.floor) {
+			c.floor = floor
+		}
+	}
+	for rest := data[8:]; len(rest) > 0; rest = rest[24:] {
+		var e replayEntry
+		copy(e.id[:], rest[:16])
+		e.sent = time.Unix(0, int64(binary.BigEndian.Uint64(rest[16:24])))
+
+		if _, ok := c.seen[e.id]; !ok {
+			c.seen[e.id] = struct{}{}
+			c.entries = append(c.entries, e)
+		}
+	}
+}
+
+// scheduleSaveLocked saves the cache shortly, so a burst of frames costs one
+// write. Callers must hold c.mu.
+func (c *replayCache) scheduleSaveLocked() {
+	if c.path == "" || c.saving != nil {
+		return
+	}
+
+	c.saving = time.AfterFunc(time.Second, func() {
+		c.mu.Lock()
+		c.saving = nil
+		c.expireLocked(time.Now())
+
+		data := make([]byte, 8, 8+24*len(c.entries))
+		if !c.floor.IsZero() {
+			binary.BigEndian.PutUint64(data, uint64(c.floor.UnixNano()))
+		}
+		for _, e := range c.entries {
+			data = append(data, e.id[:]...)
+			data = binary.BigEndian.AppendUint64(data, uint64(e.sent.UnixNano()))
+		}
+		path := c.path
+		c.mu.Unlock()
+
+		sealed, err := config.SealLocal(data, replayAAD)
+		if err == nil {
+			err = os.WriteFile(path, sealed, 0o600)
+		}
+		if err != nil {
+			log.Printf("[REPLAY] Could not save cache: %v", err)
+		}
+	})
+}
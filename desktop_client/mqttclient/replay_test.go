@@ -0,0 +1,191 @@
+package mqttclient
+
+import (
+	"desktop_client/internal/testkeys"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zalando/go-keyring"
+)
+
+func replayHeader(id byte, sent time.Time) Header {
+	h := Header{Version: Version5, Sent: sent}
+	h.MessageID[0] = id
+	return h
+}
+
+func TestReplayCacheRecord(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		window time.Duration
+		before []Header
+		h      Header
+		want   error
+	}{
+		{"fresh", 0, nil, replayHeader(1, now), nil},
+		{"same ID", 0, []Header{replayHeader(1, now)}, replayHeader(1, now), ErrReplay},
+		{"same ID, other time", 0, []Header{replayHeader(1, now)}, replayHeader(1, now.Add(time.Second)), ErrReplay},
+		{"other ID", 0, []Header{replayHeader(1, now)}, replayHeader(2, now), nil},
+		{"too old", 0, nil, replayHeader(1, now.Add(-ReplayWindow-time.Minute)), ErrStale},
+		{"too far ahead", 0, nil, replayHeader(1, now.Add(ReplayWindow+time.Minute)), ErrStale},
+		{"inside widened window", time.Hour, nil, replayHeader(1, now.Add(-30*time.Minute)), nil},
+		{"outside widened window", time.Hour, nil, replayHeader(1, now.Add(-2*time.Hour)), ErrStale},
+		{"narrower window than ReplayWindow", time.Minute, nil, replayHeader(1, now.Add(-5*time.Minute)), nil},
+		{"before V5", 0, []Header{{Version: Version4}}, Header{Version: Version4}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newReplayCache()
+			c.setWindow(tt.window, "")
+
+			for _, h := range tt.before {
+				if err := c.record(h); err != nil {
+					t.Fatalf("recording %x: %v", h.MessageID, err)
+				}
+			}
+
+			if err := c.check(tt.h); !errors.Is(err, tt.want) {
+				t.Errorf("check = %v, want %v", err, tt.want)
+			}
+			if err := c.record(tt.h); !errors.Is(err, tt.want) {
+				t.Errorf("record = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayCacheEviction(t *testing.T) {
+	c := newReplayCache()
+	start := time.Now().Add(-time.Minute)
+
+	sent := func(i int) time.Time { return start.Add(time.Duration(i) * time.Millisecond) }
+	header := func(i int) Header {
+		h := Header{Version: Version5, Sent: sent(i)}
+		h.MessageID[0], h.MessageID[1] = byte(i>>8), byte(i)
+		h.MessageID[2] = 1
+		return h
+	}
+
+	for i := range replayCacheSize + 1 {
+		if err := c.record(header(i)); err != nil {
+			t.Fatalf("recording %d: %v", i, err)
+		}
+	}
+
+	// the first entry was evicted and its send time is the floor now
+	tests := []struct {
+		name string
+		h    Header
+		want error
+	}{
+		{"evicted ID", header(0), ErrStale},
+		{"new ID at the floor", replayHeader(0xff, sent(0)), ErrStale},
+		{"new ID before the floor", replayHeader(0xff, sent(-1)), ErrStale},
+		{"new ID after the floor", replayHeader(0xff, sent(1)), nil},
+		{"kept ID", header(1), ErrReplay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.check(tt.h); !errors.Is(err, tt.want) {
+				t.Errorf("check = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayCacheDigests(t *testing.T) {
+	c := newReplayCache()
+
+	digest := func(i int) [32]byte {
+		var d [32]byte
+		d[0], d[1] = byte(i>>8), byte(i)
+		return d
+	}
+
+	if err := c.recordDigest(digest(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.recordDigest(digest(0)); !errors.Is(err, ErrReplay) {
+		t.Fatalf("second record = %v, want ErrReplay", err)
+	}
+
+	for i := 1; i <= replayCacheSize; i++ {
+		if err := c.recordDigest(digest(i)); err != nil {
+			t.Fatalf("recording %d: %v", i, err)
+		}
+	}
+
+	// only the last replayCacheSize digests are remembered
+	if err := c.recordDigest(digest(0)); err != nil {
+		t.Errorf("record after eviction = %v, want nil", err)
+	}
+	if err := c.recordDigest(digest(replayCacheSize)); !errors.Is(err, ErrReplay) {
+		t.Errorf("record of a kept digest = %v, want ErrReplay", err)
+	}
+}
+
+func TestReplayCachePersisted(t *testing.T) {
+	keyring.MockInit()
+	path := filepath.Join(t.TempDir(), "replay")
+	h := replayHeader(1, time.Now())
+
+	c := newReplayCache()
+	c.setWindow(time.Hour, path)
+	if err := c.record(h); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache was not saved")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	restarted := newReplayCache()
+	restarted.setWindow(time.Hour, path)
+	if err := restarted.record(h); !errors.Is(err, ErrReplay) {
+		t.Errorf("record after restart = %v, want ErrReplay", err)
+	}
+}
+
+func TestDecodeRejectsCopies(t *testing.T) {
+	testkeys.Install(t)
+
+	for _, version := range SupportedVersions {
+		t.Run("v"+string('0'+rune(version)), func(t *testing.T) {
+			resetReplays()
+
+			frame, err := EncodeMessageVersion(version, "text/plain", "note.txt", []byte("hoppy"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := DecodeMessage(frame); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := DecodeMessage(frame); !errors.Is(err, ErrReplay) {
+				t.Fatalf("decoding a copy = %v, want ErrReplay", err)
+			}
+
+			// the same note sent again is a different frame
+			again, err := EncodeMessageVersion(version, "text/plain", "note.txt", []byte("hoppy"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := DecodeMessage(again); err != nil {
+				t.Errorf("decoding the note sent again = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package mqttclient
+
+import (
+	"desktop_client/settings"
+	"encoding/hex"
+)
+
+// receiveFor applies the receive rules of this Client's settings (see
+// settings.ApplyReceiveRules) to a note from the device with the given hash.
+func (c *Client) receiveFor(sender [32]byte, contentType string) settings.Receive {
+	return settings.ApplyReceiveRules(c.settings.ReceiveRules(), c.settings.Get(), hex.EncodeToString(sender[:]), contentType)
+}
+
+// AcceptNote reports whether the receive rules let a decoded note in.
+func (c *Client) AcceptNote(d *DecodedPayload) bool {
+	return c.receiveFor(d.DeviceID, d.Type).Accepts(int64(len(d.Payload)))
+}
@@ -0,0 +1,182 @@
+package mqttclient
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"desktop_client/config"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// cryptoSession holds the unwrapped group keys and the parsed device key of
+// a Client, so RSA-OAEP and PEM parsing run once per key instead of once per
+// message.
+//
+// A cached group key is dropped as soon as the keyring no longer returns the
+// same wrapped key for its ID, which covers rotation and retirement.
+// Everything is dropped by Client.CloseSession, which also runs on the
+// default client when config clears its keys on uninstall or shutdown.
+//
+// Dropped group keys are zeroed, and so are the exported numbers of the
+// parsed device key, once no Encoder signs with it anymore. That is our copy
+// only: the AES key schedule inside each AEAD, and the copy of the device key
+// crypto/rsa and crypto/ecdsa derive the first time it signs, live inside the
+// standard library and cannot be reached from Go. Dropping them and leaving
+// them to the garbage collector is as close as it gets.
+type cryptoSession struct {
+	keyPEM    []byte // device key, wraps the group keys
+	groupKeys GroupKeyring
+
+	mu     sync.Mutex
+	keys   map[uint32]*sessionKey
+	signer *sessionSigner
+}
+
+type sessionKey struct {
+	wrapped []byte // as returned by the keyring, to notice a changed key
+	key     []byte
+	aead    cipher.AEAD
+}
+
+// sessionSigner is the parsed device key, shared by every Encoder signing
+// with it.
+type sessionSigner struct {
+	crypto.Signer
+	users  int  // Encoders that have not been closed yet
+	closed bool // dropped by the session, zeroed once users is 0
+}
+
+func newCryptoSession(keyPEM []byte, groupKeys GroupKeyring) *cryptoSession {
+	return &cryptoSession{
+		keyPEM:    keyPEM,
+		groupKeys: groupKeys,
+		keys:      make(map[uint32]*sessionKey),
+	}
+}
+
+// CloseSession zeroes and forgets every cached key. The next message unwraps
+// its key again.
+func (c *Client) CloseSession() {
+	c.session.close()
+}
+
+func (s *cryptoSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, k := range s.keys {
+		clear(k.key)
+		delete(s.keys, id)
+	}
+	if s.signer != nil {
+		s.signer.closed = true
+		if s.signer.users == 0 {
+			zeroSigner(s.signer.Signer)
+		}
+		s.signer = nil
+	}
+}
+
+// zeroSigner overwrites the exported secret values of a parsed private key.
+// The signer must not be used afterwards.
+func zeroSigner(signer crypto.Signer) {
+	switch k := signer.(type) {
+	case *rsa.PrivateKey:
+		zeroInt(k.D)
+		for _, p := range k.Primes {
+			zeroInt(p)
+		}
+		zeroInt(k.Precomputed.Dp)
+		zeroInt(k.Precomputed.Dq)
+		zeroInt(k.Precomputed.Qinv)
+		for _, v := range k.Precomputed.CRTValues {
+			zeroInt(v.Exp)
+			zeroInt(v.Coeff)
+			zeroInt(v.R)
+		}
+	case *ecdsa.PrivateKey:
+		zeroInt(k.D)
+	case ed25519.PrivateKey:
+		clear(k)
+	}
+}
+
+// zeroInt overwrites the words of n before setting it to zero, which alone
+// would only shorten the slice.
+func zeroInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	clear(n.Bits())
+	n.SetInt64(0)
+}
+
+// aead returns the AES-GCM AEAD for the group key with the given ID.
+func (s *cryptoSession) aead(keyID uint32) (cipher.AEAD, error) {
+	entry, err := s.groupKeys.Lookup(keyID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cached, ok := s.keys[keyID]
+	if ok && (err != nil || !bytes.Equal(cached.wrapped, entry.Key)) {
+		clear(cached.key)
+		delete(s.keys, keyID)
+		ok = false
+	}
+	if err != nil {
+		return nil, fmt.Errorf("group key %d: %w", keyID, err)
+	}
+	if ok {
+		return cached.aead, nil
+	}
+
+	groupKey, aead, err := config.UnwrapGroupKey(entry.Key, s.keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	s.keys[keyID] = &sessionKey{
+		wrapped: append([]byte(nil), entry.Key...),
+		key:     groupKey,
+		aead:    aead,
+	}
+
+	return aead, nil
+}
+
+// acquireSigner returns the private key of the device's mTLS certificate.
+// It stays usable, even if the session closes, until it is passed to
+// releaseSigner.
+func (s *cryptoSession) acquireSigner() (*sessionSigner, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.signer == nil {
+		signer, err := parseDeviceSigner(s.keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		s.signer = &sessionSigner{Signer: signer}
+	}
+
+	s.signer.users++
+	return s.signer, nil
+}
+
+// releaseSigner gives back a signer from acquireSigner, and zeroes it if the
+// session closed meanwhile and nobody else uses it.
+func (s *cryptoSession) releaseSigner(signer *sessionSigner) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	signer.users--
+	if signer.closed && signer.users == 0 {
+		zeroSigner(signer.Signer)
+	}
+}
@@ -0,0 +1,154 @@
+package mqttclient
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"desktop_client/internal/testkeys"
+	"math/big"
+	"testing"
+)
+
+func TestCloseSessionZeroesKeys(t *testing.T) {
+	testkeys.Install(t)
+	session := defaultClient().session
+
+	if _, err := session.aead(0); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := session.acquireSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.releaseSigner(signer)
+	secrets := rsaSecrets(signer.Signer.(*rsa.PrivateKey))
+
+	session.mu.Lock()
+	key := session.keys[0].key
+	session.mu.Unlock()
+
+	CloseSession()
+
+	for _, b := range key {
+		if b != 0 {
+			t.Fatal("group key not zeroed")
+		}
+	}
+	for i, n := range secrets {
+		if n.Sign() != 0 {
+			t.Errorf("secret value %d of the device key not zeroed", i)
+		}
+	}
+	if session.signer != nil {
+		t.Fatal("session still holds the device key")
+	}
+	if len(session.keys) != 0 {
+		t.Fatal("session still holds keys")
+	}
+}
+
+func TestCloseSessionWhileEncoding(t *testing.T) {
+	testkeys.Install(t)
+	c := defaultClient()
+
+	h, err := c.newHeader(CurrentVersion, 0, "text/plain", "note.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	enc, err := c.NewEncoder(buf, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := enc.signer.Signer.(*rsa.PrivateKey)
+	public := key.PublicKey
+
+	if _, err := enc.Write([]byte("hoppy")); err != nil {
+		t.Fatal(err)
+	}
+
+	CloseSession()
+	if key.D.Sign() == 0 {
+		t.Fatal("device key zeroed while an Encoder uses it")
+	}
+
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range rsaSecrets(key) {
+		if n.Sign() != 0 {
+			t.Errorf("secret value %d of the device key not zeroed after the Encoder closed", i)
+		}
+	}
+
+	// the trailer is the length of the signature and the signature
+	frame := buf.Bytes()
+	sigLen := public.Size()
+	signed := frame[:len(frame)-2-sigLen]
+	digest := sha256.Sum256(signed)
+	opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+	if err := rsa.VerifyPSS(&public, crypto.SHA256, digest[:], frame[len(frame)-sigLen:], opts); err != nil {
+		t.Errorf("signature made across CloseSession: %v", err)
+	}
+}
+
+// rsaSecrets returns the secret numbers of an RSA key.
+func rsaSecrets(k *rsa.PrivateKey) []*big.Int {
+	secrets := []*big.Int{k.D, k.Precomputed.Dp, k.Precomputed.Dq, k.Precomputed.Qinv}
+	return append(secrets, k.Primes...)
+}
+
+// The Uncached benchmarks close the session before every message, which is
+// what every message cost before the session existed.
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	benchmarkEncodeMessage(b, false)
+}
+
+func BenchmarkEncodeMessageUncached(b *testing.B) {
+	benchmarkEncodeMessage(b, true)
+}
+
+func BenchmarkDecodeMessage(b *testing.B) {
+	benchmarkDecodeMessage(b, false)
+}
+
+func BenchmarkDecodeMessageUncached(b *testing.B) {
+	benchmarkDecodeMessage(b, true)
+}
+
+func benchmarkEncodeMessage(b *testing.B, uncached bool) {
+	testkeys.Install(b)
+	payload := make([]byte, 1024)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if uncached {
+			CloseSession()
+		}
+		if _, err := EncodeMessageVersion(CurrentVersion, "text/plain", "note.txt", payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDecodeMessage(b *testing.B, uncached bool) {
+	testkeys.Install(b)
+	frame, err := EncodeMessageVersion(CurrentVersion, "text/plain", "note.txt", make([]byte, 1024))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if uncached {
+			CloseSession()
+		}
+		resetReplays()
+		if _, err := DecodeMessage(frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package mqttclient
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Signed frames (V4)
+//
+// A frame with FlagSigned ends in a trailer after its final stream segment:
+//
+//	sigLen uint16 | signature
+//
+// The signature covers sha256 of every frame byte before the trailer and is
+// made with the device's mTLS key. Receivers learn each device's certificate
+// from its capabilities message and only use it if it chains to the broker
+// CA, belongs to the account and names the device: the backend binds the
+// device ID into every certificate it issues, as the URI SAN
+// urn:hoppyshare:device:<device ID>. Another device on the account can
+// advertise its own certificate for the device, but cannot sign as it.
+// Certificates issued before the ID was bound name no device, and frames
+// signed with them stay unverified.
+
+// ErrBadSignature means a frame was signed with a key other than the one
+// its sending device advertised. It wraps ErrAuth.
+var ErrBadSignature = fmt.Errorf("%w: message signature does not match sender", ErrAuth)
+
+// deviceURIPrefix starts the URI SAN that binds a certificate to a device.
+const deviceURIPrefix = "hoppyshare:device:"
+
+// parseDeviceSigner parses the private key of a device's mTLS certificate.
+// Use cryptoSession.acquireSigner, which caches it.
+func parseDeviceSigner(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("failed to parse PEM block")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, errors.New("private key cannot sign")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func signDigest(signer crypto.Signer, digest []byte) ([]byte, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(*rsa.PublicKey); ok {
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	}
+	return signer.Sign(rand.Reader, digest, opts)
+}
+
+func verifyDigest(cert *x509.Certificate, digest, sig []byte) error {
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPSS(pub, crypto.SHA256, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			return ErrBadSignature
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// senderCert returns the certificate of a device, or nil if the device has
+// not advertised one yet.
+func (c *Client) senderCert(deviceHash [32]byte) *x509.Certificate {
+	if deviceHash == hashDeviceID(c.opts.DeviceID) {
+		if cert, err := parseCert(c.opts.CertPEM); err == nil {
+			return cert
+		}
+	}
+
+	c.peerCertsMu.RLock()
+	defer c.peerCertsMu.RUnlock()
+	return c.peerCerts[deviceHash]
+}
+
+// registerPeerCert records the certificate a device advertised, after
+// checking it was issued by the broker CA for the client's account and for
+// the device itself.
+func (c *Client) registerPeerCert(deviceHash [32]byte, certPEM []byte) error {
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(c.opts.CAPEM) {
+		return errors.New("no CA certificate loaded")
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("certificate not issued by broker CA: %w", err)
+	}
+	if cert.Subject.CommonName != c.id {
+		return fmt.Errorf("certificate belongs to %q", cert.Subject.CommonName)
+	}
+	if !certNamesDevice(cert, deviceHash) {
+		return errors.New("certificate was not issued for this device")
+	}
+
+	c.peerCertsMu.Lock()
+	defer c.peerCertsMu.Unlock()
+
+	c.peerCerts[deviceHash] = cert
+	return nil
+}
+
+// certNamesDevice reports whether cert carries the device URI SAN of the
+// device with the given hash.
+func certNamesDevice(cert *x509.Certificate, deviceHash [32]byte) bool {
+	for _, u := range cert.URIs {
+		id, ok := strings.CutPrefix(u.Opaque, deviceURIPrefix)
+		if u.Scheme == "urn" && ok && hashDeviceID(id) == deviceHash {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptSender reports whether a message with the given verification state
+// should be shown, according to the RequireSigned setting.
+func (c *Client) acceptSender(verified bool) bool {
+	return verified || !c.settings.Get().RequireSigned
+}
+
+func parseCert(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("failed to parse certificate PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,311 @@
+package mqttclient
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/sha256"
+	"desktop_client/config"
+	"desktop_client/internal/stream"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Segmented stream bodies (V3)
+//
+// A V3 body is a segmented stream (see internal/stream) sealed with the group
+// key and the frame header as additional data. Signed frames carry their
+// signature trailer right after the final segment.
+const (
+	SegmentSize     = stream.SegmentSize
+	segmentOverhead = 4 + 16
+)
+
+// Encoder writes a V3 frame: the header, then the plaintext written to it as
+// sealed segments. Close must be called to write the final segment, and also
+// when giving up on the frame, to release the device key.
+type Encoder struct {
+	body    *stream.Writer
+	out     io.Writer
+	session *cryptoSession
+	signer  *sessionSigner
+	hash    hash.Hash
+	closed  bool
+}
+
+// NewEncoder writes the frame header for h to w and returns an Encoder for
+// the body, sealed with the client's group key and signed with its device
+// key. h.Version must be Version3 or later.
+func (c *Client) NewEncoder(w io.Writer, h Header) (*Encoder, error) {
+	if h.Version < Version3 {
+		return nil, fmt.Errorf("frame version %d cannot be streamed", h.Version)
+	}
+
+	header, err := h.marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := c.session.aead(h.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Encoder{out: w, session: c.session}
+
+	if h.Flags&FlagSigned != 0 {
+		if e.signer, err = c.session.acquireSigner(); err != nil {
+			return nil, err
+		}
+		e.hash = sha256.New()
+		w = io.MultiWriter(w, e.hash)
+	}
+
+	if _, err := w.Write(header); err != nil {
+		e.release()
+		return nil, err
+	}
+
+	if e.body, err = stream.NewWriter(w, aead, header); err != nil {
+		e.release()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *Encoder) Write(p []byte) (int, error) {
+	return e.body.Write(p)
+}
+
+// Close seals and writes the final segment, followed by the signature
+// trailer for signed frames. It does not close the underlying writer.
+func (e *Encoder) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	defer e.release()
+
+	if err := e.body.Close(); err != nil {
+		return err
+	}
+
+	if e.signer == nil {
+		return nil
+	}
+
+	sig, err := signDigest(e.signer, e.hash.Sum(nil))
+	if err != nil {
+		return err
+	}
+
+	trailer := make([]byte, 2, 2+len(sig))
+	binary.BigEndian.PutUint16(trailer, uint16(len(sig)))
+	_, err = e.out.Write(append(trailer, sig...))
+	return err
+}
+
+func (e *Encoder) release() {
+	if e.signer != nil {
+		e.session.releaseSigner(e.signer)
+		e.signer = nil
+	}
+}
+
+// Decoder reads a frame of any version. Header is available as soon as
+// NewDecoder returns; Read returns the decrypted body. Stream bodies are
+// decrypted one segment at a time, older bodies all at once.
+//
+// Verified is set once the body has been read to EOF if the frame was signed
+// by the certificate issued for its sender. A signature made with any other
+// key is an error; a signed frame from a device whose certificate is not
+// known yet just stays unverified.
+//
+// V5 frames that were already received, or sent outside the replay window,
+// fail with ErrReplay or ErrStale: before the body is read if possible, and
+// otherwise once it has authenticated.
+type Decoder struct {
+	Header   Header
+	Verified bool
+
+	client *Client
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	stream *stream.Reader
+	plain  []byte
+	hash   hash.Hash
+	done   bool
+	err    error
+}
+
+// NewDecoder reads the frame header from r and returns a Decoder for the
+// body, checked against the client's replay cache and peer certificates.
+func (c *Client) NewDecoder(r io.Reader) (*Decoder, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	h, header, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.replays.check(h); err != nil {
+		return nil, err
+	}
+
+	aead, err := c.session.aead(h.KeyID)
+	if errors.Is(err, config.ErrUnknownGroupKey) {
+		return nil, fmt.Errorf("%w: %w", ErrAuth, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Decoder{
+		Header: h,
+		client: c,
+		r:      br,
+		aead:   aead,
+		header: header,
+	}
+
+	// signed frames are verified against the hash, and frames older than
+	// V5 are recorded in the replay cache by it
+	if h.Flags&FlagSigned != 0 || h.Version < Version5 {
+		d.hash = sha256.New()
+		d.hash.Write(header)
+	}
+
+	if h.Version >= Version3 {
+		var body io.Reader = br
+		if d.hash != nil {
+			body = io.TeeReader(br, d.hash)
+		}
+		if d.stream, err = stream.NewReader(body, aead, header); err != nil {
+			return nil, ErrTruncated
+		}
+	}
+
+	return d, nil
+}
+
+func (d *Decoder) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+
+		if d.Header.Version >= Version3 {
+			d.err = d.nextSegment()
+		} else {
+			d.err = d.readSealed()
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// readSealed decrypts a V0-V2 body, which is one sealed message running to
+// the end of the frame.
+func (d *Decoder) readSealed() error {
+	nonce := make([]byte, d.aead.NonceSize())
+	if _, err := io.ReadFull(d.r, nonce); err != nil {
+		return ErrTruncated
+	}
+
+	ciphertext, err := io.ReadAll(d.r)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := d.aead.Open(nil, nonce, ciphertext, d.header)
+	if err != nil {
+		return ErrAuth
+	}
+
+	d.hash.Write(nonce)
+	d.hash.Write(ciphertext)
+	if err := d.recordReplay(); err != nil {
+		return err
+	}
+
+	d.plain = plaintext
+	d.done = true
+	return nil
+}
+
+func (d *Decoder) nextSegment() error {
+	plaintext, last, err := d.stream.Next()
+	switch {
+	case errors.Is(err, stream.ErrAuth):
+		return ErrAuth
+	case errors.Is(err, stream.ErrLength):
+		return fmt.Errorf("%w: %w", ErrBadHeader, err)
+	case err != nil:
+		return ErrTruncated
+	}
+
+	if last && d.Header.Flags&FlagSigned != 0 {
+		if err := d.verifyTrailer(); err != nil {
+			return err
+		}
+	}
+
+	// Only an authenticated frame may claim its message ID
+	if last {
+		if err := d.recordReplay(); err != nil {
+			return err
+		}
+	}
+
+	d.plain = plaintext
+	d.done = last
+	return nil
+}
+
+// recordReplay records the authenticated frame in the client's replay cache,
+// by its message ID or, before V5, by its digest.
+func (d *Decoder) recordReplay() error {
+	if d.Header.Version >= Version5 {
+		return d.client.replays.record(d.Header)
+	}
+
+	var digest [32]byte
+	d.hash.Sum(digest[:0])
+	return d.client.replays.recordDigest(digest)
+}
+
+func (d *Decoder) verifyTrailer() error {
+	var length [2]byte
+	if _, err := io.ReadFull(d.r, length[:]); err != nil {
+		return ErrTruncated
+	}
+
+	sig := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(d.r, sig); err != nil {
+		return ErrTruncated
+	}
+
+	cert := d.client.senderCert(d.Header.DeviceID)
+	if cert == nil {
+		return nil
+	}
+
+	if err := verifyDigest(cert, d.hash.Sum(nil), sig); err != nil {
+		return ErrBadSignature
+	}
+
+	d.Verified = true
+	return nil
+}
@@ -0,0 +1,796 @@
+package mqttclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"desktop_client/config"
+	"desktop_client/notification"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Large transfers
+//
+// Anything bigger than MaxMessageSize is sent as a transfer on the notes
+// topic: one FlagManifest frame describing the file, then one FlagPart frame
+// per PartSize slice. Receivers seal each part into the spool as it arrives
+// (see config.SealLocal) and send the sender a FlagResend frame listing what
+// is missing, both when the sender goes quiet and after every reconnect.
+// Senders keep the source file around for transferLifetime so they can answer
+// those requests, even across restarts, but only from the devices the
+// transfer was sent to.
+const (
+	MaxMessageSize  = 25 * 1024 * 1024
+	MaxTransferSize = 4 * 1024 * 1024 * 1024
+	PartSize        = 4 * 1024 * 1024
+
+	// The watchdog blocks a user after 30 notes in 10 seconds
+	partInterval = 500 * time.Millisecond
+
+	resendAfter       = 15 * time.Second
+	maxResendAttempts = 5
+	reconnectWait     = 10 * time.Minute
+	transferLifetime  = 24 * time.Hour
+
+	// Manifests beyond these limits are refused until pending transfers
+	// finish or expire
+	maxIncomingTransfers = 8
+	maxIncomingBytes     = MaxTransferSize
+)
+
+// ErrTransfersUnsupported means some device on the account predates V2 frames
+// and could not reassemble a transfer.
+var ErrTransfersUnsupported = errors.New("not every device supports multi-part transfers")
+
+type Manifest struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Type     string `json:"type"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part_size"`
+	Parts    int    `json:"parts"`
+	SHA256   string `json:"sha256"`
+}
+
+type resendRequest struct {
+	ID      string `json:"id"`
+	Missing []int  `json:"missing"`
+}
+
+type outgoingTransfer struct {
+	Manifest Manifest  `json:"manifest"`
+	Topic    string    `json:"topic"`
+	Path     string    `json:"path"`
+	Owned    bool      `json:"owned"` // Path lives in the spool dir and is removed with the transfer
+	To       []string  `json:"to,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+type incomingTransfer struct {
+	Manifest Manifest `json:"manifest"`
+	Topic    string   `json:"topic"`
+	Sender   [32]byte `json:"sender"`
+	Verified bool     `json:"verified"`
+	Received []int    `json:"received"`
+
+	// of the manifest frame, for receipts
+	Version   byte     `json:"version"`
+	MessageID [16]byte `json:"message_id"`
+
+	Created time.Time `json:"created"`
+
+	have     map[int]bool
+	timer    *time.Timer
+	attempts int
+}
+
+// spoolDir returns (and creates) a directory under the client's spool, where
+// received messages and transfer state are kept on disk.
+func (c *Client) spoolDir(sub ...string) (string, error) {
+	base := c.opts.SpoolDir
+	if base == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(cache, "HoppyShare", "spool")
+	}
+
+	dir := filepath.Join(append([]string{base}, sub...)...)
+	return dir, os.MkdirAll(dir, 0o700)
+}
+
+// PublishTransfer sends the file at path as a multi-part transfer to the
+// devices in to, or to every device if to is empty, and blocks until every
+// part has been published once.
+func (c *Client) PublishTransfer(to []string, path, contentType, filename string) error {
+	return c.publishTransfer(c.topic("notes"), to, path, contentType, filename, false)
+}
+
+// PublishTransferData spools data to disk and sends it as a multi-part
+// transfer. The spooled copy is removed when the transfer expires.
+func (c *Client) PublishTransferData(to []string, data []byte, contentType, filename string) error {
+	return c.publishTransferData(c.topic("notes"), to, data, contentType, filename)
+}
+
+func (c *Client) publishTransferData(topic string, to []string, data []byte, contentType, filename string) error {
+	dir, err := c.spoolDir("out")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, "data-*")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return c.publishTransfer(topic, to, f.Name(), contentType, filename, true)
+}
+
+func (c *Client) publishTransfer(topic string, to []string, path, contentType, filename string, owned bool) error {
+	if c.negotiateVersionFor(to) < Version2 {
+		if owned {
+			os.Remove(path)
+		}
+		return ErrTransfersUnsupported
+	}
+
+	c.loadTransfers()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if size > MaxTransferSize {
+		return fmt.Errorf("file is larger than %d bytes", MaxTransferSize)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	t := &outgoingTransfer{
+		Manifest: Manifest{
+			ID:       hex.EncodeToString(id),
+			Filename: filename,
+			Type:     contentType,
+			Size:     size,
+			PartSize: PartSize,
+			Parts:    int((size + PartSize - 1) / PartSize),
+			SHA256:   hex.EncodeToString(h.Sum(nil)),
+		},
+		Topic:   topic,
+		Path:    path,
+		Owned:   owned,
+		To:      to,
+		Created: time.Now(),
+	}
+
+	c.transfersMu.Lock()
+	c.outgoing[t.Manifest.ID] = t
+	err = c.saveOutgoing()
+	c.transfersMu.Unlock()
+	if err != nil {
+		log.Printf("[TRANSFER] Could not persist transfer %s: %v", t.Manifest.ID, err)
+	}
+
+	manifest, err := json.Marshal(t.Manifest)
+	if err != nil {
+		return err
+	}
+
+	msgID, version, err := c.publishFrameID(topic, recipientHashes(to), FlagManifest, contentType, filename, manifest)
+	if err != nil {
+		return err
+	}
+	if version >= Version5 {
+		c.recordSent(msgID, filename, to)
+	}
+
+	log.Printf("[TRANSFER] Sending %s (%d bytes, %d parts) as %s", filename, size, t.Manifest.Parts, t.Manifest.ID)
+
+	all := make([]int, t.Manifest.Parts)
+	for i := range all {
+		all[i] = i
+	}
+
+	return c.sendParts(t, all)
+}
+
+func (c *Client) sendParts(t *outgoingTransfer, indexes []int) error {
+	f, err := os.Open(t.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	id, err := hex.DecodeString(t.Manifest.ID)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, t.Manifest.PartSize)
+
+	for _, i := range indexes {
+		if i < 0 || i >= t.Manifest.Parts {
+			continue
+		}
+
+		n, err := f.ReadAt(chunk, int64(i)*t.Manifest.PartSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		// part payload: id [16] | index uint32 | data
+		buf := new(bytes.Buffer)
+		buf.Write(id)
+		binary.Write(buf, binary.BigEndian, uint32(i))
+		buf.Write(chunk[:n])
+
+		if err := c.publishFrame(t.Topic, recipientHashes(t.To), FlagPart, "", "", buf.Bytes()); err != nil {
+			return fmt.Errorf("part %d of %s: %w", i, t.Manifest.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// publishFrame encodes and publishes a transfer frame to the devices with the
+// given hashes, or to every device if to is empty, pacing parts below the
+// watchdog rate limit and waiting out disconnects for up to reconnectWait.
+func (c *Client) publishFrame(topic string, to [][32]byte, flags byte, contentType, filename string, payload []byte) error {
+	_, _, err := c.publishFrameID(topic, to, flags, contentType, filename, payload)
+	return err
+}
+
+// publishFrameID is publishFrame, returning the message ID and version of the
+// frame. Transfers outlive connections, so frames go out over whichever
+// connection the client has at the time.
+func (c *Client) publishFrameID(topic string, to [][32]byte, flags byte, contentType, filename string, payload []byte) ([16]byte, byte, error) {
+	version := max(Version2, c.negotiateVersionForHashes(to))
+	h, err := c.newHeader(version, flags, contentType, filename, to)
+	if err != nil {
+		return h.MessageID, version, err
+	}
+	encoded, err := c.encodeHeader(h, payload)
+	if err != nil {
+		return h.MessageID, version, err
+	}
+
+	c.paceMu.Lock()
+	if d := partInterval - time.Since(c.lastPartSent); d > 0 {
+		time.Sleep(d)
+	}
+	c.lastPartSent = time.Now()
+	c.paceMu.Unlock()
+
+	deadline := time.Now().Add(reconnectWait)
+	for {
+		if cn := c.current(); cn != nil && cn.IsConnected() {
+			err := cn.Publish(topic, encoded, c.frameOptions(version, "transfer", 30*time.Second))
+			if err == nil {
+				return h.MessageID, version, nil
+			}
+			// retrying won't change the broker's mind
+			if errors.Is(err, ErrPublishRejected) {
+				return h.MessageID, version, err
+			}
+			log.Printf("[TRANSFER] Publish failed, retrying: %v", err)
+		}
+
+		if time.Now().After(deadline) {
+			return h.MessageID, version, errors.New("gave up waiting for the broker")
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func isTransferFrame(h Header) bool {
+	return h.Flags&(FlagManifest|FlagPart|FlagResend) != 0
+}
+
+func (c *Client) handleTransferFrame(topic string, d *DecodedPayload) {
+	// Our own transfer frames echo back from the broker
+	if d.DeviceID == hashDeviceID(c.opts.DeviceID) {
+		return
+	}
+
+	switch {
+	case d.Flags&FlagManifest != 0:
+		if !c.acceptSender(d.Verified) {
+			log.Printf("[TRANSFER] Dropped unverified manifest")
+			return
+		}
+		c.handleManifest(topic, d)
+	case d.Flags&FlagPart != 0:
+		c.handlePart(d)
+	case d.Flags&FlagResend != 0:
+		c.handleResend(d)
+	}
+}
+
+func (c *Client) handleManifest(topic string, d *DecodedPayload) {
+	var m Manifest
+	if err := json.Unmarshal(d.Payload, &m); err != nil {
+		log.Printf("[TRANSFER] Bad manifest: %v", err)
+		return
+	}
+
+	if _, err := hex.DecodeString(m.ID); err != nil || len(m.ID) != 32 {
+		log.Printf("[TRANSFER] Bad transfer ID %q", m.ID)
+		return
+	}
+	if m.Size < 0 || m.Size > MaxTransferSize || m.PartSize != PartSize || int64(m.Parts) != (m.Size+m.PartSize-1)/m.PartSize {
+		log.Printf("[TRANSFER] Rejecting manifest %s with inconsistent sizes", m.ID)
+		return
+	}
+	if !c.receiveFor(d.DeviceID, m.Type).Accepts(m.Size) {
+		log.Printf("[TRANSFER] Dropped %s (%s, %d bytes) by a receive rule", m.Filename, m.Type, m.Size)
+		return
+	}
+
+	c.transfersMu.Lock()
+	if _, exists := c.incoming[m.ID]; exists {
+		c.transfersMu.Unlock()
+		return
+	}
+
+	pending := m.Size
+	for _, t := range c.incoming {
+		pending += t.Manifest.Size
+	}
+	if len(c.incoming) >= maxIncomingTransfers || pending > maxIncomingBytes {
+		c.transfersMu.Unlock()
+		log.Printf("[TRANSFER] Refusing %s (%d bytes), too many transfers pending", m.ID, m.Size)
+		notification.Notification(fmt.Sprintf("Error: Too many transfers pending to receive %s", m.Filename))
+		return
+	}
+
+	if _, err := c.spoolDir("in", m.ID); err != nil {
+		c.transfersMu.Unlock()
+		log.Printf("[TRANSFER] Could not create spool dir: %v", err)
+		return
+	}
+
+	t := &incomingTransfer{
+		Manifest:  m,
+		Topic:     topic,
+		Sender:    d.DeviceID,
+		Verified:  d.Verified,
+		Version:   d.Version,
+		MessageID: d.MessageID,
+		Created:   time.Now(),
+		have:      make(map[int]bool),
+	}
+	c.incoming[m.ID] = t
+	c.saveIncoming(t)
+	c.armResend(t)
+	c.transfersMu.Unlock()
+
+	log.Printf("[TRANSFER] Receiving %s (%d bytes, %d parts) as %s", m.Filename, m.Size, m.Parts, m.ID)
+	notification.Notification(fmt.Sprintf("Receiving %s (%d MB)", m.Filename, m.Size/(1024*1024)))
+}
+
+func (c *Client) handlePart(d *DecodedPayload) {
+	payload := d.Payload
+	if len(payload) < 20 {
+		return
+	}
+
+	id := hex.EncodeToString(payload[:16])
+	index := int(binary.BigEndian.Uint32(payload[16:20]))
+	data := payload[20:]
+
+	c.transfersMu.Lock()
+	t, ok := c.incoming[id]
+	if !ok || index >= t.Manifest.Parts || t.have[index] {
+		c.transfersMu.Unlock()
+		return
+	}
+
+	// Parts must come from whoever sent the manifest
+	if d.DeviceID != t.Sender || (t.Verified && !d.Verified) {
+		c.transfersMu.Unlock()
+		log.Printf("[TRANSFER] Part %d of %s is from a different sender", index, id)
+		return
+	}
+
+	offset := int64(index) * t.Manifest.PartSize
+	if int64(len(data)) != min(t.Manifest.PartSize, t.Manifest.Size-offset) {
+		c.transfersMu.Unlock()
+		log.Printf("[TRANSFER] Part %d of %s has the wrong size", index, id)
+		return
+	}
+
+	dir, _ := c.spoolDir("in", id)
+	sealed, err := config.SealLocal(data, partAAD(id, index))
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, strconv.Itoa(index)), sealed, 0o600)
+	}
+	if err != nil {
+		c.transfersMu.Unlock()
+		log.Printf("[TRANSFER] Could not write part %d of %s: %v", index, id, err)
+		return
+	}
+
+	t.have[index] = true
+	t.Received = append(t.Received, index)
+	t.attempts = 0
+	c.saveIncoming(t)
+
+	done := len(t.have) == t.Manifest.Parts
+	if done {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		delete(c.incoming, id)
+	} else {
+		c.armResend(t)
+	}
+	c.transfersMu.Unlock()
+
+	if done {
+		c.finishTransfer(t, dir)
+	}
+}
+
+// partAAD binds a sealed part to its transfer and index.
+func partAAD(id string, index int) []byte {
+	return []byte("transfer/" + id + "/" + strconv.Itoa(index))
+}
+
+// partsReader reads the sealed parts of an incoming transfer in order,
+// opening one at a time.
+type partsReader struct {
+	dir   string
+	id    string
+	parts int
+
+	next int
+	cur  []byte
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.next == r.parts {
+			return 0, io.EOF
+		}
+
+		sealed, err := os.ReadFile(filepath.Join(r.dir, strconv.Itoa(r.next)))
+		if err != nil {
+			return 0, err
+		}
+		if r.cur, err = config.OpenLocal(sealed, partAAD(r.id, r.next)); err != nil {
+			return 0, err
+		}
+		r.next++
+	}
+
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// finishTransfer moves the parts spooled in dir into the history, checking
+// them against the manifest on the way.
+func (c *Client) finishTransfer(t *incomingTransfer, dir string) {
+	h := sha256.New()
+	parts := &partsReader{dir: dir, id: t.Manifest.ID, parts: t.Manifest.Parts}
+
+	id, size, err := c.sealHistory(io.TeeReader(parts, h))
+	os.RemoveAll(dir)
+
+	if err != nil {
+		log.Printf("[TRANSFER] Could not store %s: %v", t.Manifest.ID, err)
+		notification.Notification("Error: Could not store received file")
+		return
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != t.Manifest.SHA256 {
+		log.Printf("[TRANSFER] Checksum mismatch for %s", t.Manifest.ID)
+		notification.Notification("Error: Received file was corrupted")
+		c.removeHistoryFile(id)
+		return
+	}
+
+	log.Printf("[TRANSFER] Received %s (%s), %d bytes", t.Manifest.Filename, t.Manifest.Type, t.Manifest.Size)
+	c.cacheFile(historyEntry{
+		HistoryItem: HistoryItem{
+			ID:          id,
+			Filename:    t.Manifest.Filename,
+			ContentType: t.Manifest.Type,
+			Size:        size,
+			Source:      SourceMQTT,
+			Verified:    t.Verified,
+		},
+		SenderHash: t.Sender,
+		Version:    t.Version,
+		MessageID:  t.MessageID,
+	})
+}
+
+func (c *Client) handleResend(d *DecodedPayload) {
+	if !c.acceptSender(d.Verified) {
+		log.Printf("[TRANSFER] Dropped unverified resend request")
+		return
+	}
+
+	var req resendRequest
+	if err := json.Unmarshal(d.Payload, &req); err != nil {
+		log.Printf("[TRANSFER] Bad resend request: %v", err)
+		return
+	}
+
+	c.transfersMu.Lock()
+	t, ok := c.outgoing[req.ID]
+	c.transfersMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if !c.sentTo(t, d.DeviceID) {
+		log.Printf("[TRANSFER] Ignoring resend request for %s from a device it was not sent to", req.ID)
+		return
+	}
+
+	missing := uniqueParts(req.Missing, t.Manifest.Parts)
+	if len(missing) == 0 {
+		return
+	}
+
+	log.Printf("[TRANSFER] Resending %d parts of %s", len(missing), req.ID)
+
+	go func() {
+		if err := c.sendParts(t, missing); err != nil {
+			log.Printf("[TRANSFER] Resend failed: %v", err)
+		}
+	}()
+}
+
+// sentTo reports whether t was sent to the device with the given hash.
+func (c *Client) sentTo(t *outgoingTransfer, device [32]byte) bool {
+	ids := t.To
+	if len(ids) == 0 {
+		ids = c.settings.DeviceIDs()
+	}
+
+	for _, id := range ids {
+		if hashDeviceID(id) == device {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueParts returns the part indexes in missing that exist in a transfer
+// of the given number of parts, each once and in order, so a request cannot
+// make the sender publish more than the whole transfer again.
+func uniqueParts(missing []int, parts int) []int {
+	seen := make(map[int]bool, min(len(missing), parts))
+	unique := make([]int, 0, min(len(missing), parts))
+	for _, i := range missing {
+		if i < 0 || i >= parts || seen[i] {
+			continue
+		}
+		seen[i] = true
+		unique = append(unique, i)
+	}
+
+	sort.Ints(unique)
+	return unique
+}
+
+// armResend (re)starts the quiet timer of an incoming transfer. Callers must
+// hold c.transfersMu.
+func (c *Client) armResend(t *incomingTransfer) {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+
+	t.timer = time.AfterFunc(resendAfter, func() {
+		c.transfersMu.Lock()
+		_, active := c.incoming[t.Manifest.ID]
+		t.attempts++
+		giveUp := t.attempts > maxResendAttempts
+		c.transfersMu.Unlock()
+
+		// After maxResendAttempts, wait for the next reconnect to try again
+		if !active || giveUp {
+			return
+		}
+
+		c.requestMissing(t)
+
+		c.transfersMu.Lock()
+		c.armResend(t)
+		c.transfersMu.Unlock()
+	})
+}
+
+func (c *Client) requestMissing(t *incomingTransfer) {
+	c.transfersMu.Lock()
+	missing := make([]int, 0, t.Manifest.Parts-len(t.have))
+	for i := 0; i < t.Manifest.Parts; i++ {
+		if !t.have[i] {
+			missing = append(missing, i)
+		}
+	}
+	c.transfersMu.Unlock()
+
+	if len(missing) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(resendRequest{ID: t.Manifest.ID, Missing: missing})
+	if err != nil {
+		return
+	}
+
+	log.Printf("[TRANSFER] Requesting %d missing parts of %s", len(missing), t.Manifest.ID)
+
+	// only the sender needs to see the request, unless it predates directed
+	// sends
+	to := [][32]byte{t.Sender}
+	if c.negotiateVersionForHashes(to) < Version7 {
+		to = nil
+	}
+
+	if err := c.publishFrame(t.Topic, to, FlagResend, "", "", data); err != nil {
+		log.Printf("[TRANSFER] Could not request missing parts: %v", err)
+	}
+}
+
+// resumeTransfers asks senders for whatever parts are still missing. It is
+// called on every (re)connect.
+func (c *Client) resumeTransfers() {
+	c.loadTransfers()
+
+	c.transfersMu.Lock()
+	pending := make([]*incomingTransfer, 0, len(c.incoming))
+	for _, t := range c.incoming {
+		t.attempts = 0
+		c.armResend(t)
+		pending = append(pending, t)
+	}
+	c.transfersMu.Unlock()
+
+	for _, t := range pending {
+		go c.requestMissing(t)
+	}
+}
+
+// loadTransfers restores transfer state left on disk by a previous run and
+// drops anything older than transferLifetime. It removes every spool/in dir
+// without a state.json, so it runs before the client subscribes.
+func (c *Client) loadTransfers() {
+	c.loadOnce.Do(func() {
+		c.transfersMu.Lock()
+		defer c.transfersMu.Unlock()
+
+		if dir, err := c.spoolDir(); err == nil {
+			if data, err := os.ReadFile(filepath.Join(dir, "outgoing.json")); err == nil {
+				var saved map[string]*outgoingTransfer
+				if json.Unmarshal(data, &saved) == nil {
+					for id, t := range saved {
+						if time.Since(t.Created) < transferLifetime {
+							c.outgoing[id] = t
+						} else if t.Owned {
+							os.Remove(t.Path)
+						}
+					}
+				}
+			}
+			c.saveOutgoing()
+		}
+
+		inDir, err := c.spoolDir("in")
+		if err != nil {
+			return
+		}
+		entries, _ := os.ReadDir(inDir)
+		for _, e := range entries {
+			dir := filepath.Join(inDir, e.Name())
+
+			data, err := os.ReadFile(filepath.Join(dir, "state.json"))
+			if err != nil {
+				// Leftovers of finished transfers, and notes spooled by
+				// earlier versions
+				os.RemoveAll(dir)
+				continue
+			}
+
+			var t incomingTransfer
+			if json.Unmarshal(data, &t) != nil || time.Since(t.Created) > transferLifetime {
+				os.RemoveAll(dir)
+				continue
+			}
+
+			// earlier versions spooled the parts unsealed into one file,
+			// which is dropped rather than resumed
+			if _, err := os.Stat(filepath.Join(dir, "data")); err == nil {
+				os.RemoveAll(dir)
+				continue
+			}
+
+			if _, exists := c.incoming[t.Manifest.ID]; exists {
+				continue
+			}
+
+			t.have = make(map[int]bool, len(t.Received))
+			for _, i := range t.Received {
+				t.have[i] = true
+			}
+			c.incoming[t.Manifest.ID] = &t
+		}
+	})
+}
+
+// saveOutgoing persists outgoing transfers. Callers must hold c.transfersMu.
+func (c *Client) saveOutgoing() error {
+	now := time.Now()
+	for id, t := range c.outgoing {
+		if now.Sub(t.Created) > transferLifetime {
+			if t.Owned {
+				os.Remove(t.Path)
+			}
+			delete(c.outgoing, id)
+		}
+	}
+
+	dir, err := c.spoolDir()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(c.outgoing)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, "outgoing.json"), data, 0o600)
+}
+
+// saveIncoming persists the progress of an incoming transfer. Callers must
+// hold c.transfersMu.
+func (c *Client) saveIncoming(t *incomingTransfer) {
+	dir, err := c.spoolDir("in", t.Manifest.ID)
+	if err != nil {
+		return
+	}
+
+	sort.Ints(t.Received)
+	data, err := json.Marshal(t)
+	if err != nil {
+		return
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "state.json"), data, 0o600); err != nil {
+		log.Printf("[TRANSFER] Could not save progress of %s: %v", t.Manifest.ID, err)
+	}
+}
@@ -0,0 +1,91 @@
+package mqttclient
+
+import (
+	"bytes"
+	"desktop_client/config"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/zalando/go-keyring"
+)
+
+func TestUniqueParts(t *testing.T) {
+	tests := []struct {
+		name    string
+		missing []int
+		parts   int
+		want    []int
+	}{
+		{"in order", []int{0, 1, 2}, 3, []int{0, 1, 2}},
+		{"sorted", []int{2, 0, 1}, 3, []int{0, 1, 2}},
+		{"duplicates", []int{0, 0, 0, 0, 1, 0}, 3, []int{0, 1}},
+		{"out of range", []int{-1, 3, 1, 1 << 30}, 3, []int{1}},
+		{"empty", nil, 3, []int{}},
+		{"no parts", []int{0}, 0, []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := uniqueParts(tt.missing, tt.parts); !slices.Equal(got, tt.want) {
+				t.Errorf("uniqueParts(%v, %d) = %v, want %v", tt.missing, tt.parts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartsReader(t *testing.T) {
+	keyring.MockInit()
+
+	const id = "00112233445566778899aabbccddeeff"
+	parts := [][]byte{[]byte("first part, "), []byte("second part, "), []byte("last")}
+
+	seal := func(t *testing.T, dir string, index int, aadIndex int) {
+		sealed, err := config.SealLocal(parts[index], partAAD(id, aadIndex))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, strconv.Itoa(index)), sealed, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("in order", func(t *testing.T) {
+		dir := t.TempDir()
+		for i := range parts {
+			seal(t, dir, i, i)
+		}
+
+		got, err := io.ReadAll(&partsReader{dir: dir, id: id, parts: len(parts)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := bytes.Join(parts, nil); !bytes.Equal(got, want) {
+			t.Errorf("read %q, want %q", got, want)
+		}
+	})
+
+	t.Run("swapped parts", func(t *testing.T) {
+		dir := t.TempDir()
+		seal(t, dir, 0, 0)
+		seal(t, dir, 1, 2)
+		seal(t, dir, 2, 1)
+
+		if _, err := io.ReadAll(&partsReader{dir: dir, id: id, parts: len(parts)}); err == nil {
+			t.Error("read parts sealed for other indexes")
+		}
+	})
+
+	t.Run("missing part", func(t *testing.T) {
+		dir := t.TempDir()
+		seal(t, dir, 0, 0)
+		seal(t, dir, 2, 2)
+
+		if _, err := io.ReadAll(&partsReader{dir: dir, id: id, parts: len(parts)}); err == nil {
+			t.Error("read a transfer with a part missing")
+		}
+	})
+}
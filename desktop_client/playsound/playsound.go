@@ -1,10 +1,27 @@
 package playsound
 
-import "desktop_client/settings"
+import "sync"
 
-// Play plays the notification sound (platform-specific implementation).
+var (
+	muted   bool
+	mutedMu sync.RWMutex
+)
+
+// SetMuted turns the notification sound off or back on.
+func SetMuted(m bool) {
+	mutedMu.Lock()
+	muted = m
+	mutedMu.Unlock()
+}
+
+// Play plays the notification sound (platform-specific implementation),
+// unless it is muted.
 func Play(notificationSound []byte) {
-	if !settings.GetSettings().Muted {
+	mutedMu.RLock()
+	m := muted
+	mutedMu.RUnlock()
+
+	if !m {
 		play(notificationSound)
 	}
 }
@@ -0,0 +1,128 @@
+package settings
+
+import (
+	"desktop_client/config"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Settings cache
+//
+// The last settings payload applied is sealed with the local storage key
+// (see config.SealLocal) into the HoppyShare config dir. LoadCached applies it
+// at startup, before the client connects, so a device that was disabled or
+// muted stays that way while the broker is unreachable.
+//
+// The backend stamps each device's settings with updated_at whenever they
+// change. A payload whose entry for this device is older than the settings
+// already applied, e.g. a retained copy the broker restored from a backup, is
+// ignored. Payloads without updated_at, from older backends, always apply.
+//
+// The payload is cached as received, still signed, and verified again when it
+// is loaded. A destroy cancelled on this device is cached with it.
+
+// CacheFile is the name of the settings cache in the HoppyShare config
+// directory.
+const CacheFile = "settings.cache"
+
+var cacheAAD = []byte("settings/cache")
+
+// cacheEntry is the content of the settings cache. Caches written before
+// destroys could be cancelled hold the payload alone.
+type cacheEntry struct {
+	Payload          json.RawMessage `json:"payload"`
+	DestroyCancelled *int64          `json:"destroy_cancelled,omitempty"` // see destroy.go
+}
+
+// cachedData is the payload last applied. Guarded by settingsMu.
+var cachedData []byte
+
+// updatedAt is the updated_at of the settings applied for this device, zero
+// until settings with one were applied. Guarded by settingsMu.
+var updatedAt int64
+
+func cachePath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "HoppyShare", CacheFile), nil
+}
+
+// LoadCached applies the settings cached by the last ParseSettings. A missing
+// cache is not an error; an unreadable one is removed.
+func LoadCached() error {
+	path, err := cachePath()
+	if err != nil {
+		return err
+	}
+
+	sealed, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := config.OpenLocal(sealed, cacheAAD)
+	if errors.Is(err, config.ErrCorruptStorage) {
+		log.Printf("[SETTINGS] Dropping unreadable settings cache")
+		os.Remove(path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		entry = cacheEntry{Payload: data}
+	}
+
+	settingsMu.Lock()
+	destroyCancelled = entry.DestroyCancelled
+	settingsMu.Unlock()
+
+	log.Printf("[SETTINGS] Applying cached settings")
+	return applySettings(entry.Payload, true)
+}
+
+// saveCacheLocked seals cachedData into the settings cache. Callers must
+// hold settingsMu, which keeps concurrent saves in order.
+func saveCacheLocked() {
+	path, err := cachePath()
+	if err != nil {
+		log.Printf("[SETTINGS] Could not cache settings: %v", err)
+		return
+	}
+
+	data, err := json.Marshal(cacheEntry{Payload: cachedData, DestroyCancelled: destroyCancelled})
+	if err != nil {
+		log.Printf("[SETTINGS] Could not cache settings: %v", err)
+		return
+	}
+
+	sealed, err := config.SealLocal(data, cacheAAD)
+	if err != nil {
+		log.Printf("[SETTINGS] Could not seal settings cache: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		log.Printf("[SETTINGS] Could not cache settings: %v", err)
+		return
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, sealed, 0o600); err != nil {
+		log.Printf("[SETTINGS] Could not cache settings: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("[SETTINGS] Could not cache settings: %v", err)
+	}
+}
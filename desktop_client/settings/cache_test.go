@@ -0,0 +1,97 @@
+package settings
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheSurvivesRestart(t *testing.T) {
+	priv := setupTest(t)
+
+	payload := append(devicePayload(entry{"nickname": "Laptop", "muted": true, "updated_at": 1000}),
+		entry{"deviceid": "other-device", "settings": entry{"nickname": "Phone"}})
+	if err := ParseSettings(sign(t, priv, testAccount, 1, payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	restart()
+	if err := LoadCached(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := GetSettings()
+	if s.Nickname != "Laptop" || !s.Muted {
+		t.Errorf("settings after restart = %+v, want nickname Laptop and muted", s)
+	}
+	if ids := DeviceIDs(); len(ids) != 2 || ids[1] != "other-device" {
+		t.Errorf("devices after restart = %v", ids)
+	}
+
+	// the cached settings hold back older ones
+	old := sign(t, priv, testAccount, 2, devicePayload(entry{"nickname": "Old", "updated_at": 500}))
+	if err := ParseSettings(old); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetSettings().Nickname; got != "Laptop" {
+		t.Errorf("nickname = %q after older settings, want Laptop", got)
+	}
+	stale := sign(t, priv, testAccount, 0, devicePayload(entry{"nickname": "Replayed"}))
+	if err := ParseSettings(stale); !errors.Is(err, ErrStaleSettings) {
+		t.Errorf("replay of settings signed before the cached ones: got %v, want ErrStaleSettings", err)
+	}
+}
+
+func TestCacheMissing(t *testing.T) {
+	setupTest(t)
+
+	if err := LoadCached(); err != nil {
+		t.Fatal(err)
+	}
+	if s := GetSettings(); s != defaults {
+		t.Errorf("settings = %+v, want the defaults", s)
+	}
+}
+
+func TestCacheRemovesCorrupt(t *testing.T) {
+	setupTest(t)
+
+	path, err := cachePath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("not sealed"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadCached(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("corrupt cache was not removed: %v", err)
+	}
+	if s := GetSettings(); s != defaults {
+		t.Errorf("settings = %+v, want the defaults", s)
+	}
+}
+
+func TestCacheVerifiedAgain(t *testing.T) {
+	priv := setupTest(t)
+
+	if err := ParseSettings(sign(t, priv, testAccount, 1, devicePayload(entry{"nickname": "Laptop"}))); err != nil {
+		t.Fatal(err)
+	}
+
+	restart()
+	pinTestKey(t)
+	if err := LoadCached(); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("cache signed with an unpinned key: got %v, want ErrBadSignature", err)
+	}
+	if got := GetSettings().Nickname; got != defaults.Nickname {
+		t.Errorf("nickname = %q, want the default", got)
+	}
+}
@@ -0,0 +1,117 @@
+package settings
+
+import (
+	"desktop_client/uninstall"
+	"log"
+	"time"
+)
+
+// Remote destroy
+//
+// Settings with destroy set do not uninstall the device right away. The
+// uninstall is scheduled DestroyGrace later, and the tray offers to cancel it
+// in the meantime, so a destroy sent by mistake, or to the wrong device, can
+// still be stopped at the device. Settings with destroy unset cancel it too.
+//
+// A destroy cancelled on the device stays cancelled, across restarts, until
+// the device's settings change again (a newer updated_at), so the retained
+// settings do not schedule it again on the next connect.
+
+// DestroyGrace is how long a destroy waits before uninstalling.
+const DestroyGrace = 10 * time.Minute
+
+// Guarded by settingsMu.
+var (
+	destroyTimer *time.Timer
+	destroyAt    time.Time
+
+	// updated_at of the settings whose destroy was cancelled on this device
+	destroyCancelled *int64
+
+	onDestroyFns []func(at time.Time)
+)
+
+// OnDestroyChange registers fn to run when a destroy is scheduled, with the
+// time it uninstalls, and when it is cancelled, with the zero time.
+func OnDestroyChange(fn func(at time.Time)) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	onDestroyFns = append(onDestroyFns, fn)
+}
+
+// PendingDestroy returns when a scheduled destroy uninstalls, and whether one
+// is scheduled.
+func PendingDestroy() (time.Time, bool) {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+
+	return destroyAt, destroyTimer != nil
+}
+
+// CancelDestroy cancels a scheduled destroy for the current settings. It
+// reports whether one was scheduled.
+func CancelDestroy() bool {
+	settingsMu.Lock()
+	if !stopDestroyLocked() {
+		settingsMu.Unlock()
+		return false
+	}
+
+	cancelled := updatedAt
+	destroyCancelled = &cancelled
+	saveCacheLocked()
+
+	fns := append([]func(time.Time){}, onDestroyFns...)
+	settingsMu.Unlock()
+
+	log.Printf("[SETTINGS] Destroy cancelled on this device")
+
+	for _, fn := range fns {
+		fn(time.Time{})
+	}
+	return true
+}
+
+// scheduleDestroyLocked schedules the uninstall, unless it is already
+// scheduled or was cancelled for these settings. Callers must hold
+// settingsMu.
+func scheduleDestroyLocked() {
+	if destroyTimer != nil {
+		return
+	}
+	if destroyCancelled != nil && *destroyCancelled == updatedAt {
+		log.Printf("[SETTINGS] Ignoring destroy, it was cancelled on this device")
+		return
+	}
+
+	destroyAt = time.Now().Add(DestroyGrace)
+	destroyTimer = time.AfterFunc(DestroyGrace, runDestroy)
+
+	log.Printf("[SETTINGS] Destroy scheduled for %s", destroyAt.Format(time.Kitchen))
+}
+
+// stopDestroyLocked stops a scheduled uninstall and reports whether one was
+// scheduled. Callers must hold settingsMu.
+func stopDestroyLocked() bool {
+	if destroyTimer == nil {
+		return false
+	}
+
+	destroyTimer.Stop()
+	destroyTimer = nil
+	destroyAt = time.Time{}
+	return true
+}
+
+func runDestroy() {
+	settingsMu.Lock()
+	// cancelled while the timer fired
+	if destroyTimer == nil {
+		settingsMu.Unlock()
+		return
+	}
+	destroyTimer = nil
+	settingsMu.Unlock()
+
+	uninstall.RunUninstall()
+}
@@ -0,0 +1,105 @@
+package settings
+
+import (
+	"testing"
+	"time"
+)
+
+// Destroys are only ever scheduled here, DestroyGrace is far longer than a
+// test runs, and setupTest stops the timer before it could uninstall.
+
+func TestDestroyGrace(t *testing.T) {
+	priv := setupTest(t)
+
+	var changes []time.Time
+	OnDestroyChange(func(at time.Time) { changes = append(changes, at) })
+
+	destroy := sign(t, priv, testAccount, 1, devicePayload(entry{"destroy": true, "updated_at": 1000}))
+	if err := ParseSettings(destroy); err != nil {
+		t.Fatal(err)
+	}
+
+	at, ok := PendingDestroy()
+	if !ok {
+		t.Fatal("destroy was not scheduled")
+	}
+	if wait := time.Until(at); wait < DestroyGrace-time.Minute || wait > DestroyGrace {
+		t.Errorf("destroy scheduled in %v, want %v", wait, DestroyGrace)
+	}
+	if len(changes) != 1 || !changes[0].Equal(at) {
+		t.Errorf("destroy changes = %v, want %v", changes, at)
+	}
+
+	// the retained settings arrive again on reconnect
+	if err := ParseSettings(destroy); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := PendingDestroy(); !again.Equal(at) {
+		t.Errorf("destroy was scheduled again for %v", again)
+	}
+
+	// settings with destroy unset cancel it
+	if err := ParseSettings(sign(t, priv, testAccount, 2, devicePayload(entry{"destroy": false, "updated_at": 2000}))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := PendingDestroy(); ok {
+		t.Error("destroy unset did not cancel the destroy")
+	}
+	if len(changes) != 2 || !changes[1].IsZero() {
+		t.Errorf("destroy changes = %v, want the cancel reported", changes)
+	}
+	if GetSettings().Destroy {
+		t.Error("destroy is still set")
+	}
+}
+
+func TestCancelDestroy(t *testing.T) {
+	priv := setupTest(t)
+
+	if CancelDestroy() {
+		t.Error("cancelled a destroy that was not scheduled")
+	}
+
+	destroy := sign(t, priv, testAccount, 1, devicePayload(entry{"destroy": true, "updated_at": 1000}))
+	if err := ParseSettings(destroy); err != nil {
+		t.Fatal(err)
+	}
+
+	var changes []time.Time
+	OnDestroyChange(func(at time.Time) { changes = append(changes, at) })
+
+	if !CancelDestroy() {
+		t.Fatal("no destroy to cancel")
+	}
+	if _, ok := PendingDestroy(); ok {
+		t.Fatal("destroy still scheduled after cancelling it")
+	}
+	if len(changes) != 1 || !changes[0].IsZero() {
+		t.Errorf("destroy changes = %v, want the cancel reported", changes)
+	}
+
+	// the same settings, on reconnect or after a restart, do not schedule it
+	// again
+	if err := ParseSettings(destroy); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := PendingDestroy(); ok {
+		t.Error("retained settings scheduled the cancelled destroy again")
+	}
+
+	restart()
+	if err := LoadCached(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := PendingDestroy(); ok {
+		t.Error("cached settings scheduled the cancelled destroy again after a restart")
+	}
+
+	// newer settings with destroy set do
+	if err := ParseSettings(sign(t, priv, testAccount, 2, devicePayload(entry{"destroy": true, "updated_at": 2000}))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := PendingDestroy(); !ok {
+		t.Error("newer settings did not schedule the destroy")
+	}
+}
@@ -0,0 +1,154 @@
+package settings
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Receive rules
+//
+// receive_rules in a device's settings decide, per sender, whether its notes
+// are received and what happens when they are. Rules are checked in order and
+// the first one whose sender matches applies; "*" matches every sender, so a
+// last "*" rule sets the default. Notes from senders no rule matches are
+// received as before, following the device's own auto_copy and muted.
+//
+// Senders are named by device ID or by the hex SHA-256 of one, the hash
+// frames carry, so a rule can name a device that left the settings topic.
+// Rules apply to notes received over MQTT and BLE alike; Enabled, SendToSelf
+// and RequireSigned are checked before them.
+
+// MaxReceiveRules is the number of rules kept, later ones are dropped.
+const MaxReceiveRules = 32
+
+// Actions of a receive rule.
+const (
+	RuleAllow = "allow"
+	RuleDeny  = "deny"
+)
+
+// ReceiveRule is one entry of receive_rules.
+type ReceiveRule struct {
+	Sender   string   `json:"sender"`              // device ID, hex SHA-256 of one, or "*"
+	Action   string   `json:"action,omitempty"`    // RuleAllow (default) or RuleDeny
+	Types    []string `json:"types,omitempty"`     // MIME types, "image/*" matches a kind; empty allows every type
+	MaxSize  int64    `json:"max_size,omitempty"`  // bytes, 0 for no limit
+	AutoCopy *bool    `json:"auto_copy,omitempty"` // overrides the device's auto_copy
+	Muted    bool     `json:"muted,omitempty"`     // no notification sound
+	AutoSave bool     `json:"auto_save,omitempty"` // saved to the downloads folder on arrival
+}
+
+// Receive is how to handle a note, see ReceiveFor.
+type Receive struct {
+	Deny     bool  // the sender, or the type of the note, is not allowed
+	MaxSize  int64 // bytes, 0 for no limit
+	AutoCopy bool
+	Muted    bool
+	AutoSave bool
+}
+
+// Accepts reports whether a note of the given size is received.
+func (r Receive) Accepts(size int64) bool {
+	return !r.Deny && (r.MaxSize == 0 || size <= r.MaxSize)
+}
+
+// guarded by settingsMu
+var receiveRules []ReceiveRule
+
+// ReceiveRules returns the receive rules of this device.
+func ReceiveRules() []ReceiveRule {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+
+	return append([]ReceiveRule(nil), receiveRules...)
+}
+
+// ReceiveFor applies the receive rules of this device to a note of
+// contentType from sender, a device ID or the hex SHA-256 of one.
+func ReceiveFor(sender, contentType string) Receive {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+
+	return ApplyReceiveRules(receiveRules, settings, sender, contentType)
+}
+
+// ApplyReceiveRules applies rules to a note of contentType from sender, on a
+// device with the settings s.
+func ApplyReceiveRules(rules []ReceiveRule, s Settings, sender, contentType string) Receive {
+	r := Receive{AutoCopy: s.AutoCopy, Muted: s.Muted}
+
+	hash := senderHash(sender)
+	for _, rule := range rules {
+		if rule.Sender != "*" && senderHash(rule.Sender) != hash {
+			continue
+		}
+
+		r.Deny = rule.Action == RuleDeny || !matchesType(rule.Types, contentType)
+		r.MaxSize = rule.MaxSize
+		if rule.AutoCopy != nil {
+			r.AutoCopy = *rule.AutoCopy
+		}
+		r.Muted = r.Muted || rule.Muted
+		r.AutoSave = rule.AutoSave
+		break
+	}
+
+	return r
+}
+
+// senderHash returns the device hash a sender names.
+func senderHash(sender string) [32]byte {
+	var hash [32]byte
+	if len(sender) == 2*len(hash) {
+		if _, err := hex.Decode(hash[:], []byte(sender)); err == nil {
+			return hash
+		}
+	}
+	return sha256.Sum256([]byte(sender))
+}
+
+func matchesType(types []string, contentType string) bool {
+	if len(types) == 0 {
+		return true
+	}
+
+	contentType = strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	for _, t := range types {
+		if ok, _ := path.Match(strings.ToLower(t), contentType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// clampReceiveRules drops the rules that cannot be applied.
+func clampReceiveRules(rules []ReceiveRule) ([]ReceiveRule, []FieldError) {
+	var errs []FieldError
+	invalid := func(i int, reason string) {
+		errs = append(errs, FieldError{Field: "receive_rules", Reason: fmt.Sprintf("rule %d %s, ignoring it", i+1, reason)})
+	}
+
+	kept := make([]ReceiveRule, 0, len(rules))
+	for i, rule := range rules {
+		switch {
+		case strings.TrimSpace(rule.Sender) == "":
+			invalid(i, "has no sender")
+		case rule.Action != "" && rule.Action != RuleAllow && rule.Action != RuleDeny:
+			invalid(i, fmt.Sprintf("has unknown action %q", rule.Action))
+		case rule.MaxSize < 0:
+			invalid(i, "has a negative max_size")
+		default:
+			kept = append(kept, rule)
+		}
+	}
+
+	if len(kept) > MaxReceiveRules {
+		errs = append(errs, FieldError{Field: "receive_rules", Reason: fmt.Sprintf("more than %d rules, ignoring the rest", MaxReceiveRules)})
+		kept = kept[:MaxReceiveRules]
+	}
+
+	return kept, errs
+}
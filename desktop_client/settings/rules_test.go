@@ -0,0 +1,109 @@
+package settings
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestApplyReceiveRules(t *testing.T) {
+	no := false
+	hash := sha256.Sum256([]byte("phone"))
+
+	rules := []ReceiveRule{
+		{Sender: "laptop", Action: RuleDeny},
+		{Sender: hex.EncodeToString(hash[:]), Types: []string{"image/*", "text/plain"}, MaxSize: 1024, AutoSave: true},
+		{Sender: "tablet", AutoCopy: &no, Muted: true},
+		{Sender: "*", Types: []string{"text/*"}},
+		{Sender: "tablet", Action: RuleDeny}, // after "*", never applies
+	}
+	s := Settings{AutoCopy: true}
+
+	tests := []struct {
+		name        string
+		sender      string
+		contentType string
+		size        int64
+		accept      bool
+		check       func(t *testing.T, r Receive)
+	}{
+		{name: "denied sender", sender: "laptop", contentType: "text/plain", accept: false},
+		{name: "sender by hash", sender: "phone", contentType: "image/png", size: 1024, accept: true,
+			check: func(t *testing.T, r Receive) {
+				if !r.AutoSave || !r.AutoCopy {
+					t.Errorf("receive = %+v, want auto_save and the device's auto_copy", r)
+				}
+			}},
+		{name: "hash of the sender", sender: hex.EncodeToString(hash[:]), contentType: "text/plain", accept: true},
+		{name: "type mismatch", sender: "phone", contentType: "application/pdf", accept: false},
+		{name: "type with parameters", sender: "phone", contentType: "Text/Plain; charset=utf-8", accept: true},
+		{name: "over the size limit", sender: "phone", contentType: "image/png", size: 1025, accept: false},
+		{name: "first match wins", sender: "tablet", contentType: "application/pdf", size: 1 << 30, accept: true,
+			check: func(t *testing.T, r Receive) {
+				if r.AutoCopy || !r.Muted || r.MaxSize != 0 {
+					t.Errorf("receive = %+v, want no auto_copy, muted and no size limit", r)
+				}
+			}},
+		{name: "default rule", sender: "desktop", contentType: "text/html", accept: true},
+		{name: "default rule type mismatch", sender: "desktop", contentType: "image/png", accept: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := ApplyReceiveRules(rules, s, tt.sender, tt.contentType)
+			if got := r.Accepts(tt.size); got != tt.accept {
+				t.Errorf("accepts = %v, want %v (%+v)", got, tt.accept, r)
+			}
+			if tt.check != nil {
+				tt.check(t, r)
+			}
+		})
+	}
+}
+
+func TestApplyReceiveRulesNoMatch(t *testing.T) {
+	rules := []ReceiveRule{{Sender: "laptop", Action: RuleDeny}}
+	s := Settings{AutoCopy: true, Muted: true}
+
+	r := ApplyReceiveRules(rules, s, "phone", "image/png")
+	if !r.Accepts(1<<30) || !r.AutoCopy || !r.Muted || r.AutoSave {
+		t.Errorf("receive = %+v, want the device's own settings", r)
+	}
+}
+
+func TestDecodeReceiveRules(t *testing.T) {
+	raw := rawDeviceSettings{DeviceID: testDevice, Settings: []byte(`{"receive_rules": [
+		{"sender": "laptop", "action": "deny"},
+		{"sender": "", "action": "deny"},
+		{"sender": "phone", "action": "block"},
+		{"sender": "tablet", "max_size": -1},
+		{"sender": "*", "types": ["text/*"], "colour": "red"}
+	]}`)}
+
+	d, errs := decodeDeviceSettings(raw)
+
+	var senders []string
+	for _, rule := range d.Settings.ReceiveRules {
+		senders = append(senders, rule.Sender)
+	}
+	if got := strings.Join(senders, ","); got != "laptop,*" {
+		t.Errorf("rules kept = %s, want laptop,*", got)
+	}
+	if rules := d.Settings.ReceiveRules; len(rules) == 2 && (len(rules[1].Types) != 1 || rules[1].Types[0] != "text/*") {
+		t.Errorf("rule with an unknown field = %+v", rules[1])
+	}
+	// the unknown field, and the three invalid rules
+	if len(errs) != 4 {
+		t.Errorf("reported %v, want 4 errors", errs)
+	}
+
+	raw.Settings = []byte(`{"receive_rules": [{"sender": "*"}]}`)
+	for range MaxReceiveRules {
+		raw.Settings = append(raw.Settings[:len(raw.Settings)-2], []byte(`, {"sender": "*"}]}`)...)
+	}
+	d, errs = decodeDeviceSettings(raw)
+	if len(d.Settings.ReceiveRules) != MaxReceiveRules || len(errs) != 1 {
+		t.Errorf("kept %d rules, reported %v; want %d and one error", len(d.Settings.ReceiveRules), errs, MaxReceiveRules)
+	}
+}
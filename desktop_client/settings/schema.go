@@ -0,0 +1,179 @@
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Settings schema
+//
+// Each device's settings object names the schema version it was written for
+// in "schema"; objects without one are version 1. Fields are decoded one at a
+// time, so a field of the wrong type or an unknown field is dropped without
+// losing the rest, and numbers out of range are clamped. Both are reported
+// back from ParseSettings. Fields this client does not know are expected, and
+// not reported, in objects written for a newer schema than SchemaVersion.
+const SchemaVersion = 1
+
+// Limits of the settings, see settings.md.
+const (
+	MaxNicknameLength = 64
+	MinCacheTime      = 1   // seconds
+	MaxCacheTime      = 300 // seconds
+	MaxOfflineTTL     = 168 // hours
+	MaxHistorySize    = 50
+)
+
+// FieldError is a setting that was dropped or changed during validation.
+type FieldError struct {
+	Field  string // JSON name, e.g. "cache_time"
+	Reason string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// ValidationError lists the settings of this device that were dropped or
+// clamped. The rest of the payload was applied.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return "invalid settings: " + strings.Join(msgs, "; ")
+}
+
+type rawDeviceSettings struct {
+	DeviceID string          `json:"deviceid"`
+	Settings json.RawMessage `json:"settings"`
+}
+
+// decodeDeviceSettings decodes and validates one entry of the settings
+// payload.
+func decodeDeviceSettings(raw rawDeviceSettings) (DeviceSettings, []FieldError) {
+	d := DeviceSettings{DeviceID: raw.DeviceID}
+	if len(raw.Settings) == 0 || string(raw.Settings) == "null" {
+		return d, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw.Settings, &fields); err != nil {
+		return d, []FieldError{{Field: "settings", Reason: "not an object"}}
+	}
+
+	schema := SchemaVersion
+	if v, ok := fields["schema"]; ok {
+		json.Unmarshal(v, &schema)
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []FieldError
+	for _, name := range names {
+		one, _ := json.Marshal(map[string]json.RawMessage{name: fields[name]})
+
+		dec := json.NewDecoder(bytes.NewReader(one))
+		dec.DisallowUnknownFields()
+
+		// a failed decode can leave a zero value behind
+		prev := d.Settings
+		err := dec.Decode(&d.Settings)
+
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case err == nil:
+		case errors.As(err, &typeErr):
+			d.Settings = prev
+			errs = append(errs, FieldError{Field: name, Reason: "expected " + jsonType(typeErr)})
+		case strings.HasPrefix(err.Error(), "json: unknown field"):
+			// an unknown field inside a setting, e.g. a receive rule, drops
+			// only that field
+			reason := "unknown setting"
+			if err.Error() != fmt.Sprintf("json: unknown field %q", name) {
+				reason = strings.TrimPrefix(err.Error(), "json: ")
+			}
+			d.Settings = prev
+			if err := json.Unmarshal(one, &d.Settings); err != nil {
+				d.Settings = prev
+				errs = append(errs, FieldError{Field: name, Reason: err.Error()})
+			} else if schema <= SchemaVersion {
+				errs = append(errs, FieldError{Field: name, Reason: reason})
+			}
+		default:
+			d.Settings = prev
+			errs = append(errs, FieldError{Field: name, Reason: err.Error()})
+		}
+	}
+
+	return d, append(errs, clampDeviceSettings(&d)...)
+}
+
+// jsonType names the JSON type a field should have had.
+func jsonType(err *json.UnmarshalTypeError) string {
+	switch k := err.Type.String(); {
+	case k == "bool":
+		return "a boolean"
+	case k == "string":
+		return "a string"
+	case strings.HasPrefix(k, "int") || strings.HasPrefix(k, "uint"):
+		return "a whole number"
+	case strings.HasPrefix(k, "[]"):
+		return "a list"
+	default:
+		return "an object"
+	}
+}
+
+// clampDeviceSettings brings the settings within their limits.
+func clampDeviceSettings(d *DeviceSettings) []FieldError {
+	var errs []FieldError
+	s := &d.Settings
+
+	if s.Nickname != nil {
+		nickname := strings.TrimSpace(*s.Nickname)
+		if utf8.RuneCountInString(nickname) > MaxNicknameLength {
+			nickname = string([]rune(nickname)[:MaxNicknameLength])
+			errs = append(errs, FieldError{Field: "nickname", Reason: fmt.Sprintf("longer than %d characters, truncated", MaxNicknameLength)})
+		}
+		s.Nickname = &nickname
+	}
+
+	clamp := func(field string, v *int, lo, hi int) {
+		if v == nil || (*v >= lo && *v <= hi) {
+			return
+		}
+		clamped := min(max(*v, lo), hi)
+		errs = append(errs, FieldError{Field: field, Reason: fmt.Sprintf("%d is outside %d-%d, using %d", *v, lo, hi, clamped)})
+		*v = clamped
+	}
+	clamp("cache_time", s.CacheTime, MinCacheTime, MaxCacheTime)
+	clamp("offline_ttl", s.OfflineTTL, 0, MaxOfflineTTL)
+	clamp("history_size", s.HistorySize, 0, MaxHistorySize)
+
+	if s.GroupKey != nil && s.GroupKey.Transition != nil && *s.GroupKey.Transition < 0 {
+		errs = append(errs, FieldError{Field: "group_key", Reason: "negative transition, using the default"})
+		s.GroupKey.Transition = nil
+	}
+
+	if s.ReceiveRules != nil {
+		var ruleErrs []FieldError
+		s.ReceiveRules, ruleErrs = clampReceiveRules(s.ReceiveRules)
+		errs = append(errs, ruleErrs...)
+	}
+
+	return errs
+}
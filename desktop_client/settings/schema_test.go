@@ -0,0 +1,131 @@
+package settings
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodeDeviceSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings string
+		errs     []string // fields reported, in order
+		check    func(t *testing.T, d DeviceSettings)
+	}{
+		{
+			name:     "valid",
+			settings: `{"nickname": "Laptop", "cache_time": 60, "muted": true}`,
+			check: func(t *testing.T, d DeviceSettings) {
+				if *d.Settings.Nickname != "Laptop" || *d.Settings.CacheTime != 60 || !*d.Settings.Muted {
+					t.Errorf("settings = %+v", d.Settings)
+				}
+			},
+		},
+		{
+			name:     "wrong type keeps the rest",
+			settings: `{"muted": "yes", "enabled": false, "cache_time": 1.5}`,
+			errs:     []string{"cache_time", "muted"},
+			check: func(t *testing.T, d DeviceSettings) {
+				if d.Settings.Muted != nil || d.Settings.CacheTime != nil {
+					t.Errorf("invalid fields were kept: %+v", d.Settings)
+				}
+				if d.Settings.Enabled == nil || *d.Settings.Enabled {
+					t.Errorf("enabled = %v, want false", d.Settings.Enabled)
+				}
+			},
+		},
+		{
+			name:     "unknown field",
+			settings: `{"nickname": "Laptop", "colour": "red"}`,
+			errs:     []string{"colour"},
+		},
+		{
+			name:     "unknown field of a newer schema",
+			settings: `{"schema": 2, "nickname": "Laptop", "colour": "red"}`,
+		},
+		{
+			name:     "clamped",
+			settings: `{"cache_time": 0, "offline_ttl": 1000, "history_size": -1}`,
+			errs:     []string{"cache_time", "offline_ttl", "history_size"},
+			check: func(t *testing.T, d DeviceSettings) {
+				s := d.Settings
+				if *s.CacheTime != MinCacheTime || *s.OfflineTTL != MaxOfflineTTL || *s.HistorySize != 0 {
+					t.Errorf("cache_time %d, offline_ttl %d, history_size %d", *s.CacheTime, *s.OfflineTTL, *s.HistorySize)
+				}
+			},
+		},
+		{
+			name:     "long nickname",
+			settings: `{"nickname": "  ` + strings.Repeat("é", MaxNicknameLength+1) + `  "}`,
+			errs:     []string{"nickname"},
+			check: func(t *testing.T, d DeviceSettings) {
+				if *d.Settings.Nickname != strings.Repeat("é", MaxNicknameLength) {
+					t.Errorf("nickname = %q", *d.Settings.Nickname)
+				}
+			},
+		},
+		{
+			name:     "negative transition",
+			settings: `{"group_key": {"id": 2, "key": "00", "transition": -1}}`,
+			errs:     []string{"group_key"},
+			check: func(t *testing.T, d DeviceSettings) {
+				if d.Settings.GroupKey == nil || d.Settings.GroupKey.Transition != nil {
+					t.Errorf("group_key = %+v, want it without transition", d.Settings.GroupKey)
+				}
+			},
+		},
+		{
+			name:     "not an object",
+			settings: `["nickname"]`,
+			errs:     []string{"settings"},
+		},
+		{
+			name:     "null",
+			settings: `null`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, errs := decodeDeviceSettings(rawDeviceSettings{DeviceID: testDevice, Settings: []byte(tt.settings)})
+			if d.DeviceID != testDevice {
+				t.Errorf("device ID = %q", d.DeviceID)
+			}
+
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.errs, ",") {
+				t.Errorf("reported %v, want %v", errs, tt.errs)
+			}
+
+			if tt.check != nil {
+				tt.check(t, d)
+			}
+		})
+	}
+}
+
+func TestParseSettingsValidation(t *testing.T) {
+	priv := setupTest(t)
+
+	payload := append(devicePayload(entry{"nickname": "Laptop", "cache_time": "soon", "history_size": 500}),
+		entry{"deviceid": "other-device", "settings": entry{"cache_time": "later"}})
+	err := ParseSettings(sign(t, priv, testAccount, 1, payload))
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("got %v, want a ValidationError", err)
+	}
+	// only this device's settings are reported
+	if len(verr.Fields) != 2 || verr.Fields[0].Field != "cache_time" || verr.Fields[1].Field != "history_size" {
+		t.Errorf("reported %v", verr.Fields)
+	}
+
+	s := GetSettings()
+	if s.Nickname != "Laptop" || s.CacheTime != defaults.CacheTime || s.HistorySize != MaxHistorySize {
+		t.Errorf("settings = %+v, want the valid ones applied", s)
+	}
+}
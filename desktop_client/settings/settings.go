@@ -3,10 +3,12 @@ package settings
 import (
 	"desktop_client/config"
 	"desktop_client/startup"
-	"desktop_client/uninstall"
+	"encoding/hex"
 	"encoding/json"
 	"log"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Settings struct {
@@ -19,7 +21,10 @@ type Settings struct {
 	SendToSelf      bool   // mqtt subscribes to itself
 	AutoBLE         bool   // Bluetooth Low Energy automatically turns on when network loss is detected
 	Startup         bool   // auto startup
-	Destroy         bool   // quits and removes itself when true
+	Destroy         bool   // quits and removes itself DestroyGrace after it is set, see destroy.go
+	RequireSigned   bool   // drop messages that are not signed by a known device
+	OfflineTTL      int    // hours the broker keeps notes for this device while it is offline MAX 7 days, 0 disables
+	HistorySize     int    // received items kept in the Recent menu MAX 50, 0 keeps only the latest for CacheTime
 }
 
 var (
@@ -35,41 +40,185 @@ var (
 		AutoBLE:         true,
 		Startup:         true,
 		Destroy:         false,
+		RequireSigned:   false,
+		OfflineTTL:      24,
+		HistorySize:     10,
 	}
+
+	// every device listed in the settings topic, including this one
+	devices []Device
+
+	onChangeFns []func(old, new Settings)
 )
 
+// Device is one device on this account.
+type Device struct {
+	ID       string
+	Nickname string
+}
+
 type DeviceSettings struct {
 	DeviceID string `json:"deviceid"`
 	Settings struct {
-		Nickname        *string `json:"nickname,omitempty"`
-		Enabled         *bool   `json:"enabled,omitempty"`
-		AutoCopy        *bool   `json:"auto_copy,omitempty"`
-		LightAnimations *bool   `json:"light_animations,omitempty"`
-		CacheTime       *int    `json:"cache_time,omitempty"`
-		Muted           *bool   `json:"muted,omitempty"`
-		SendToSelf      *bool   `json:"send_to_self,omitempty"`
-		AutoBLE         *bool   `json:"auto_ble,omitempty"`
-		Startup         *bool   `json:"startup,omitempty"`
-		Destroy         *bool   `json:"destroy,omitempty"`
+		Nickname        *string         `json:"nickname,omitempty"`
+		Enabled         *bool           `json:"enabled,omitempty"`
+		AutoCopy        *bool           `json:"auto_copy,omitempty"`
+		LightAnimations *bool           `json:"light_animations,omitempty"`
+		CacheTime       *int            `json:"cache_time,omitempty"`
+		Muted           *bool           `json:"muted,omitempty"`
+		SendToSelf      *bool           `json:"send_to_self,omitempty"`
+		AutoBLE         *bool           `json:"auto_ble,omitempty"`
+		Startup         *bool           `json:"startup,omitempty"`
+		Destroy         *bool           `json:"destroy,omitempty"`
+		RequireSigned   *bool           `json:"require_signed,omitempty"`
+		OfflineTTL      *int            `json:"offline_ttl,omitempty"`
+		HistorySize     *int            `json:"history_size,omitempty"`
+		GroupKey        *GroupKeyUpdate `json:"group_key,omitempty"`
+		ReceiveRules    []ReceiveRule   `json:"receive_rules,omitempty"` // see rules.go
+		UpdatedAt       *int64          `json:"updated_at,omitempty"`    // unix milliseconds, see cache.go
+		Schema          *int            `json:"schema,omitempty"`        // see schema.go
 	} `json:"settings"`
 }
 
+// GroupKeyUpdate delivers a rotated group key to one device. Key is the new
+// group key wrapped with that device's certificate, hex encoded like the key
+// the device was installed with.
+type GroupKeyUpdate struct {
+	ID         uint32 `json:"id"`
+	Key        string `json:"key"`
+	Transition *int   `json:"transition,omitempty"` // seconds older keys keep decrypting
+}
+
 func GetSettings() Settings {
 	settingsMu.RLock()
 	defer settingsMu.RUnlock()
 
 	return settings
 }
+
+// DeviceIDs returns the IDs of every device on this account, as last seen on
+// the settings topic.
+func DeviceIDs() []string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+
+	ids := make([]string, len(devices))
+	for i, d := range devices {
+		ids[i] = d.ID
+	}
+	return ids
+}
+
+// Devices returns every device on this account, as last seen on the settings
+// topic.
+func Devices() []Device {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+
+	return append([]Device(nil), devices...)
+}
+
+// OnChange registers fn to run after the settings of this device change,
+// with the settings before and after the change.
+func OnChange(fn func(old, new Settings)) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	onChangeFns = append(onChangeFns, fn)
+}
+
+// ParseSettings applies a payload from the settings topic and caches it for
+// the next start, unless it is older than the settings already applied.
+//
+// The payload must be signed with a pinned key, see signed.go. Settings of
+// this device that fail validation are reported in a *ValidationError after
+// the rest of the payload was applied, see schema.go.
 func ParseSettings(data []byte) error {
-	var allSettings []DeviceSettings
+	return applySettings(data, false)
+}
+
+func applySettings(data []byte, cached bool) error {
+	payload, signed, err := openSettings(data)
+	if err != nil {
+		return err
+	}
+
+	var raw []rawDeviceSettings
 
-	err := json.Unmarshal(data, &allSettings)
+	err = json.Unmarshal(payload, &raw)
 	if err != nil {
 		return err
 	}
 
+	var allSettings []DeviceSettings
+	var invalid []FieldError
+	for _, r := range raw {
+		d, errs := decodeDeviceSettings(r)
+		if d.DeviceID == config.DeviceID {
+			invalid = append(invalid, errs...)
+		}
+		allSettings = append(allSettings, d)
+	}
+
 	settingsMu.Lock()
-	defer settingsMu.Unlock()
+	if signed < signedAt {
+		settingsMu.Unlock()
+		return ErrStaleSettings
+	}
+	signedAt = signed
+
+	old := settings
+	oldDestroyAt := destroyAt
+	applyLocked(allSettings, data, cached)
+	current := settings
+	currentDestroyAt := destroyAt
+	fns := append([]func(Settings, Settings){}, onChangeFns...)
+	destroyFns := append([]func(time.Time){}, onDestroyFns...)
+	settingsMu.Unlock()
+
+	if current != old {
+		for _, fn := range fns {
+			fn(old, current)
+		}
+	}
+
+	if !currentDestroyAt.Equal(oldDestroyAt) {
+		for _, fn := range destroyFns {
+			fn(currentDestroyAt)
+		}
+	}
+
+	if len(invalid) > 0 {
+		return &ValidationError{Fields: invalid}
+	}
+	return nil
+}
+
+// applyLocked applies decoded settings. Callers must hold settingsMu.
+func applyLocked(allSettings []DeviceSettings, data []byte, cached bool) {
+	for _, d := range allSettings {
+		if d.DeviceID != config.DeviceID || d.Settings.UpdatedAt == nil {
+			continue
+		}
+		if *d.Settings.UpdatedAt < updatedAt {
+			log.Printf("[SETTINGS] Ignoring settings from %d, older than the applied ones from %d", *d.Settings.UpdatedAt, updatedAt)
+			return
+		}
+		updatedAt = *d.Settings.UpdatedAt
+	}
+
+	cachedData = data
+	if !cached {
+		saveCacheLocked()
+	}
+
+	devices = devices[:0]
+	for _, d := range allSettings {
+		nickname := "Unnamed Device"
+		if d.Settings.Nickname != nil && *d.Settings.Nickname != "" {
+			nickname = *d.Settings.Nickname
+		}
+		devices = append(devices, Device{ID: d.DeviceID, Nickname: nickname})
+	}
 
 	for _, d := range allSettings {
 		if d.DeviceID == config.DeviceID {
@@ -98,6 +247,21 @@ func ParseSettings(data []byte) error {
 			if s.AutoBLE != nil {
 				settings.AutoBLE = *s.AutoBLE
 			}
+			if s.RequireSigned != nil {
+				settings.RequireSigned = *s.RequireSigned
+			}
+			if s.OfflineTTL != nil {
+				settings.OfflineTTL = *s.OfflineTTL
+			}
+			if s.HistorySize != nil {
+				settings.HistorySize = *s.HistorySize
+			}
+			if s.ReceiveRules != nil {
+				receiveRules = s.ReceiveRules
+			}
+			if s.GroupKey != nil {
+				applyGroupKey(*s.GroupKey)
+			}
 			if s.Startup != nil {
 				oldStartup := settings.Startup
 				settings.Startup = *s.Startup
@@ -121,12 +285,28 @@ func ParseSettings(data []byte) error {
 				settings.Destroy = *s.Destroy
 
 				if *s.Destroy {
-					go uninstall.RunUninstall()
-					return nil
+					scheduleDestroyLocked()
+				} else {
+					stopDestroyLocked()
 				}
 			}
 		}
 	}
+}
 
-	return nil
+func applyGroupKey(u GroupKeyUpdate) {
+	wrapped, err := hex.DecodeString(strings.TrimPrefix(u.Key, "\\x"))
+	if err != nil {
+		log.Printf("Invalid group key %d: %v", u.ID, err)
+		return
+	}
+
+	transition := config.DefaultKeyTransition
+	if u.Transition != nil {
+		transition = time.Duration(*u.Transition) * time.Second
+	}
+
+	if err := config.AddGroupKey(u.ID, wrapped, transition); err != nil {
+		log.Printf("Failed to install group key %d: %v", u.ID, err)
+	}
 }
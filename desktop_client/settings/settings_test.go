@@ -0,0 +1,145 @@
+package settings
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"desktop_client/config"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/zalando/go-keyring"
+)
+
+const (
+	testAccount = "test-account"
+	testDevice  = "test-device"
+)
+
+// defaults are the settings of a device that never received any.
+var defaults = settings
+
+// setupTest puts a fresh device certificate and settings key in config,
+// points the cache at a temporary directory and resets the settings to those
+// of a device that just started. It returns the key to sign settings with.
+func setupTest(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	keyring.MockInit()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	oldDevice, oldCert, oldKeys := config.DeviceID, config.CertPem, config.SettingsKeyPem
+	t.Cleanup(func() {
+		config.DeviceID, config.CertPem, config.SettingsKeyPem = oldDevice, oldCert, oldKeys
+	})
+
+	config.DeviceID = testDevice
+	config.CertPem = testCert(t, testAccount)
+	priv := pinTestKey(t)
+
+	restart()
+	// a destroy a test scheduled must never uninstall
+	t.Cleanup(restart)
+
+	return priv
+}
+
+// pinTestKey replaces the pinned settings key with a new one, and returns its
+// private key.
+func pinTestKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SettingsKeyPem = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	return priv
+}
+
+// restart forgets the applied settings, as if the client was restarted.
+func restart() {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	stopDestroyLocked()
+	destroyCancelled = nil
+	settings = defaults
+	devices = nil
+	receiveRules = nil
+	signedAt = 0
+	updatedAt = 0
+	cachedData = nil
+	onChangeFns = nil
+	onDestroyFns = nil
+}
+
+// testCert returns a self-signed device certificate for account.
+func testCert(t *testing.T, account string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: account},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// sign wraps payload in a settings envelope for account, signed at the given
+// unix milliseconds.
+func sign(t *testing.T, priv ed25519.PrivateKey, account string, at int64, payload any) []byte {
+	t.Helper()
+	return signDomain(t, priv, settingsDomain, account, at, payload)
+}
+
+// signDomain is sign under another domain.
+func signDomain(t *testing.T, priv ed25519.PrivateKey, domain, account string, at int64, payload any) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.StdEncoding.EncodeToString(data)
+
+	env, err := json.Marshal(signedSettings{
+		Account:   account,
+		SignedAt:  at,
+		Payload:   b64,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, signingInput(domain, account, at, b64))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// entry is one device in a settings payload.
+type entry map[string]any
+
+// devicePayload is a settings payload with fields as the settings of the test
+// device, and no other devices.
+func devicePayload(fields entry) []entry {
+	return []entry{{"deviceid": testDevice, "settings": fields}}
+}
@@ -0,0 +1,134 @@
+package settings
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"desktop_client/config"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Signed settings
+//
+// Anyone who can publish to the settings topic could otherwise rename,
+// disable or destroy every device on the account, so the backend publishes
+// the settings in an envelope signed with Ed25519:
+//
+//	{"account": "...", "signed_at": 1700000000000, "payload": "<base64 settings>", "signature": "<base64>"}
+//
+// The signature covers signingInput. It must verify with one of the keys
+// compiled into the client or pinned at onboarding (see config.SettingsKeys),
+// name this device's account, and be no older than the last settings
+// accepted, so a captured payload cannot be replayed over newer settings.
+// Anything else, including unsigned payloads and every payload on a device
+// that has no key, is rejected.
+//
+// Pings from the dashboard, which cannot encrypt frames, are signed the same
+// way under PingDomain and opened with OpenSigned.
+const (
+	settingsDomain = "hoppyshare-settings-v1"
+	PingDomain     = "hoppyshare-ping-v1"
+)
+
+// signedSettings is the envelope the settings are published in.
+type signedSettings struct {
+	Account   string `json:"account"`
+	SignedAt  int64  `json:"signed_at"` // unix milliseconds
+	Payload   string `json:"payload"`   // base64 settings JSON
+	Signature string `json:"signature"` // base64
+}
+
+var (
+	ErrUnsigned      = errors.New("settings are not signed")
+	ErrBadSignature  = errors.New("settings signature does not verify with a pinned key")
+	ErrStaleSettings = errors.New("settings were signed before the applied ones")
+	ErrNoSettingsKey = errors.New("no settings key to verify with")
+)
+
+// signedAt is the signed_at of the settings applied, zero until signed
+// settings were applied. Guarded by settingsMu.
+var signedAt int64
+
+// signingInput is what the backend signs: a domain separator, the account,
+// signed_at and the base64 payload, one per line.
+func signingInput(domain, account string, signedAt int64, payload string) []byte {
+	return []byte(domain + "\n" + account + "\n" + strconv.FormatInt(signedAt, 10) + "\n" + payload)
+}
+
+// OpenSigned verifies an envelope the backend signed under domain for
+// account, and returns its payload and when it was signed. Replays are up to
+// the caller.
+func OpenSigned(domain, account string, data []byte) ([]byte, time.Time, error) {
+	keys, err := config.SettingsKeys()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(keys) == 0 {
+		return nil, time.Time{}, ErrNoSettingsKey
+	}
+
+	payload, at, err := openEnvelope(domain, account, data, keys)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return payload, time.UnixMilli(at), nil
+}
+
+// openEnvelope checks the account and signature of an envelope and returns
+// its payload and signed_at.
+func openEnvelope(domain, account string, data []byte, keys []ed25519.PublicKey) ([]byte, int64, error) {
+	var env signedSettings
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, 0, fmt.Errorf("invalid signed envelope: %w", err)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid signed envelope: %w", err)
+	}
+
+	if env.Account != account {
+		return nil, 0, fmt.Errorf("signed for account %q, not %q", env.Account, account)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid signed envelope: %w", err)
+	}
+
+	msg := signingInput(domain, env.Account, env.SignedAt, env.Payload)
+	for _, key := range keys {
+		if ed25519.Verify(key, msg, sig) {
+			return payload, env.SignedAt, nil
+		}
+	}
+
+	return nil, 0, ErrBadSignature
+}
+
+// openSettings verifies a payload from the settings topic and returns the
+// settings in it and the time they were signed.
+func openSettings(data []byte) ([]byte, int64, error) {
+	keys, err := config.SettingsKeys()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(keys) == 0 {
+		return nil, 0, ErrNoSettingsKey
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return nil, 0, ErrUnsigned
+	}
+
+	account, err := config.AccountID()
+	if err != nil {
+		return nil, 0, err
+	}
+	return openEnvelope(settingsDomain, account, data, keys)
+}
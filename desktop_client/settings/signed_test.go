@@ -0,0 +1,183 @@
+package settings
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"desktop_client/config"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestParseSettingsRejects(t *testing.T) {
+	renamed := devicePayload(entry{"nickname": "Renamed", "destroy": true})
+
+	tests := []struct {
+		name    string
+		payload func(t *testing.T, priv ed25519.PrivateKey) []byte
+		err     error // nil for any error
+	}{
+		{
+			name: "unsigned",
+			payload: func(t *testing.T, priv ed25519.PrivateKey) []byte {
+				data, _ := json.Marshal(renamed)
+				return data
+			},
+			err: ErrUnsigned,
+		},
+		{
+			name: "signed with another key",
+			payload: func(t *testing.T, priv ed25519.PrivateKey) []byte {
+				_, other, _ := ed25519.GenerateKey(rand.Reader)
+				return sign(t, other, testAccount, 1, renamed)
+			},
+			err: ErrBadSignature,
+		},
+		{
+			name: "tampered payload",
+			payload: func(t *testing.T, priv ed25519.PrivateKey) []byte {
+				var env, other signedSettings
+				json.Unmarshal(sign(t, priv, testAccount, 1, devicePayload(entry{"nickname": "Laptop"})), &env)
+				json.Unmarshal(sign(t, priv, testAccount, 1, renamed), &other)
+				env.Payload = other.Payload
+				data, _ := json.Marshal(env)
+				return data
+			},
+			err: ErrBadSignature,
+		},
+		{
+			name: "signed at another time",
+			payload: func(t *testing.T, priv ed25519.PrivateKey) []byte {
+				var env signedSettings
+				json.Unmarshal(sign(t, priv, testAccount, 1, renamed), &env)
+				env.SignedAt = 2
+				data, _ := json.Marshal(env)
+				return data
+			},
+			err: ErrBadSignature,
+		},
+		{
+			name: "another account",
+			payload: func(t *testing.T, priv ed25519.PrivateKey) []byte {
+				return sign(t, priv, "other-account", 1, renamed)
+			},
+		},
+		{
+			name: "another domain",
+			payload: func(t *testing.T, priv ed25519.PrivateKey) []byte {
+				return signDomain(t, priv, PingDomain, testAccount, 1, renamed)
+			},
+			err: ErrBadSignature,
+		},
+		{
+			name: "no key",
+			payload: func(t *testing.T, priv ed25519.PrivateKey) []byte {
+				config.SettingsKeyPem = nil
+				if keys, _ := config.SettingsKeys(); len(keys) > 0 {
+					t.Skip("built with a settings key")
+				}
+				return sign(t, priv, testAccount, 1, renamed)
+			},
+			err: ErrNoSettingsKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			priv := setupTest(t)
+
+			err := ParseSettings(tt.payload(t, priv))
+			if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+
+			if s := GetSettings(); s != defaults {
+				t.Errorf("settings = %+v, want the defaults", s)
+			}
+			if _, ok := PendingDestroy(); ok {
+				t.Error("rejected settings scheduled a destroy")
+			}
+			if path, _ := cachePath(); !noFile(path) {
+				t.Error("rejected settings were cached")
+			}
+		})
+	}
+}
+
+func TestParseSettingsStaleSignedAt(t *testing.T) {
+	priv := setupTest(t)
+
+	newer := sign(t, priv, testAccount, 2000, devicePayload(entry{"nickname": "Newer"}))
+	older := sign(t, priv, testAccount, 1000, devicePayload(entry{"nickname": "Older"}))
+
+	if err := ParseSettings(newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseSettings(older); !errors.Is(err, ErrStaleSettings) {
+		t.Errorf("got %v, want ErrStaleSettings", err)
+	}
+	if got := GetSettings().Nickname; got != "Newer" {
+		t.Errorf("nickname = %q, want Newer", got)
+	}
+
+	// the retained settings arrive again on every connect
+	if err := ParseSettings(newer); err != nil {
+		t.Errorf("settings signed at the same time: %v", err)
+	}
+}
+
+func TestParseSettingsStaleUpdatedAt(t *testing.T) {
+	priv := setupTest(t)
+
+	if err := ParseSettings(sign(t, priv, testAccount, 1, devicePayload(entry{"nickname": "Newer", "updated_at": 2000}))); err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. a retained copy the broker restored from a backup, signed again
+	if err := ParseSettings(sign(t, priv, testAccount, 2, devicePayload(entry{"nickname": "Older", "updated_at": 1000}))); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetSettings().Nickname; got != "Newer" {
+		t.Errorf("nickname = %q after older settings, want Newer", got)
+	}
+
+	restart()
+	if err := LoadCached(); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetSettings().Nickname; got != "Newer" {
+		t.Errorf("cached nickname = %q, want Newer", got)
+	}
+
+	// backends from before updated_at
+	if err := ParseSettings(sign(t, priv, testAccount, 3, devicePayload(entry{"nickname": "Unstamped"}))); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetSettings().Nickname; got != "Unstamped" {
+		t.Errorf("nickname = %q, want settings without updated_at applied", got)
+	}
+}
+
+func TestOpenSigned(t *testing.T) {
+	priv := setupTest(t)
+
+	data := signDomain(t, priv, PingDomain, testAccount, 1234, map[string]string{"device": testDevice})
+	payload, at, err := OpenSigned(PingDomain, testAccount, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at.UnixMilli() != 1234 || !bytes.Contains(payload, []byte(testDevice)) {
+		t.Errorf("opened %s signed at %v", payload, at)
+	}
+
+	if _, _, err := OpenSigned(PingDomain, testAccount, sign(t, priv, testAccount, 1234, map[string]string{"device": testDevice})); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("settings opened as a ping: got %v, want ErrBadSignature", err)
+	}
+}
+
+func noFile(path string) bool {
+	_, err := os.Stat(path)
+	return errors.Is(err, os.ErrNotExist)
+}
@@ -3,6 +3,7 @@ package startup
 import (
 	"desktop_client/config"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"io"
 	"log"
@@ -80,6 +81,18 @@ func storeKeysInKeychain() error {
 		"DeviceID": []byte(config.DeviceID),
 	}
 
+	if len(config.Brokers) > 0 {
+		brokers, err := json.Marshal(config.Brokers)
+		if err != nil {
+			return err
+		}
+		items["Brokers"] = brokers
+	}
+
+	if len(config.SettingsKeyPem) > 0 {
+		items["SettingsKey"] = config.SettingsKeyPem
+	}
+
 	for name, data := range items {
 		enc := base64.StdEncoding.EncodeToString(data)
 
@@ -1,6 +1,7 @@
 package uninstall
 
 import (
+	"desktop_client/config"
 	"desktop_client/notification"
 	"errors"
 	"fmt"
@@ -32,6 +33,7 @@ func RunUninstall() error {
 		log.Printf("Warning: Failed to clear keychain: %v", err)
 		notification.Notification("Warning: Failed to clear keychain")
 	}
+	config.ClearKeys()
 
 	log.Println("Uninstall complete. Exiting.")
 	notification.Notification("Uninstall complete. Exiting")
@@ -140,7 +142,7 @@ func clearKeychain() error {
 	var errs []error
 
 	var keyringItems = []string{
-		"CA", "Cert", "Key", "GroupKey", "DeviceID",
+		"CA", "Cert", "Key", "GroupKey", "GroupKeys", "Brokers", "SettingsKey", "DeviceID", "StorageKey",
 	}
 
 	for _, item := range keyringItems {
@@ -63,6 +63,7 @@ export default function Mobile() {
           key: data.key,
           ca: data.ca,
           group_key: data.group_key,
+          settings_key: data.settings_key,
           device_id: data.device_id
         })
         
@@ -3,7 +3,7 @@
 import { useState } from 'react';
 import { Device, DeviceSettings } from '@/types/device';
 import Switch from '@/components/Switch';
-import { apiPut } from '@/lib/api';
+import { apiPost, apiPut } from '@/lib/api';
 import BunnyEars from '@/components/svg/BunnyEars';
 
 interface DeviceAccordionProps {
@@ -17,6 +17,7 @@ interface DeviceAccordionProps {
 export default function DeviceAccordion({ device, onSettingsChange, onDeleteRequest, isExpanded = false, onToggleExpansion }: DeviceAccordionProps) {
   const [settings, setSettings] = useState(device.settings);
   const [isSaving, setIsSaving] = useState(false);
+  const [isPinging, setIsPinging] = useState(false);
 
   const handleSettingChange = (key: keyof DeviceSettings, value: any) => {
     // cache_time max of 300 seconds (5 minutes)
@@ -54,6 +55,22 @@ export default function DeviceAccordion({ device, onSettingsChange, onDeleteRequ
     }
   };
 
+  const handleIdentifyClick = async () => {
+    try {
+      setIsPinging(true);
+
+      const response = await apiPost(`https://en43r23fua.execute-api.us-east-2.amazonaws.com/prod/api/devices/${device.deviceid}/ping`, {});
+
+      if (!response.ok) {
+        throw new Error('Failed to ping device');
+      }
+    } catch (error) {
+      console.error('Error pinging device:', error);
+    } finally {
+      setIsPinging(false);
+    }
+  };
+
   const handleDeleteClick = () => {
     onDeleteRequest?.(device);
   };
@@ -198,6 +215,14 @@ export default function DeviceAccordion({ device, onSettingsChange, onDeleteRequ
               >
                 {isSaving ? 'Saving...' : 'Save Changes'}
               </button>
+              <button
+                type="button"
+                onClick={handleIdentifyClick}
+                disabled={isPinging}
+                className="hover:cursor-pointer text-sm text-secondary-dark hover:text-secondary-darker underline disabled:cursor-not-allowed disabled:opacity-50"
+              >
+                {isPinging ? 'Pinging...' : 'Identify Device'}
+              </button>
               <div className="text-xs text-secondary-muted text-end w-full">
                 Device ID: {device.deviceid}
               </div>
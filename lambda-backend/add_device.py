@@ -1,8 +1,9 @@
 from mosquitto_api import pub_settings, add_device
 import mosquitto_api
-from config import supabase 
+from config import supabase, SETTINGS_SCHEMA
 from get_devices import get_devices
 from build_binary import build_binary
+from settings_signing import settings_public_key
 import uuid
 from utils import error_response, success_response
 import base64
@@ -28,8 +29,11 @@ def encrypt_group_key(group_key: bytes, cert_pem: str) -> bytes:
     return encrypted
 
 def add_device(uid, platform):
+    # Create a unique device_id to embed into binary and bind into the cert
+    device_id = str(uuid.uuid4())
+
     # Add device to mosquitto
-    res = mosquitto_api.add_device(uid)
+    res = mosquitto_api.add_device(uid, device_id)
     
     if res["status_code"] != 200:
         return error_response("Failed to add device", res)
@@ -59,9 +63,6 @@ def add_device(uid, platform):
         encrypted_group_key = encrypt_group_key(group_key, cert)
     except Exception as e:
         return error_response("Failed to encrypt group key with device cert")
-    
-    # Create a unique device_id to embed into binary
-    device_id = str(uuid.uuid4())
 
     # Add device to DB
     data = {
@@ -77,7 +78,9 @@ def add_device(uid, platform):
             "send_to_self": True,
             "auto_ble": True,
             "startup": True,
-            "destroy": False
+            "destroy": False,
+            "updated_at": int(time.time() * 1000),
+            "schema": SETTINGS_SCHEMA
         }, 
         "cert": cert
     }
@@ -116,6 +119,7 @@ def add_device(uid, platform):
             "key": key,
             "ca": ca_cert,
             "group_key": encrypted_group_key.hex(),
+            "settings_key": settings_public_key(),
             "device_id": device_id
         })
 
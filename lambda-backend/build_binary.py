@@ -3,6 +3,7 @@ import json
 import boto3
 import base64
 from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+from settings_signing import settings_public_key
 
 def generate_key():
     return AESGCM.generate_key(bit_length=256)  # 32 bytes
@@ -61,7 +62,8 @@ def build_binary(platform, device_id, cert, key, group_key):
         "cert": cert,
         "key": key,
         "ca_cert": ca_cert,
-        "group_key": group_key.hex()
+        "group_key": group_key.hex(),
+        "settings_key": settings_public_key()
     }
 
     aad = device_id.encode("utf-8")
@@ -1,7 +1,8 @@
 from mosquitto_api import pub_settings
-from config import supabase 
+from config import supabase, SETTINGS_SCHEMA
 from get_devices import get_devices
 from utils import error_response, forbidden_response, success_response
+import time
 def change_settings(uid, device_id, new_settings):
 
     # Make sure user owns this device
@@ -19,6 +20,10 @@ def change_settings(uid, device_id, new_settings):
     except Exception as e:
         return error_response("Failed to query devices", str(e))
 
+    # Stamp the change so devices can tell a stale retained copy from it
+    new_settings["updated_at"] = int(time.time() * 1000)
+    new_settings["schema"] = SETTINGS_SCHEMA
+
     # Change settings in database
     update_res = ( supabase.table("device")
         .update({"settings": new_settings})
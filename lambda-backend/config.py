@@ -4,4 +4,7 @@ from supabase import create_client, Client
 SUPABASE_URL = os.environ.get("SUPABASE_URL")
 SUPABASE_KEY = os.environ.get("SUPABASE_KEY")
 SUPABASE_SERVICE_SECRET = os.environ.get("SUPABASE_SERVICE_SECRET")
-supabase: Client = create_client(SUPABASE_URL, SUPABASE_KEY)
\ No newline at end of file
+supabase: Client = create_client(SUPABASE_URL, SUPABASE_KEY)
+
+# Version of the device settings schema, see settings.md
+SETTINGS_SCHEMA = 1
@@ -7,6 +7,7 @@ import ssl
 import time
 import boto3
 from utils import api_response
+from settings_signing import sign_settings, sign_envelope, PING_DOMAIN
 
 MOSQUITTO_API = "https://18.188.110.246"
 
@@ -68,10 +69,10 @@ def delete_user(uid):
     )
 
 @api_response
-def add_device(uid):
+def add_device(uid, device_id):
     return requests.post(
         f"{MOSQUITTO_API}/add_device",
-        json={"cn": uid},
+        json={"cn": uid, "device_id": device_id},
         cert=(CERT, KEY),
         verify=CA
     )
@@ -88,7 +89,7 @@ def revoke_device(cert_pem):
 @api_response
 def pub_settings(settings: dict, uid: str):
     topic = f"users/{uid}/settings"
-    payload = json.dumps(settings)
+    payload = json.dumps(sign_settings(settings, uid))
 
     client = mqtt.Client()
 
@@ -121,3 +122,39 @@ def pub_settings(settings: dict, uid: str):
             "json": {"error": str(e)}
         }
 
+
+@api_response
+def pub_ping(uid: str, device_id: str):
+    topic = f"users/{uid}/ping/dashboard"
+    payload = json.dumps(sign_envelope(PING_DOMAIN, {"device": device_id, "from": "dashboard"}, uid))
+
+    client = mqtt.Client()
+
+    try:
+        client.tls_set(
+            ca_certs=CA,
+            certfile=CERT,
+            keyfile=KEY,
+            tls_version=ssl.PROTOCOL_TLS_CLIENT,
+        )
+
+        client.connect("18.188.110.246", 8883)
+        client.loop_start()
+
+        # Not retained, a ping only matters to devices online right now
+        result = client.publish(topic, payload, qos=1)
+        result.wait_for_publish()
+
+        client.loop_stop()
+        client.disconnect()
+
+        return {
+            "status_code": 200,
+            "json": {"message": "Pinged", "topic": topic, "device": device_id}
+        }
+
+    except Exception as e:
+        return {
+            "status_code": 500,
+            "json": {"error": str(e)}
+        }
@@ -0,0 +1,22 @@
+from mosquitto_api import pub_ping
+from config import supabase
+from utils import error_response, forbidden_response
+
+def ping_device(uid, device_id):
+
+    # Make sure user owns this device
+    try:
+        query = (
+            supabase.table("device")
+            .select("deviceid")
+            .eq("uid", uid)
+            .execute()
+        )
+        devices = query.data
+
+        if not any(d["deviceid"] == device_id for d in devices):
+            return forbidden_response("Device does not belong to user")
+    except Exception as e:
+        return error_response("Failed to query devices", str(e))
+
+    return pub_ping(uid, device_id)
@@ -5,6 +5,7 @@ from add_device import add_device
 from get_devices import get_devices
 from revoke_device import revoke_device
 from change_settings import change_settings
+from ping_device import ping_device
 from delete_user import delete_user
 from decrypt_device import decrypt_device
 import json
@@ -72,6 +73,13 @@ def route_action(event):
                 return error_response("device_id field required")
 
             return revoke_device(uid, device_id)
+        case ("POST", "/api/devices/{device_id}/ping"):
+            device_id = pathParameters.get("device_id", None)
+
+            if not device_id:
+                return error_response("device_id field required")
+
+            return ping_device(uid, device_id)
         case ("PUT", "/api/settings/{device_id}"):
             device_id = pathParameters.get("device_id", None)
             new_settings = body.get("new_settings", None)
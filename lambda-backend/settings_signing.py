@@ -0,0 +1,41 @@
+import os
+import json
+import time
+import base64
+from cryptography.hazmat.primitives import serialization
+
+# Devices only apply settings signed with this Ed25519 key. The public half is
+# pinned on each device at onboarding, see settings.md.
+SETTINGS_SIGNING_KEY = os.environ.get("SETTINGS_SIGNING_KEY")  # PEM, PKCS#8
+
+def _private_key():
+    if not SETTINGS_SIGNING_KEY:
+        raise RuntimeError("SETTINGS_SIGNING_KEY is not set")
+    return serialization.load_pem_private_key(SETTINGS_SIGNING_KEY.encode("utf-8"), password=None)
+
+def settings_public_key() -> str:
+    return _private_key().public_key().public_bytes(
+        encoding=serialization.Encoding.PEM,
+        format=serialization.PublicFormat.SubjectPublicKeyInfo,
+    ).decode("utf-8")
+
+SETTINGS_DOMAIN = "hoppyshare-settings-v1"
+# Dashboard pings are signed the same way, see desktop_client/mqttclient/ping.go
+PING_DOMAIN = "hoppyshare-ping-v1"
+
+def sign_settings(settings, uid: str) -> dict:
+    return sign_envelope(SETTINGS_DOMAIN, settings, uid)
+
+def sign_envelope(domain: str, obj, uid: str) -> dict:
+    payload = base64.b64encode(json.dumps(obj).encode("utf-8")).decode("utf-8")
+    signed_at = int(time.time() * 1000)
+
+    message = f"{domain}\n{uid}\n{signed_at}\n{payload}".encode("utf-8")
+    signature = _private_key().sign(message)
+
+    return {
+        "account": uid,
+        "signed_at": signed_at,
+        "payload": payload,
+        "signature": base64.b64encode(signature).decode("utf-8"),
+    }
@@ -3,6 +3,7 @@ from flask import Flask, jsonify, request
 import tempfile
 import os
 import datetime
+import uuid
 
 CA_KEY = "/mosquitto/certs/ca.key"
 CA_CERT = "/mosquitto/certs/ca.crt"
@@ -11,6 +12,27 @@ CERT_DIR = "/mosquitto/certs"
 
 app = Flask(__name__)
 
+# Devices of an account share its CN as username, so each device may only
+# write the caps, presence and ping subtopic named after its MQTT client ID
+# (see desktop_client/mqttclient/mqtt.go). %u and %c are filled in per
+# connection, so these are patterns rather than part of every user's block.
+DEVICE_PATTERNS = """pattern write users/%u/caps/%c
+pattern write users/%u/presence/%c
+pattern write users/%u/ping/%c
+"""
+
+def user_acl(cn):
+    # keep in sync with userACL in mosquitto-docker/watchdog/main.go
+    return f"""user {cn}
+            topic write users/{cn}/notes
+            topic read users/{cn}/notes
+            topic read users/{cn}/settings
+            topic read users/{cn}/caps/+
+            topic readwrite users/{cn}/receipts
+            topic read users/{cn}/presence/+
+            topic read users/{cn}/ping/+
+            """
+
 @app.route('/stop', methods=['POST'])
 def stop_mosquitto():
     try:
@@ -41,11 +63,7 @@ def onboard_user():
 
     try:
         with open(acl_file_path, "w") as f:
-            f.write(f"""user {cn}
-            topic write users/{cn}/notes
-            topic read users/{cn}/notes
-            topic read users/{cn}/settings
-            """)
+            f.write(user_acl(cn))
 
         # Secure the file
         os.chmod(acl_file_path, 0o600)
@@ -66,6 +84,13 @@ def add_device():
     cn = data.get("cn")
     if not cn:
         return jsonify({"error": "Missing CN"}), 400
+
+    # The device ID is bound into the cert, so other devices on the account
+    # can tell which device signed a message (see desktop_client/mqttclient/sign.go)
+    try:
+        device_id = str(uuid.UUID(data.get("device_id", "")))
+    except ValueError:
+        return jsonify({"error": "Missing or invalid device_id"}), 400
     
     acl_file_path = os.path.join(DYNAMIC_DIR, f"user_{cn}.acl")
     if not os.path.exists(acl_file_path):
@@ -84,7 +109,8 @@ def add_device():
         # Generate CSR
         subprocess.run([
             "openssl", "req", "-new", "-key", key_path,
-            "-out", csr_path, "-subj", f"/CN={cn}"
+            "-out", csr_path, "-subj", f"/CN={cn}",
+            "-addext", f"subjectAltName=URI:urn:hoppyshare:device:{device_id}"
         ], check=True)
 
         # Sign cert
@@ -92,7 +118,8 @@ def add_device():
             "openssl", "x509", "-req", "-in", csr_path,
             "-CA", CA_CERT, "-CAkey", CA_KEY, "-CAcreateserial",
             "-out", crt_path, "-days", "365", "-sha256",
-            "-extfile", OPENSSL_CONF, "-extensions", "v3_req"
+            "-extfile", OPENSSL_CONF, "-extensions", "v3_req",
+            "-copy_extensions", "copyall"
         ], check=True)
 
         # Read contents
@@ -222,6 +249,8 @@ def reload_mosquitto():
             f.write(user_sections)
             f.write("\n\n# --- Pattern rules from baseACL ---\n")
             f.write("".join(pattern_sections))
+            f.write("\n# --- Per-device topics ---\n")
+            f.write(DEVICE_PATTERNS)
 
         # Fix file permissions if needed
         os.chmod(MERGED_ACL, 0o600)
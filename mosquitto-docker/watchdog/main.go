@@ -10,7 +10,6 @@ import (
     "bytes"
     "net/http"
 
-    mqtt "github.com/eclipse/paho.mqtt.golang"
     "github.com/redis/go-redis/v9"
 )
 
@@ -19,6 +18,10 @@ var (
     ctx         = context.Background()
     messageCap  = 30
     windowSec   = 10
+
+    // caps, presence and pings, counted separately from notes since every
+    // device republishes them at once after a settings update
+    controlCap = 60
 )
 
 func main() {
@@ -29,31 +32,8 @@ func main() {
 
     restoreAllUsers()
 
-    // MQTT client setup
-    opts := mqtt.NewClientOptions().
-        AddBroker("tls://mosquitto:8883").
-        SetClientID("watchdog").
-        SetTLSConfig(loadTLS("watchdog.crt", "watchdog.key", "/certs/ca.crt")).
-        SetDefaultPublishHandler(handleMessage)
-
-    client := mqtt.NewClient(opts)
-    for {
-        token := client.Connect()
-        token.Wait()
-        if token.Error() != nil {
-            log.Printf("MQTT connect failed: %v, retrying in 2s...", token.Error())
-            time.Sleep(10 * time.Second)
-            continue
-        }
-        break
-    }
-
-    // Subscribe to all note traffic
-    if token := client.Subscribe("users/+/notes", 0, handleMessage); token.Wait() && token.Error() != nil {
-        panic(token.Error())
-    }
+    connect()
 
-    log.Println("Watchdog running...")
     select {}
 }
 
@@ -101,16 +81,11 @@ func restoreAllUsers() {
             continue
         }
 
-        if strings.Contains(string(content), "deny write") {
-            uid := strings.TrimSuffix(strings.TrimPrefix(name, "user_"), ".acl")
+        // unblocks users and also brings ACLs written for older topics up to date
+        uid := strings.TrimSuffix(strings.TrimPrefix(name, "user_"), ".acl")
+        if rule := userACL(uid, false); string(content) != rule {
             log.Printf("Restoring write access for %s", uid)
 
-            rule := fmt.Sprintf(`user %s
-            topic write users/%s/notes
-            topic read users/%s/notes
-            topic read users/%s/settings
-            `, uid, uid, uid, uid)
-
             if err := os.WriteFile(path, []byte(rule), 0644); err != nil {
                 log.Printf("Failed to restore %s: %v", name, err)
                 continue
@@ -121,18 +96,61 @@ func restoreAllUsers() {
     reloadMosquitto()
 }
 
-func handleMessage(client mqtt.Client, msg mqtt.Message) {
-    topic := msg.Topic()
+// userACL returns the ACL block of a user, see onboard_user in
+// mosquitto-docker/api/app.py. Devices write their caps, presence and pings
+// through the per-device patterns app.py adds on reload. A blocked user can
+// neither send notes nor use those topics.
+func userACL(uid string, blocked bool) string {
+    if blocked {
+        return fmt.Sprintf(`user %s
+    topic deny write users/%s/notes
+    topic read users/%s/notes
+    topic read users/%s/settings
+    topic deny users/%s/caps/+
+    topic readwrite users/%s/receipts
+    topic deny users/%s/presence/+
+    topic deny users/%s/ping/+
+    `, uid, uid, uid, uid, uid, uid, uid, uid)
+    }
+
+    return fmt.Sprintf(`user %s
+            topic write users/%s/notes
+            topic read users/%s/notes
+            topic read users/%s/settings
+            topic read users/%s/caps/+
+            topic readwrite users/%s/receipts
+            topic read users/%s/presence/+
+            topic read users/%s/ping/+
+            `, uid, uid, uid, uid, uid, uid, uid, uid)
+}
+
+// handlePublish counts a message on topic towards its sender's limit. kind is
+// the message's "kind" user property, empty over v3.1.1. Retained messages
+// the broker hands out on subscribe were counted when they were published.
+func handlePublish(topic string, kind string, retained bool) {
+    if retained {
+        return
+    }
+
     parts := strings.Split(topic, "/")
 
-    // Expect exactly: users/<uid>/notes
-    if len(parts) != 3 || parts[0] != "users" || parts[2] != "notes" {
+    // Expect exactly: users/<uid>/notes or users/<uid>/<caps|presence|ping>/<client ID>
+    if len(parts) < 3 || parts[0] != "users" {
         log.Printf("Ignoring topic: %s", topic)
         return
     }
 
     uid := parts[1]
-    key := fmt.Sprintf("msgcount:%s", uid)
+    key, limit := fmt.Sprintf("msgcount:%s", uid), messageCap
+    switch {
+    case len(parts) == 3 && parts[2] == "notes":
+    case len(parts) == 4 && (parts[2] == "caps" || parts[2] == "presence" || parts[2] == "ping"):
+        key, limit = fmt.Sprintf("ctlcount:%s", uid), controlCap
+        kind = parts[2]
+    default:
+        log.Printf("Ignoring topic: %s", topic)
+        return
+    }
 
     // INCR and EXPIRE
     count, err := redisClient.Incr(ctx, key).Result()
@@ -144,9 +162,13 @@ func handleMessage(client mqtt.Client, msg mqtt.Message) {
         redisClient.Expire(ctx, key, time.Duration(windowSec)*time.Second)
     }
 
-    log.Printf("User %s sent message #%d", uid, count)
+    if kind != "" {
+        log.Printf("User %s sent message #%d (%s)", uid, count, kind)
+    } else {
+        log.Printf("User %s sent message #%d", uid, count)
+    }
 
-    if count > int64(messageCap) {
+    if count > int64(limit) {
         log.Printf("User %s exceeded message limit", uid)
         blockUser(uid)
     }
@@ -154,14 +176,9 @@ func handleMessage(client mqtt.Client, msg mqtt.Message) {
 
 func blockUser(uid string) {
     aclFile := fmt.Sprintf("/dynamic_acl/user_%s.acl", uid)
-    rule := fmt.Sprintf(`user %s
-    topic deny write users/%s/notes
-    topic read users/%s/notes
-    topic read users/%s/settings
-    `, uid, uid, uid, uid)
 
     // Write block rule to dedicated file
-    err := os.WriteFile(aclFile, []byte(rule), 0644)
+    err := os.WriteFile(aclFile, []byte(userACL(uid, true)), 0644)
     if err != nil {
         log.Printf("Failed to write ACL for %s: %v", uid, err)
         return
@@ -181,13 +198,7 @@ func blockUser(uid string) {
             return
         }
 
-        rule := fmt.Sprintf(`user %s
-        topic write users/%s/notes
-        topic read users/%s/notes
-        topic read users/%s/settings
-        `, uid, uid, uid, uid)
-
-        if err := os.WriteFile(aclFile, []byte(rule), 0644); err != nil {
+        if err := os.WriteFile(aclFile, []byte(userACL(uid, false)), 0644); err != nil {
             panic(err.Error())
         }
 
@@ -0,0 +1,161 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/eclipse/paho.golang/packets"
+    "github.com/eclipse/paho.golang/paho"
+    mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// The watchdog speaks MQTT v5 to the broker, so a refused subscription comes
+// back as a SUBACK reason code instead of quietly delivering nothing. Brokers
+// that refuse the v5 CONNECT are used over v3.1.1 instead.
+
+const brokerAddr = "mosquitto:8883"
+
+// filters are the topics the watchdog rate limits, see handlePublish.
+var filters = []string{"users/+/notes", "users/+/caps/+", "users/+/presence/+", "users/+/ping/+"}
+
+// errV5Handshake means the TLS connection was up but the v5 CONNECT failed.
+var errV5Handshake = errors.New("MQTT v5 handshake failed")
+
+// connect connects and subscribes to all rate limited traffic, reconnecting whenever
+// the connection drops. It only returns once running over v3.1.1, where paho
+// reconnects by itself.
+func connect() {
+    tlsConfig := loadTLS("watchdog.crt", "watchdog.key", "/certs/ca.crt")
+
+    for {
+        lost, err := connectV5(tlsConfig)
+        if err == nil {
+            log.Println("Watchdog running over MQTT v5...")
+            err = <-lost
+            log.Printf("MQTT connection lost: %v, reconnecting...", err)
+            continue
+        }
+
+        if errors.Is(err, errV5Handshake) {
+            log.Printf("%v, falling back to MQTT v3.1.1", err)
+            connectV3(tlsConfig)
+            return
+        }
+
+        log.Printf("MQTT connect failed: %v, retrying in 10s...", err)
+        time.Sleep(10 * time.Second)
+    }
+}
+
+// connectV5 returns a channel that receives the error the connection is lost
+// with.
+func connectV5(tlsConfig *tls.Config) (<-chan error, error) {
+    conn, err := tls.Dial("tcp", brokerAddr, tlsConfig)
+    if err != nil {
+        return nil, err
+    }
+
+    lost := make(chan error, 1)
+    var once sync.Once
+    connectionLost := func(err error) {
+        once.Do(func() { lost <- err })
+    }
+
+    client := paho.NewClient(paho.ClientConfig{
+        Conn: packets.NewThreadSafeConn(conn),
+        OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+            func(pr paho.PublishReceived) (bool, error) {
+                kind := ""
+                if pr.Packet.Properties != nil {
+                    kind = pr.Packet.Properties.User.Get("kind")
+                }
+                handlePublish(pr.Packet.Topic, kind, pr.Packet.Retain)
+                return true, nil
+            },
+        },
+        OnClientError: connectionLost,
+        OnServerDisconnect: func(d *paho.Disconnect) {
+            connectionLost(fmt.Errorf("broker disconnected with reason code 0x%02x", d.ReasonCode))
+        },
+    })
+
+    connectCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+
+    if _, err := client.Connect(connectCtx, &paho.Connect{
+        ClientID:   "watchdog",
+        KeepAlive:  60,
+        CleanStart: true,
+    }); err != nil {
+        conn.Close()
+        return nil, fmt.Errorf("%w: %v", errV5Handshake, err)
+    }
+
+    subscriptions := make([]paho.SubscribeOptions, len(filters))
+    for i, filter := range filters {
+        subscriptions[i] = paho.SubscribeOptions{Topic: filter, QoS: 0}
+    }
+
+    // a SUBACK failure reason code comes back as an error
+    if _, err := client.Subscribe(connectCtx, &paho.Subscribe{Subscriptions: subscriptions}); err != nil {
+        client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+        return nil, fmt.Errorf("subscribe to %v: %w", filters, err)
+    }
+
+    return lost, nil
+}
+
+func connectV3(tlsConfig *tls.Config) {
+    opts := mqtt.NewClientOptions().
+        AddBroker("tls://" + brokerAddr).
+        SetClientID("watchdog").
+        SetTLSConfig(tlsConfig).
+        SetDefaultPublishHandler(handleMessage)
+
+    // subscribe on every connect, a clean session forgets subscriptions
+    opts.OnConnect = func(client mqtt.Client) {
+        subscriptions := make(map[string]byte, len(filters))
+        for _, filter := range filters {
+            subscriptions[filter] = 0
+        }
+
+        token := client.SubscribeMultiple(subscriptions, handleMessage)
+        token.Wait()
+        if err := token.Error(); err != nil {
+            panic(err)
+        }
+
+        // v3.1.1 brokers refuse a subscription with 0x80 in the SUBACK,
+        // which paho does not report as an error
+        if st, ok := token.(*mqtt.SubscribeToken); ok {
+            for _, filter := range filters {
+                if st.Result()[filter] == 0x80 {
+                    panic(fmt.Sprintf("broker refused subscription to %s", filter))
+                }
+            }
+        }
+
+        log.Println("Watchdog running over MQTT v3.1.1...")
+    }
+
+    client := mqtt.NewClient(opts)
+    for {
+        token := client.Connect()
+        token.Wait()
+        if token.Error() != nil {
+            log.Printf("MQTT connect failed: %v, retrying in 10s...", token.Error())
+            time.Sleep(10 * time.Second)
+            continue
+        }
+        break
+    }
+}
+
+func handleMessage(client mqtt.Client, msg mqtt.Message) {
+    handlePublish(msg.Topic(), "", msg.Retained())
+}